@@ -0,0 +1,94 @@
+package sip
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// Number of random bytes in generated identifiers. RFC 3261 19.3 requires at
+// least 32 bits of randomness for tags, branches and Call-IDs use more because
+// they must be unique across space and time.
+const (
+	branch_rand_len = 12
+	tag_rand_len    = 8
+	callid_rand_len = 16
+	hash_len        = 16
+)
+
+// randomHex returns n random bytes from crypto/rand, hex encoded
+func randomHex(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("reading random bytes: " + err.Error())
+	}
+	buf := make([]byte, hex.EncodedLen(n))
+	hex.Encode(buf, b)
+	return buf
+}
+
+// GenerateBranch returns a new Via branch parameter starting with the magic cookie
+func GenerateBranch() []byte {
+	return append([]byte(MagicCookie), randomHex(branch_rand_len)...)
+}
+
+// GenerateTag returns a new From or To tag
+func GenerateTag() []byte {
+	return randomHex(tag_rand_len)
+}
+
+// GenerateCallID returns a new Call-ID, qualified with host unless it is empty
+func GenerateCallID(host string) []byte {
+	callid := randomHex(callid_rand_len)
+	if host != "" {
+		callid = append(callid, '@')
+		callid = append(callid, host...)
+	}
+	return callid
+}
+
+/*
+	 RFC 3261 16.11
+		The proxy examines the branch ID in the topmost Via header field of
+		the received request.  If it begins with the magic cookie, the first
+		component of the branch ID of the outgoing request is computed as a
+		hash of the received branch ID.  Otherwise, the first component of
+		the branch ID is computed as a hash of the topmost Via, the tag in
+		the To header field, the tag in the From header field, the Call-ID
+		header field, the CSeq number (but not method), and the Request-URI
+		from the received request.  One of these fields will always vary
+		across two different transactions.
+*/
+// StatelessBranch returns the branch a stateless proxy puts in the Via it adds to
+// a received request. Retransmissions of the request get the same branch, and
+// so does the ACK of a non-2xx response sent by an RFC 3261 client.
+func StatelessBranch(msg *SIPMessage) []byte {
+	var fields [][]byte
+	if hasMagicCookie(msg.TopmostVia.Branch) {
+		fields = [][]byte{msg.TopmostVia.Branch}
+	} else {
+		fields = [][]byte{
+			msg.TopmostVia.Serialize(),
+			msg.toTag(),
+			msg.fromTag(),
+			msg.callID(),
+			strconv.AppendInt(nil, int64(msg.cseq().Seq), 10),
+		}
+		if msg.Request != nil {
+			fields = append(fields, msg.Request.RequestURI.Serialize())
+		}
+	}
+
+	h := sha256.New()
+	for _, field := range fields {
+		h.Write(field)
+		h.Write([]byte{0}) // Keeps "ab"+"c" apart from "a"+"bc"
+	}
+
+	sum := h.Sum(nil)[:hash_len]
+	branch := make([]byte, len(MagicCookie)+hex.EncodedLen(hash_len))
+	copy(branch, MagicCookie)
+	hex.Encode(branch[len(MagicCookie):], sum)
+	return branch
+}
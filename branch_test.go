@@ -0,0 +1,41 @@
+package sip
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGenerateBranch(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		branch := GenerateBranch()
+		if !hasMagicCookie(branch) {
+			t.Fatalf("GenerateBranch() = %s, missing magic cookie", branch)
+		}
+		if seen[string(branch)] {
+			t.Fatalf("GenerateBranch() returned %s twice", branch)
+		}
+		seen[string(branch)] = true
+	}
+}
+
+func TestStatelessBranch(t *testing.T) {
+	invite := parseTestMessage(t, testInvite)
+	retransmission := parseTestMessage(t, testInvite)
+	other := parseTestMessage(t, testInvite)
+	other.TopmostVia.Branch = GenerateBranch()
+
+	branch := StatelessBranch(invite)
+	if !hasMagicCookie(branch) {
+		t.Errorf("StatelessBranch() = %s, missing magic cookie", branch)
+	}
+	if !bytes.Equal(branch, StatelessBranch(retransmission)) {
+		t.Errorf("StatelessBranch() differs for a retransmission")
+	}
+	if !bytes.Equal(branch, StatelessBranch(initAck(invite))) {
+		t.Errorf("StatelessBranch() differs for the ACK of a non-2xx")
+	}
+	if bytes.Equal(branch, StatelessBranch(other)) {
+		t.Errorf("StatelessBranch() is the same for two transactions")
+	}
+}
@@ -52,28 +52,25 @@ func ParseSipContact(contact []byte) (SIPContact, error) {
 }
 
 func (contact SIPContact) Serialize() []byte {
+	if bytes.Equal(contact.DisName, []byte("*")) {
+		return []byte("*")
+	}
 	uri := contact.Uri.Serialize()
 
 	// Calculate size of buffer
-	size := len(uri)
-	if contact.DisName != nil {
-		size += len(contact.DisName) + 2 // 2 for '<' and '>'
-	}
+	size := len(contact.DisName) + len(uri) + 2 // 2 for '<' and '>'
 	if contact.Paras != nil {
 		size += 1 + len(contact.Paras) // 1 for ';'
 	}
 
 	buffer := make([]byte, 0, size)
 	// Serialize display name if exists
-	if contact.DisName != nil {
-		buffer = append(buffer, contact.DisName...)
-		buffer = append(buffer, '<')
-	}
-	// Serialize URI
+	buffer = append(buffer, contact.DisName...)
+	// Serialize URI, always between '<' and '>' so that its parameters are not
+	// taken for those of the header field
+	buffer = append(buffer, '<')
 	buffer = append(buffer, uri...)
-	if contact.DisName != nil {
-		buffer = append(buffer, '>')
-	}
+	buffer = append(buffer, '>')
 	// Serialize parameters if exists
 	if contact.Paras != nil {
 		buffer = append(buffer, ';')
@@ -0,0 +1,696 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDialogTerminated is returned when using a dialog after it has terminated
+	ErrDialogTerminated = errors.New("dialog terminated")
+	// ErrCSeqOrder is returned for a request of a dialog received out of order,
+	// which must be answered with 500
+	ErrCSeqOrder = errors.New("CSeq lower than the remote sequence number")
+)
+
+// DialogState is the state of a dialog
+type DialogState int
+
+const (
+	DialogEarly DialogState = iota
+	DialogConfirmed
+	DialogTerminated
+)
+
+func (s DialogState) String() string {
+	switch s {
+	case DialogEarly:
+		return "Early"
+	case DialogConfirmed:
+		return "Confirmed"
+	case DialogTerminated:
+		return "Terminated"
+	default:
+		return "Unknown"
+	}
+}
+
+/*
+	RFC 3261 12
+		A dialog is identified at each UA with a dialog ID, which consists of
+		a Call-ID value, a local tag and a remote tag.  The dialog ID at each
+		UA involved in the dialog is not the same.  Specifically, the local
+		tag at one UA is identical to the remote tag at the peer UA.
+*/
+// DialogID identifies a dialog at one of its UAs
+type DialogID struct {
+	CallID    string
+	LocalTag  string
+	RemoteTag string
+}
+
+func (id DialogID) String() string {
+	return id.CallID + ";" + id.LocalTag + ";" + id.RemoteTag
+}
+
+// Dialog is a peer-to-peer relationship between two UAs (RFC 3261 12). It
+// keeps the state needed to build the requests of the dialog and to check the
+// ones received. Its methods may be called concurrently, such as from the
+// callbacks of transactions.
+type Dialog struct {
+	mu    sync.Mutex
+	id    DialogID
+	state DialogState
+	uac   bool // Created by sending the initial request
+
+	init_cseq     SIPCseq // CSeq of the request that created the dialog
+	local_seq     int     // -1 while empty
+	remote_seq    int     // -1 while empty
+	local         SIPFromTo
+	remote        SIPFromTo
+	local_contact SIPContact
+	remote_target SIPUri
+	route_set     [][]byte // Record-Route values, in the order of the Route header field of requests
+
+	sched Scheduler         // Drives the retransmissions of 2xx
+	ack   *SIPMessage       // Last ACK for 2xx built by the UAC
+	ok    *okRetransmission // 2xx retransmitted by the UAS until its ACK
+}
+
+// okRetransmission is a 2xx to an INVITE retransmitted by the UAS core
+type okRetransmission struct {
+	res       *SIPMessage
+	transport Transport
+	timeout   func()
+	interval  time.Duration // Between the last two retransmissions
+	elapsed   time.Duration // Since the 2xx was first sent
+	handle    TimerHandle
+}
+
+/*
+	RFC 3261 12.1.2
+		The route set MUST be set to the list of URIs in the Record-Route
+		header field from the response, taken in reverse order and preserving
+		all URI parameters.  If no Record-Route header field is present in
+		the response, the route set MUST be set to the empty set.  [...]
+		The remote target MUST be set to the URI from the Contact header field
+		of the response.
+
+		The local sequence number MUST be set to the value of the sequence
+		number in the CSeq header field of the request.  The remote sequence
+		number MUST be empty [...].  The call identifier component of the
+		dialog ID MUST be set to the value of the Call-ID in the request.
+		The local tag component of the dialog ID MUST be set to the tag in
+		the From field in the request, and the remote tag component of the
+		dialog ID MUST be set to the tag in the To field of the response.
+*/
+// NewUACDialog creates the dialog of a UAC from a request it sent and a
+// response with a To tag: a 1xx creates an early dialog, a 2xx a confirmed one
+func NewUACDialog(req *SIPMessage, res *SIPMessage) (*Dialog, error) {
+	if res.Response == nil || res.Response.StatusCode <= 100 || res.Response.StatusCode >= 300 {
+		return nil, fmt.Errorf("response does not create a dialog")
+	}
+	local, err := req.from()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := res.to()
+	if err != nil {
+		return nil, err
+	}
+	if len(local.Tag) == 0 || len(remote.Tag) == 0 {
+		return nil, fmt.Errorf("missing tag in From or To header")
+	}
+	local_contact, err := firstContact(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	remote_target, err := firstContact(res)
+	if err != nil {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+
+	d := &Dialog{
+		id: DialogID{
+			CallID:    string(req.callID()),
+			LocalTag:  string(local.Tag),
+			RemoteTag: string(remote.Tag),
+		},
+		uac:           true,
+		init_cseq:     req.cseq(),
+		local_seq:     req.cseq().Seq,
+		remote_seq:    -1,
+		local:         local,
+		remote:        remote,
+		local_contact: local_contact,
+		remote_target: remote_target.Uri,
+		route_set:     reversed(res.Headers[RecordRoute]),
+		sched:         RuntimeScheduler,
+	}
+	if res.Response.StatusCode >= 200 {
+		d.state = DialogConfirmed
+	}
+	return d, nil
+}
+
+/*
+	RFC 3261 12.1.1
+		The route set MUST be set to the list of URIs in the Record-Route
+		header field from the request, taken in order and preserving all URI
+		parameters.  If no Record-Route header field is present in the
+		request, the route set MUST be set to the empty set.  [...]
+		The remote target MUST be set to the URI from the Contact header field
+		of the request.
+
+		The remote sequence number MUST be set to the value of the sequence
+		number in the CSeq header field of the request.  The local sequence
+		number MUST be empty.  The call identifier component of the dialog ID
+		MUST be set to the value of the Call-ID in the request.  The local
+		tag component of the dialog ID MUST be set to the tag in the To field
+		in the response to the request (which always includes a tag), and the
+		remote tag component of the dialog ID MUST be set to the tag from the
+		From field in the request.
+*/
+// NewUASDialog creates the dialog of a UAS from a request it received and the
+// response with a To tag it sends: a 1xx creates an early dialog, a 2xx a
+// confirmed one
+func NewUASDialog(req *SIPMessage, res *SIPMessage) (*Dialog, error) {
+	if res.Response == nil || res.Response.StatusCode <= 100 || res.Response.StatusCode >= 300 {
+		return nil, fmt.Errorf("response does not create a dialog")
+	}
+	remote, err := req.from()
+	if err != nil {
+		return nil, err
+	}
+	local, err := res.to()
+	if err != nil {
+		return nil, err
+	}
+	if len(local.Tag) == 0 || len(remote.Tag) == 0 {
+		return nil, fmt.Errorf("missing tag in From or To header")
+	}
+	remote_target, err := firstContact(req)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	local_contact, err := firstContact(res)
+	if err != nil {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+
+	d := &Dialog{
+		id: DialogID{
+			CallID:    string(req.callID()),
+			LocalTag:  string(local.Tag),
+			RemoteTag: string(remote.Tag),
+		},
+		init_cseq:     req.cseq(),
+		local_seq:     -1,
+		remote_seq:    req.cseq().Seq,
+		local:         local,
+		remote:        remote,
+		local_contact: local_contact,
+		remote_target: remote_target.Uri,
+		route_set:     slices.Clone(req.Headers[RecordRoute]),
+		sched:         RuntimeScheduler,
+	}
+	if res.Response.StatusCode >= 200 {
+		d.state = DialogConfirmed
+	}
+	return d, nil
+}
+
+// ID returns the identifier of the dialog
+func (d *Dialog) ID() DialogID {
+	return d.id
+}
+
+// State returns the state of the dialog
+func (d *Dialog) State() DialogState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// RemoteTarget returns the URI the requests of the dialog are sent to
+func (d *Dialog) RemoteTarget() SIPUri {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remote_target
+}
+
+// RouteSet returns the Route header field values of the requests of the dialog
+func (d *Dialog) RouteSet() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.route_set)
+}
+
+// SetScheduler changes the scheduler driving the retransmissions of 2xx, it
+// must be called before RetransmitOK
+func (d *Dialog) SetScheduler(sched Scheduler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sched = sched
+}
+
+// Terminate ends the dialog, such as once a BYE has been sent, and stops the
+// retransmissions of a 2xx
+func (d *Dialog) Terminate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state = DialogTerminated
+	d.stop_ok()
+}
+
+/*
+	RFC 3261 12.2.1.2
+		When a UAC receives a 2xx response to a target refresh request, it
+		MUST replace the dialog's remote target URI with the URI from the
+		Contact header field in that response, if present.
+
+		If the response for a request within a dialog is a 481
+		(Call/Transaction Does Not Exist) or a 408 (Request Timeout), the UAC
+		SHOULD terminate the dialog.
+
+	RFC 3261 12.3
+		If the dialog is in the "early" state and a non-2xx final response is
+		received, the early dialog terminates.  [...] If the initial request
+		was an INVITE, an early dialog transitions to the "confirmed" state
+		upon receipt of a 2xx final response.
+
+	RFC 3261 22.2
+		When a UAC resubmits a request with its credentials after receiving a
+		401 (Unauthorized) or 407 (Proxy Authentication Required) response, it
+		MUST increment the CSeq header field value as it would normally when
+		sending an updated request.
+*/
+// Response updates the dialog with a response to one of its requests,
+// received by the UAC or sent by the UAS. A 2xx to the initial request
+// confirms an early dialog, whose route set is recomputed from the 2xx at the
+// UAC (RFC 3261 13.2.2.4). A final response to a BYE terminates the dialog,
+// but a 401, 407 or 491, after which the BYE can be sent again with NewRequest.
+func (d *Dialog) Response(res *SIPMessage) {
+	if res.Response == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == DialogTerminated {
+		return
+	}
+
+	code := res.Response.StatusCode
+	cseq := res.cseq()
+	initial := cseq == d.init_cseq
+	switch {
+	case code < 200:
+		if d.uac && initial {
+			d.refresh_target(res)
+		}
+	case code < 300:
+		if d.uac && (initial || isTargetRefresh(cseq.Method)) {
+			d.refresh_target(res)
+		}
+		if initial && d.state == DialogEarly {
+			if d.uac {
+				d.route_set = reversed(res.Headers[RecordRoute])
+			}
+			d.state = DialogConfirmed
+		}
+	default:
+		if initial && d.state == DialogEarly || d.uac && (code == 481 || code == 408) {
+			d.state = DialogTerminated
+		}
+	}
+	if cseq.Method == Bye && code >= 200 && !retryable(code) {
+		d.state = DialogTerminated
+	}
+}
+
+/*
+	RFC 3261 12.2.2
+		If the remote sequence number is empty, it MUST be set to the value
+		of the sequence number in the CSeq header field value in the request.
+		If the remote sequence number was not empty, but the sequence number
+		of the request is lower than the remote sequence number, the request
+		is out of order and MUST be rejected with a 500 (Server Internal
+		Error) response.  If the remote sequence number was not empty, and
+		the sequence number of the request is greater than the remote
+		sequence number, the request is in order.
+
+		When a UAS receives a target refresh request, it MUST replace the
+		dialog's remote target URI with the URI from the Contact header field
+		in that request, if present.
+*/
+// Request updates the dialog with a request of the dialog received from the
+// remote UA. It fails with ErrCSeqOrder for a request out of order, and with
+// ErrDialogTerminated once the dialog has terminated, to be answered with 481.
+// The ACK of a 2xx stops its retransmissions, a BYE terminates the dialog.
+func (d *Dialog) Request(req *SIPMessage) error {
+	if req.Request == nil {
+		return fmt.Errorf("not a request")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == DialogTerminated {
+		return ErrDialogTerminated
+	}
+
+	method := req.Request.Method
+	if method == Ack && d.ok != nil && req.cseq().Seq == d.ok.res.cseq().Seq {
+		d.stop_ok()
+	}
+	if method != Ack && method != Cancel { // Both share the CSeq number of their INVITE
+		seq := req.cseq().Seq
+		if d.remote_seq != -1 && seq < d.remote_seq {
+			return ErrCSeqOrder
+		}
+		d.remote_seq = seq
+	}
+	if isTargetRefresh(method) {
+		d.refresh_target(req)
+	}
+	if method == Bye {
+		d.state = DialogTerminated
+		d.stop_ok()
+	}
+	return nil
+}
+
+/*
+	RFC 3261 12.2.1.1
+		The URI in the To field of the request MUST be set to the remote URI
+		from the dialog state.  The tag in the To header field of the request
+		MUST be set to the remote tag of the dialog ID.  The From URI of the
+		request MUST be set to the local URI from the dialog state.  The tag
+		in the From header field of the request MUST be set to the local tag
+		of the dialog ID.  [...] The Call-ID of the request MUST be set to the
+		Call-ID of the dialog.  Requests within a dialog MUST contain strictly
+		monotonically increasing and contiguous CSeq sequence numbers
+		(increasing-by-one) in each direction [...].
+
+		If the route set is empty, the UAC MUST place the remote target URI
+		into the Request-URI.  The UAC MUST NOT add a Route header field to
+		the request.
+
+		If the route set is not empty, and the first URI in the route set
+		contains the lr parameter (see Section 19.1.1), the UAC MUST place
+		the remote target URI into the Request-URI and MUST include a Route
+		header field containing the route set values in order, including all
+		parameters.
+
+		If the route set is not empty, and its first URI does not contain the
+		lr parameter, the UAC MUST place the first URI from the route set
+		into the Request-URI, stripping any parameters that are not allowed
+		in a Request-URI.  The UAC MUST add a Route header field containing
+		the remainder of the route set values in order, including all
+		parameters.  The UAC MUST then place the remote target URI into the
+		Route header field as the last value.
+*/
+// NewRequest builds a request of the dialog, such as a BYE, a re-INVITE, an
+// INFO, an UPDATE or a REFER. Its Via has a new branch and the address of the
+// local Contact, and target refresh requests carry the local Contact. ACK and
+// CANCEL are not built by NewRequest.
+func (d *Dialog) NewRequest(method SIPMethod) (*SIPMessage, error) {
+	if method == Ack || method == Cancel {
+		return nil, fmt.Errorf("%s is not a request of its own within a dialog", SerializeMethod(method))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == DialogTerminated {
+		return nil, ErrDialogTerminated
+	}
+
+	if d.local_seq == -1 { // An initial value below 2**31
+		d.local_seq = rand.IntN(1 << 30)
+	}
+	d.local_seq++
+	return d.request(method, d.local_seq)
+}
+
+/*
+	RFC 3261 13.2.2.4
+		The UAC core MUST generate an ACK request for each 2xx received from
+		the transaction layer.  The header fields of the ACK are constructed
+		in the same way as for any request sent within a dialog (see Section
+		12) with the exception of the CSeq and the header fields related to
+		authentication.  The sequence number of the CSeq header field MUST be
+		the same as the INVITE being acknowledged, but the CSeq method MUST
+		be ACK.
+*/
+// NewAck builds the ACK for a 2xx to an INVITE of the dialog. The ACK is an
+// end-to-end request of its own, sent without transaction over the transport
+// the INVITE was sent with, once for every 2xx received: retransmissions of
+// the 2xx get the same ACK.
+func (d *Dialog) NewAck(res *SIPMessage) (*SIPMessage, error) {
+	if res.Response == nil || res.Response.StatusCode < 200 || res.Response.StatusCode >= 300 {
+		return nil, fmt.Errorf("ACK of a response other than 2xx")
+	}
+	cseq := res.cseq()
+	if cseq.Method != Invite {
+		return nil, fmt.Errorf("ACK of a response to %s", SerializeMethod(cseq.Method))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ack != nil && d.ack.CSeq.Seq == cseq.Seq {
+		return d.ack, nil
+	}
+
+	ack, err := d.request(Ack, cseq.Seq)
+	if err != nil {
+		return nil, err
+	}
+	d.ack = ack
+	return ack, nil
+}
+
+// request builds a request of the dialog with a CSeq number, d.mu must be held
+func (d *Dialog) request(method SIPMethod, seq int) (*SIPMessage, error) {
+	hdr := make(map[SIPHeader][][]byte)
+	ruri := d.remote_target
+	next := ruri // Where the request is sent, the first route if any
+	if len(d.route_set) > 0 {
+		first, err := ParseSipContact(d.route_set[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing route %q: %w", d.route_set[0], err)
+		}
+		next = first.Uri
+		if _, lr := first.Uri.Param("lr"); lr {
+			hdr[Route] = slices.Clone(d.route_set)
+		} else { // Strict router
+			ruri = first.Uri
+			hdr[Route] = append(slices.Clone(d.route_set[1:]), []byte("<"+string(d.remote_target.Serialize())+">"))
+		}
+	}
+	ruri.Headers = nil
+	if isTargetRefresh(method) {
+		hdr[Contact] = [][]byte{d.local_contact.Serialize()}
+	}
+	hdr[MaxForwards] = [][]byte{[]byte("70")}
+	hdr[ContentLength] = [][]byte{[]byte("0")}
+
+	return &SIPMessage{
+		Startline: Startline{
+			Request: &Request{Method: method, RequestURI: ruri},
+		},
+		From:       d.local,
+		To:         d.remote,
+		CallID:     []byte(d.id.CallID),
+		CSeq:       SIPCseq{Method: method, Seq: seq},
+		TopmostVia: d.via(next),
+		Headers:    hdr,
+		Options: ParseOptions{
+			ParseFrom:       true,
+			ParseTo:         true,
+			ParseCallID:     true,
+			ParseCseq:       true,
+			ParseTopMostVia: true,
+		},
+	}, nil
+}
+
+/*
+	RFC 3261 13.3.1.4
+		The 2xx response is passed to the transport with an
+		interval that starts at T1 seconds and doubles for each
+		retransmission until it reaches T2 seconds (T1 and T2 are defined in
+		Section 17).  Response retransmissions cease when an ACK request for
+		the response is received.  This is independent of whatever transport
+		protocols are used to send the response.
+
+		If the server retransmits the 2xx response for 64*T1 seconds without
+		receiving an ACK, the dialog is confirmed, but the session SHOULD be
+		terminated.  This is accomplished with a BYE, as described in Section
+		15.
+*/
+// RetransmitOK retransmits a 2xx to an INVITE, sent by the INVITE server
+// transaction, over a transport until its ACK is passed to Request. If no ACK
+// arrives within 64*T1, the retransmissions stop and timeout is called from
+// the scheduler, it should send a BYE. A new 2xx replaces the previous one.
+func (d *Dialog) RetransmitOK(res *SIPMessage, transport Transport, timeout func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == DialogTerminated {
+		return
+	}
+	d.stop_ok()
+	d.ok = &okRetransmission{
+		res:       res,
+		transport: transport,
+		timeout:   timeout,
+		interval:  t1 * time.Millisecond,
+	}
+	d.schedule_ok(d.ok, d.ok.interval)
+}
+
+// schedule_ok runs the next retransmission of a 2xx after delay, d.mu must be held
+func (d *Dialog) schedule_ok(r *okRetransmission, delay time.Duration) {
+	r.handle = d.sched.AfterFunc(delay, func() { d.retransmit_ok(r, delay) })
+}
+
+// retransmit_ok sends a 2xx again, or gives up once 64*T1 have elapsed
+func (d *Dialog) retransmit_ok(r *okRetransmission, delay time.Duration) {
+	d.mu.Lock()
+	if d.ok != r { // Acknowledged or replaced meanwhile
+		d.mu.Unlock()
+		return
+	}
+	r.elapsed += delay
+	if r.elapsed >= tiack_dur*time.Millisecond {
+		d.ok = nil
+		d.mu.Unlock()
+		if r.timeout != nil {
+			r.timeout()
+		}
+		return
+	}
+	r.interval = min(2*r.interval, t2*time.Millisecond)
+	d.schedule_ok(r, min(r.interval, tiack_dur*time.Millisecond-r.elapsed))
+	d.mu.Unlock()
+
+	r.transport.Send(r.res)
+}
+
+// stop_ok stops the retransmissions of a 2xx, d.mu must be held
+func (d *Dialog) stop_ok() {
+	if d.ok != nil {
+		d.ok.handle.Stop()
+		d.ok = nil
+	}
+}
+
+// via returns a Via with a new branch and the transport of the next hop of a
+// request, responses are sent back to the address of the local Contact
+func (d *Dialog) via(next SIPUri) SIPVia {
+	return SIPVia{
+		Tranport: next.Transport(),
+		Domain:   d.local_contact.Uri.Domain,
+		Port:     d.local_contact.Uri.Port,
+		Branch:   GenerateBranch(),
+		Opts:     []byte(";rport"),
+	}
+}
+
+// refresh_target replaces the remote target with the Contact of a message, if any
+func (d *Dialog) refresh_target(msg *SIPMessage) {
+	if contact, err := firstContact(msg); err == nil {
+		d.remote_target = contact.Uri
+	}
+}
+
+// retryable reports whether a final response asks for the request to be sent
+// again: with credentials, or later after a glare (RFC 3261 14.1)
+func retryable(code int) bool {
+	return code == 401 || code == 407 || code == 491
+}
+
+// isTargetRefresh reports whether a method can update the remote target of a
+// dialog (RFC 3261 12.2, RFC 3311, RFC 3515, RFC 6665)
+func isTargetRefresh(method SIPMethod) bool {
+	switch method {
+	case Invite, Update, Subscribe, Notify, Refer:
+		return true
+	}
+	return false
+}
+
+// firstContact returns the first Contact of a message
+func firstContact(msg *SIPMessage) (SIPContact, error) {
+	contacts, err := msg.contacts()
+	if err != nil {
+		return SIPContact{}, err
+	}
+	if len(contacts) == 0 {
+		return SIPContact{}, fmt.Errorf("missing Contact header")
+	}
+	return contacts[0], nil
+}
+
+// reversed returns a copy of header field values in reverse order
+func reversed(values [][]byte) [][]byte {
+	values = slices.Clone(values)
+	slices.Reverse(values)
+	return values
+}
+
+// DialogTable holds the dialogs of a UA or of a B2BUA, by dialog ID
+type DialogTable struct {
+	mu      sync.Mutex
+	dialogs map[DialogID]*Dialog
+}
+
+// NewDialogTable creates an empty dialog table
+func NewDialogTable() *DialogTable {
+	return &DialogTable{dialogs: make(map[DialogID]*Dialog)}
+}
+
+// Add inserts a dialog, it fails if the table has a dialog of the same ID
+func (t *DialogTable) Add(d *Dialog) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.dialogs[d.id]; ok {
+		return fmt.Errorf("dialog %s already exists", d.id)
+	}
+	t.dialogs[d.id] = d
+	return nil
+}
+
+// Find returns the dialog of a received message, or nil if there is none: the
+// local tag is the To tag of a request and the From tag of a response.
+// Terminated dialogs are removed instead of being returned.
+func (t *DialogTable) Find(msg *SIPMessage) *Dialog {
+	id := DialogID{CallID: string(msg.callID())}
+	if msg.Request != nil {
+		id.LocalTag, id.RemoteTag = string(msg.toTag()), string(msg.fromTag())
+	} else {
+		id.LocalTag, id.RemoteTag = string(msg.fromTag()), string(msg.toTag())
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.dialogs[id]
+	if d != nil && d.State() == DialogTerminated {
+		delete(t.dialogs, id)
+		return nil
+	}
+	return d
+}
+
+// Remove deletes a dialog from the table
+func (t *DialogTable) Remove(id DialogID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.dialogs, id)
+}
+
+// Len returns the number of dialogs of the table
+func (t *DialogTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.dialogs)
+}
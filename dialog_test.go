@@ -0,0 +1,477 @@
+package sip
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDialogInvite = "INVITE sip:bob@example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bKdlg1\r\n" +
+	"From: Alice <sip:alice@example.com>;tag=a1\r\n" +
+	"To: Bob <sip:bob@example.com>\r\n" +
+	"Call-ID: dlg@192.0.2.1\r\n" +
+	"CSeq: 10 INVITE\r\n" +
+	"Contact: <sip:alice@192.0.2.1:5060>\r\n" +
+	"Record-Route: <sip:p2.example.com;lr>\r\n" +
+	"Record-Route: <sip:p1.example.com;lr>\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+// testDialogResponse answers testDialogInvite with a To tag, the Contact of
+// the UAS and the Record-Route of the request
+func testDialogResponse(t *testing.T, invite *SIPMessage, code int, tag string, contact string) *SIPMessage {
+	t.Helper()
+	res := makeGenericResponse(code, []byte("Reason"), invite)
+	res.setToTag([]byte(tag))
+	res.Headers[Contact] = [][]byte{[]byte(contact)}
+	copyHeaders(res.Headers, invite.Headers, RecordRoute)
+	return res
+}
+
+func TestUACDialog(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	ringing := testDialogResponse(t, invite, 180, "b1", "<sip:bob@192.0.2.2:5070>")
+
+	d, err := NewUACDialog(invite, ringing)
+	if err != nil {
+		t.Fatalf("NewUACDialog() error = %v", err)
+	}
+	if want := (DialogID{CallID: "dlg@192.0.2.1", LocalTag: "a1", RemoteTag: "b1"}); d.ID() != want {
+		t.Errorf("ID() = %v, want %v", d.ID(), want)
+	}
+	if d.State() != DialogEarly {
+		t.Errorf("State() = %v after 180, want Early", d.State())
+	}
+
+	// The 2xx confirms the dialog and carries the final target
+	ok := testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.3>")
+	d.Response(ok)
+	if d.State() != DialogConfirmed {
+		t.Errorf("State() = %v after 200, want Confirmed", d.State())
+	}
+
+	bye, err := d.NewRequest(Bye)
+	if err != nil {
+		t.Fatalf("NewRequest(BYE) error = %v", err)
+	}
+	bye, err = ParseSipMessage(bye.Serialize(), ParseOptions{ParseFrom: true, ParseTo: true, ParseCseq: true, ParseCallID: true, ParseTopMostVia: true})
+	if err != nil {
+		t.Fatalf("parsing BYE: %v", err)
+	}
+	if ruri := string(bye.Request.RequestURI.Serialize()); ruri != "sip:bob@192.0.2.3" {
+		t.Errorf("Request-URI = %s, want the remote target", ruri)
+	}
+	// The UAC reverses the Record-Route of the response
+	if want := []string{"<sip:p1.example.com;lr>", "<sip:p2.example.com;lr>"}; !slices.Equal(byteStrings(bye.Headers[Route]), want) {
+		t.Errorf("Route = %q, want %q", bye.Headers[Route], want)
+	}
+	if string(bye.From.Tag) != "a1" || string(bye.To.Tag) != "b1" || string(bye.CallID) != "dlg@192.0.2.1" {
+		t.Errorf("From tag %s, To tag %s, Call-ID %s, want those of the dialog", bye.From.Tag, bye.To.Tag, bye.CallID)
+	}
+	if bye.CSeq != (SIPCseq{Method: Bye, Seq: 11}) {
+		t.Errorf("CSeq = %v, want 11 BYE", bye.CSeq)
+	}
+	if !strings.HasPrefix(string(bye.TopmostVia.Branch), MagicCookie) || string(bye.TopmostVia.Domain) != "192.0.2.1" || bye.TopmostVia.Port != 5060 {
+		t.Errorf("Via = %s, want a new branch and the local Contact", bye.TopmostVia.Serialize())
+	}
+	if len(bye.Headers[Contact]) != 0 {
+		t.Errorf("BYE has Contact %q", bye.Headers[Contact])
+	}
+
+	// A re-INVITE is a target refresh request with the next CSeq
+	reinvite, _ := d.NewRequest(Invite)
+	if want := []string{"<sip:alice@192.0.2.1:5060>"}; reinvite.CSeq.Seq != 12 || !slices.Equal(byteStrings(reinvite.Headers[Contact]), want) {
+		t.Errorf("re-INVITE CSeq %d with Contact %q, want 12 with %q", reinvite.CSeq.Seq, reinvite.Headers[Contact], want)
+	}
+
+	// The dialog ends with the response to the BYE
+	d.Response(makeGenericResponse(200, []byte("OK"), bye))
+	if d.State() != DialogTerminated {
+		t.Errorf("State() = %v after the BYE, want Terminated", d.State())
+	}
+	if _, err := d.NewRequest(Info); !errors.Is(err, ErrDialogTerminated) {
+		t.Errorf("NewRequest(INFO) error = %v, want ErrDialogTerminated", err)
+	}
+}
+
+func TestUACEarlyDialogTerminates(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	d, err := NewUACDialog(invite, testDialogResponse(t, invite, 183, "b1", "<sip:bob@192.0.2.2>"))
+	if err != nil {
+		t.Fatalf("NewUACDialog() error = %v", err)
+	}
+	d.Response(testDialogResponse(t, invite, 486, "b1", "<sip:bob@192.0.2.2>"))
+	if d.State() != DialogTerminated {
+		t.Errorf("State() = %v after 486, want Terminated", d.State())
+	}
+
+	if _, err := NewUACDialog(invite, makeGenericResponse(180, []byte("Ringing"), invite)); err == nil {
+		t.Errorf("NewUACDialog() of a 180 without To tag succeeded")
+	}
+}
+
+func TestDialogChallengedBye(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	d, err := NewUACDialog(invite, testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2>"))
+	if err != nil {
+		t.Fatalf("NewUACDialog() error = %v", err)
+	}
+
+	bye, _ := d.NewRequest(Bye)
+	d.Response(makeGenericResponse(407, []byte("Proxy Authentication Required"), bye))
+	if d.State() != DialogConfirmed {
+		t.Errorf("State() = %v after a 407 to the BYE, want Confirmed", d.State())
+	}
+
+	// The BYE is sent again with credentials and the next CSeq
+	retry, err := d.NewRequest(Bye)
+	if err != nil {
+		t.Fatalf("NewRequest(BYE) after a 407 error = %v", err)
+	}
+	if retry.CSeq.Seq != bye.CSeq.Seq+1 {
+		t.Errorf("CSeq of the new BYE = %d, want %d", retry.CSeq.Seq, bye.CSeq.Seq+1)
+	}
+	d.Response(makeGenericResponse(403, []byte("Forbidden"), retry))
+	if d.State() != DialogTerminated {
+		t.Errorf("State() = %v after a 403 to the BYE, want Terminated", d.State())
+	}
+}
+
+func TestUASDialog(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	ok := testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2:5070>")
+
+	d, err := NewUASDialog(invite, ok)
+	if err != nil {
+		t.Fatalf("NewUASDialog() error = %v", err)
+	}
+	if want := (DialogID{CallID: "dlg@192.0.2.1", LocalTag: "b1", RemoteTag: "a1"}); d.ID() != want {
+		t.Errorf("ID() = %v, want %v", d.ID(), want)
+	}
+
+	bye, err := d.NewRequest(Bye)
+	if err != nil {
+		t.Fatalf("NewRequest(BYE) error = %v", err)
+	}
+	if ruri := string(bye.Request.RequestURI.Serialize()); ruri != "sip:alice@192.0.2.1:5060" {
+		t.Errorf("Request-URI = %s, want the remote target", ruri)
+	}
+	// The UAS keeps the Record-Route of the request in order
+	if want := []string{"<sip:p2.example.com;lr>", "<sip:p1.example.com;lr>"}; !slices.Equal(byteStrings(bye.Headers[Route]), want) {
+		t.Errorf("Route = %q, want %q", bye.Headers[Route], want)
+	}
+	if string(bye.From.Tag) != "b1" || string(bye.To.Tag) != "a1" {
+		t.Errorf("From tag %s and To tag %s, want b1 and a1", bye.From.Tag, bye.To.Tag)
+	}
+	if string(bye.TopmostVia.Domain) != "192.0.2.2" || bye.TopmostVia.Port != 5070 {
+		t.Errorf("Via = %s, want the local Contact", bye.TopmostVia.Serialize())
+	}
+	// The local sequence number starts at random, below 2**31
+	next, _ := d.NewRequest(Info)
+	if next.CSeq.Seq != bye.CSeq.Seq+1 || bye.CSeq.Seq <= 0 || bye.CSeq.Seq >= 1<<31 {
+		t.Errorf("CSeq numbers %d and %d, want contiguous ones below 2**31", bye.CSeq.Seq, next.CSeq.Seq)
+	}
+}
+
+func TestDialogViaTransport(t *testing.T) {
+	// The transport of the Via is the one of the first route, where the
+	// request is sent, not the one of the remote target
+	raw := strings.Replace(testDialogInvite, "<sip:p1.example.com;lr>", "<sip:p1.example.com;transport=tcp;lr>", 1)
+	invite := parseTestMessage(t, raw)
+	d, err := NewUACDialog(invite, testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2>"))
+	if err != nil {
+		t.Fatalf("NewUACDialog() error = %v", err)
+	}
+	bye, _ := d.NewRequest(Bye)
+	if bye.TopmostVia.Tranport != "tcp" {
+		t.Errorf("Via transport = %q, want tcp", bye.TopmostVia.Tranport)
+	}
+
+	// Without routes, the request is sent to the remote target
+	raw = strings.Replace(testDialogInvite, "Record-Route: <sip:p2.example.com;lr>\r\n", "", 1)
+	invite = parseTestMessage(t, strings.Replace(raw, "Record-Route: <sip:p1.example.com;lr>\r\n", "", 1))
+	d, err = NewUACDialog(invite, testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2;transport=tcp>"))
+	if err != nil {
+		t.Fatalf("NewUACDialog() error = %v", err)
+	}
+	bye, _ = d.NewRequest(Bye)
+	if bye.TopmostVia.Tranport != "tcp" {
+		t.Errorf("Via transport without routes = %q, want tcp", bye.TopmostVia.Tranport)
+	}
+}
+
+func TestDialogStrictRoute(t *testing.T) {
+	raw := strings.Replace(testDialogInvite, "Record-Route: <sip:p2.example.com;lr>\r\n", "Record-Route: <sip:p2.example.com>\r\n", 1)
+	invite := parseTestMessage(t, raw)
+	d, err := NewUASDialog(invite, testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2>"))
+	if err != nil {
+		t.Fatalf("NewUASDialog() error = %v", err)
+	}
+
+	bye, _ := d.NewRequest(Bye)
+	if ruri := string(bye.Request.RequestURI.Serialize()); ruri != "sip:p2.example.com" {
+		t.Errorf("Request-URI = %s, want the strict router", ruri)
+	}
+	if want := []string{"<sip:p1.example.com;lr>", "<sip:alice@192.0.2.1:5060>"}; !slices.Equal(byteStrings(bye.Headers[Route]), want) {
+		t.Errorf("Route = %q, want %q", bye.Headers[Route], want)
+	}
+}
+
+func TestDialogRequest(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	d, err := NewUASDialog(invite, testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2>"))
+	if err != nil {
+		t.Fatalf("NewUASDialog() error = %v", err)
+	}
+
+	request := func(method string, seq string, contact string) *SIPMessage {
+		raw := strings.Replace(testDialogInvite, "INVITE sip:bob", method+" sip:bob", 1)
+		raw = strings.Replace(raw, "CSeq: 10 INVITE", "CSeq: "+seq+" "+method, 1)
+		raw = strings.Replace(raw, "<sip:alice@192.0.2.1:5060>", contact, 1)
+		raw = strings.Replace(raw, "To: Bob <sip:bob@example.com>", "To: Bob <sip:bob@example.com>;tag=b1", 1)
+		return parseTestMessage(t, raw)
+	}
+
+	if err := d.Request(request("ACK", "10", "<sip:alice@192.0.2.1:5060>")); err != nil {
+		t.Errorf("Request(ACK) error = %v", err)
+	}
+	// A re-INVITE moves the remote target
+	if err := d.Request(request("INVITE", "11", "<sip:alice@192.0.2.9>")); err != nil {
+		t.Fatalf("Request(re-INVITE) error = %v", err)
+	}
+	if target := string(d.RemoteTarget().Serialize()); target != "sip:alice@192.0.2.9" {
+		t.Errorf("RemoteTarget() = %s after the re-INVITE", target)
+	}
+	if err := d.Request(request("INFO", "5", "<sip:alice@192.0.2.9>")); !errors.Is(err, ErrCSeqOrder) {
+		t.Errorf("Request(INFO with an old CSeq) error = %v, want ErrCSeqOrder", err)
+	}
+	if err := d.Request(request("BYE", "12", "<sip:alice@192.0.2.9>")); err != nil || d.State() != DialogTerminated {
+		t.Errorf("Request(BYE) error = %v, state %v, want Terminated", err, d.State())
+	}
+}
+
+func TestDialogTable(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	table := NewDialogTable()
+
+	// Forked responses create one dialog each
+	res1 := testDialogResponse(t, invite, 180, "b1", "<sip:bob@192.0.2.2>")
+	res2 := testDialogResponse(t, invite, 200, "b2", "<sip:bob@192.0.2.3>")
+	for _, res := range []*SIPMessage{res1, res2} {
+		d, err := NewUACDialog(invite, res)
+		if err != nil {
+			t.Fatalf("NewUACDialog() error = %v", err)
+		}
+		if err := table.Add(d); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if d, _ := NewUACDialog(invite, res1); table.Add(d) == nil {
+		t.Errorf("Add() of a dialog already in the table succeeded")
+	}
+	if table.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", table.Len())
+	}
+
+	d := table.Find(res2)
+	if d == nil || d.ID().RemoteTag != "b2" {
+		t.Fatalf("Find(response) = %v, want the dialog of tag b2", d)
+	}
+	// A request of the remote UA has the tags the other way round
+	bye, _ := d.NewRequest(Bye)
+	bye.From, bye.To = bye.To, bye.From
+	if got := table.Find(bye); got != d {
+		t.Errorf("Find(request) = %v, want the dialog of tag b2", got)
+	}
+
+	d.Terminate()
+	if table.Find(res2) != nil || table.Len() != 1 {
+		t.Errorf("terminated dialog still found, %d dialogs", table.Len())
+	}
+}
+
+func byteStrings(values [][]byte) []string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = string(v)
+	}
+	return strs
+}
+
+func TestDialogNewAck(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	ok := testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.3>")
+	d, err := NewUACDialog(invite, ok)
+	if err != nil {
+		t.Fatalf("NewUACDialog() error = %v", err)
+	}
+
+	ack, err := d.NewAck(ok)
+	if err != nil {
+		t.Fatalf("NewAck() error = %v", err)
+	}
+	// An end-to-end request of the dialog with the CSeq number of the INVITE
+	if ack.CSeq != (SIPCseq{Method: Ack, Seq: 10}) {
+		t.Errorf("CSeq = %v, want 10 ACK", ack.CSeq)
+	}
+	if ruri := string(ack.Request.RequestURI.Serialize()); ruri != "sip:bob@192.0.2.3" {
+		t.Errorf("Request-URI = %s, want the remote target", ruri)
+	}
+	if want := []string{"<sip:p1.example.com;lr>", "<sip:p2.example.com;lr>"}; !slices.Equal(byteStrings(ack.Headers[Route]), want) {
+		t.Errorf("Route = %q, want %q", ack.Headers[Route], want)
+	}
+	if string(ack.To.Tag) != "b1" || string(ack.TopmostVia.Branch) == "z9hG4bKdlg1" || len(ack.Headers[Contact]) != 0 {
+		t.Errorf("ACK with To tag %s, branch %s and Contact %q, want the remote tag, a new branch and no Contact",
+			ack.To.Tag, ack.TopmostVia.Branch, ack.Headers[Contact])
+	}
+
+	// Retransmissions of the 2xx are acknowledged with the same ACK
+	if again, _ := d.NewAck(ok); again != ack {
+		t.Errorf("NewAck() of a retransmitted 2xx built another ACK")
+	}
+	// The ACK of a re-INVITE is a new one
+	reinvite, _ := d.NewRequest(Invite)
+	if again, _ := d.NewAck(makeGenericResponse(200, []byte("OK"), reinvite)); again == ack || again.CSeq.Seq != reinvite.CSeq.Seq {
+		t.Errorf("ACK of the re-INVITE has CSeq %d, want %d", again.CSeq.Seq, reinvite.CSeq.Seq)
+	}
+
+	if _, err := d.NewAck(testDialogResponse(t, invite, 486, "b1", "<sip:bob@192.0.2.3>")); err == nil {
+		t.Errorf("NewAck() of a 486 succeeded")
+	}
+}
+
+func TestDialogRetransmitOK(t *testing.T) {
+	invite := parseTestMessage(t, testDialogInvite)
+	ok := testDialogResponse(t, invite, 200, "b1", "<sip:bob@192.0.2.2>")
+
+	start := func() (*Dialog, *FakeClock, *Loopback, *int) {
+		d, err := NewUASDialog(invite, ok)
+		if err != nil {
+			t.Fatalf("NewUASDialog() error = %v", err)
+		}
+		clock := NewFakeClock()
+		d.SetScheduler(clock)
+		transport := NewLoopback("udp", "", "")
+		timeouts := new(int)
+		d.RetransmitOK(ok, transport, func() { *timeouts++ })
+		return d, clock, transport, timeouts
+	}
+
+	// T1, 2*T1, 4*T1 until the ACK
+	d, clock, transport, timeouts := start()
+	clock.Advance(4 * time.Second)
+	if n := len(transport.Sent()); n != 3 {
+		t.Errorf("2xx retransmitted %d times in 4s, want 3", n)
+	}
+	ack := strings.Replace(testDialogInvite, "INVITE sip:bob", "ACK sip:bob", 1)
+	ack = strings.Replace(ack, "CSeq: 10 INVITE", "CSeq: 10 ACK", 1)
+	if err := d.Request(parseTestMessage(t, ack)); err != nil {
+		t.Fatalf("Request(ACK) error = %v", err)
+	}
+	clock.Advance(time.Minute)
+	if n := len(transport.Sent()); n != 3 || *timeouts != 0 {
+		t.Errorf("2xx retransmitted %d times and %d timeouts after the ACK, want 3 and none", n, *timeouts)
+	}
+
+	// Up to T2 and for 64*T1 without ACK
+	_, clock, transport, timeouts = start()
+	clock.Advance(tiack_dur*time.Millisecond - time.Millisecond)
+	if n := len(transport.Sent()); n != 10 || *timeouts != 0 {
+		t.Errorf("2xx retransmitted %d times and %d timeouts before 64*T1, want 10 and none", n, *timeouts)
+	}
+	clock.Advance(time.Millisecond)
+	if *timeouts != 1 {
+		t.Errorf("%d timeouts after 64*T1 without ACK, want 1", *timeouts)
+	}
+	clock.Advance(time.Minute)
+	if n := len(transport.Sent()); n != 10 || *timeouts != 1 {
+		t.Errorf("2xx retransmitted %d times with %d timeouts, want no more after the timeout", n, *timeouts)
+	}
+}
+
+func TestNetworkAckFor2xx(t *testing.T) {
+	n := newTestNetwork(t, 1)
+	uac := n.AddHost(uacAddr)
+	uas := n.AddHost(uasAddr)
+	n.SetDefaultLink(Link{Latency: 10 * time.Millisecond})
+
+	raw := strings.Replace(testDialogInvite, "Record-Route: <sip:p2.example.com;lr>\r\n", "", 1)
+	raw = strings.Replace(raw, "Record-Route: <sip:p1.example.com;lr>\r\n", "", 1)
+	raw = strings.Replace(raw, "Contact: <sip:alice@192.0.2.1:5060>", "Contact: <sip:alice@"+uacAddr+">", 1)
+
+	// The UAS answers with 200, retransmitted until the ACK
+	dialogs := NewDialogTable()
+	timeouts := 0
+	uas.Handle(func(msg *SIPMessage, transport Transport) {
+		if msg.Request.Method == Ack {
+			if d := dialogs.Find(msg); d != nil {
+				d.Request(msg)
+			}
+			return
+		}
+		trans, err := uas.Stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+		if err != nil {
+			t.Errorf("StartServerTrans() error = %v", err)
+			return
+		}
+		ok := makeGenericResponse(200, []byte("OK"), msg)
+		ok.setToTag(GenerateTag())
+		ok.Headers[Contact] = [][]byte{[]byte("<sip:bob@" + uasAddr + ">")}
+		d, err := NewUASDialog(msg, ok)
+		if err != nil {
+			t.Errorf("NewUASDialog() error = %v", err)
+			return
+		}
+		d.SetScheduler(n.Clock)
+		dialogs.Add(d)
+		trans.Event(ok)
+		d.RetransmitOK(ok, ResponseTransport(msg.TopmostVia, transport), func() { timeouts++ })
+	})
+
+	// The UAC acknowledges every 2xx, the first ACK is lost
+	var oks, acks []string
+	n.Tap(func(src, _ string, msg *SIPMessage) {
+		if src == uasAddr && msg.Response != nil && msg.Response.StatusCode == 200 {
+			oks = append(oks, string(msg.To.Tag))
+		} else if src == uacAddr && msg.Request != nil && msg.Request.Method == Ack {
+			acks = append(acks, string(msg.TopmostVia.Branch))
+		}
+	})
+	target, _ := uac.Transport(Destination{Protocol: "udp", Addr: uasAddr})
+	invite := parseTestMessage(t, raw)
+	var d *Dialog
+	_, err := uac.Stack.StartClientTrans(invite, target,
+		func(_ Transport, res *SIPMessage) {
+			if res.Response.StatusCode < 200 {
+				return
+			}
+			if d == nil {
+				d, _ = NewUACDialog(invite, res)
+			}
+			if ack, err := d.NewAck(res); err == nil {
+				target.Send(ack)
+			}
+		},
+		nil,
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+
+	n.Clock.Advance(15 * time.Millisecond)
+	n.SetLink(uacAddr, uasAddr, Link{Latency: 10 * time.Millisecond, Loss: 1})
+	n.Clock.Advance(10 * time.Millisecond)
+	n.SetLink(uacAddr, uasAddr, Link{Latency: 10 * time.Millisecond})
+	n.Clock.Advance(time.Minute)
+
+	if len(oks) != 2 || len(acks) != 2 || acks[0] != acks[1] {
+		t.Errorf("200 sent %d times and ACK branches %v, want the 200 and the ACK sent twice", len(oks), acks)
+	}
+	if timeouts != 0 || d == nil || d.State() != DialogConfirmed {
+		t.Errorf("%d timeouts, UAC dialog %v, want a confirmed call", timeouts, d)
+	}
+}
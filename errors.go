@@ -0,0 +1,70 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Causes of an abnormal termination, test them with errors.Is. A transaction
+// that terminates normally reports a nil error.
+var (
+	ErrTimeout   = errors.New("transaction timed out")
+	ErrTransport = errors.New("transport error")
+	ErrShutdown  = errors.New("transaction layer shut down")
+)
+
+// TimeoutError reports the timer that terminated a transaction without a
+// response, such as Timer B or Timer F, or without an ACK, such as Timer H
+type TimeoutError struct {
+	Timer string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s fired", ErrTimeout, e.Timer)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// TransportError wraps the error returned by the transport callback when a
+// message could not be sent
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrTransport, e.Err)
+}
+
+func (e *TransportError) Is(target error) bool {
+	return target == ErrTransport
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+/*
+	 RFC 3261 18.4
+		If the transport user asks for a message to be sent over an
+		unreliable transport, and the result is an ICMP error, the behavior
+		depends on the type of ICMP error.  Host, network, port or protocol
+		unreachable errors, or parameter problem errors SHOULD cause the
+		transport layer to inform the transport user of a failure in
+		sending.  Source quench and TTL exceeded ICMP errors SHOULD be
+		ignored.
+
+		If the transport user asks for a request to be sent over a reliable
+		transport, and the result is a connection failure, the transport
+		layer SHOULD inform the transport user of a failure in sending.
+*/
+// IsUnreachable reports whether err was caused by the destination being
+// unreachable, which is how the kernel reports ICMP unreachable messages on
+// sockets and refused TCP connections
+func IsUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
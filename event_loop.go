@@ -0,0 +1,185 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// Size of the queue of a shard above which Event drops messages. Timer
+// expirations and internal events are never dropped.
+const loop_queue_len = 1 << 16
+
+// ErrNotStateMachine is returned when a transaction is not one of the four
+// state machines of the package
+var ErrNotStateMachine = errors.New("transaction is not a state machine of this package")
+
+// EventLoop runs transactions as pure state machines on a fixed number of
+// worker goroutines, instead of one goroutine per transaction. Every
+// transaction is bound to a shard by hashing its ID, so its events are
+// handled in order by the same worker. Callbacks run on the worker and must
+// not block, or they hold up every transaction of the shard.
+type EventLoop struct {
+	shards  []*loopShard
+	wg      sync.WaitGroup
+	pending *loopPending
+}
+
+// loopPending counts the events queued or being handled by the workers
+type loopPending struct {
+	mu   sync.Mutex
+	n    int
+	zero *sync.Cond // Broadcast when n drops to zero
+}
+
+// loopShard is the queue of events of a worker
+type loopShard struct {
+	mu      sync.Mutex
+	queue   []loopEvent
+	wake    chan struct{} // Signaled when the queue becomes non empty
+	closed  bool
+	pending *loopPending
+}
+
+type loopEvent struct {
+	m  machine
+	ev TransEvent
+}
+
+// NewEventLoop starts an event loop with n workers. Close must be called to
+// release them.
+func NewEventLoop(n int) *EventLoop {
+	l := &EventLoop{shards: make([]*loopShard, n), pending: &loopPending{}}
+	l.pending.zero = sync.NewCond(&l.pending.mu)
+	l.wg.Add(n)
+	for i := range l.shards {
+		sh := &loopShard{wake: make(chan struct{}, 1), pending: l.pending}
+		l.shards[i] = sh
+		go func() {
+			defer l.wg.Done()
+			sh.work()
+		}()
+	}
+	return l
+}
+
+// Start runs a transaction created by MakeICT, MakeIST, MakeNICT or MakeNIST
+// on the loop, in place of its Start method. It terminates with ErrShutdown
+// when ctx is done.
+func (l *EventLoop) Start(ctx context.Context, trans SIPTransaction) error {
+	return l.start(ctx, trans, nil)
+}
+
+// start binds the transaction to its shard and queues its StartEvent, exit is
+// called once the transaction has terminated
+func (l *EventLoop) start(ctx context.Context, trans SIPTransaction, exit func()) error {
+	m, ok := trans.(machine)
+	if !ok {
+		return ErrNotStateMachine
+	}
+	b := m.base()
+	sh := l.shard(b.id)
+
+	b.post = func(ev TransEvent, force bool) bool {
+		return sh.push(loopEvent{m: m, ev: ev}, force)
+	}
+	if b.spawn == nil {
+		b.spawn = func(_ TransID, t SIPTransaction) error { return l.start(ctx, t, nil) }
+	}
+	stop := context.AfterFunc(ctx, func() { b.post(TransEvent{Kind: ShutdownEvent}, true) })
+	b.exit = func() {
+		stop()
+		if exit != nil {
+			exit()
+		}
+	}
+
+	sh.push(loopEvent{m: m, ev: TransEvent{Kind: StartEvent}}, true)
+	return nil
+}
+
+// shard returns the shard of a transaction
+func (l *EventLoop) shard(id TransID) *loopShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return l.shards[h.Sum32()%uint32(len(l.shards))]
+}
+
+// Close stops the workers once the events already queued have been handled.
+// Transactions still running never terminate, shut them down first.
+func (l *EventLoop) Close() {
+	for _, sh := range l.shards {
+		sh.mu.Lock()
+		sh.closed = true
+		sh.mu.Unlock()
+		sh.signal()
+	}
+	l.wg.Wait()
+}
+
+// settle waits until every queued event has been handled, including the
+// events queued meanwhile. It must not be called from a worker.
+func (l *EventLoop) settle() {
+	l.pending.mu.Lock()
+	for l.pending.n > 0 {
+		l.pending.zero.Wait()
+	}
+	l.pending.mu.Unlock()
+}
+
+func (p *loopPending) add(delta int) {
+	p.mu.Lock()
+	p.n += delta
+	if p.n == 0 {
+		p.zero.Broadcast()
+	}
+	p.mu.Unlock()
+}
+
+// push queues an event, a message is dropped if the queue is full unless force is set
+func (sh *loopShard) push(e loopEvent, force bool) bool {
+	sh.mu.Lock()
+	if sh.closed || !force && len(sh.queue) >= loop_queue_len {
+		sh.mu.Unlock()
+		return false
+	}
+	sh.queue = append(sh.queue, e)
+	sh.pending.add(1)
+	sh.mu.Unlock()
+	sh.signal()
+	return true
+}
+
+func (sh *loopShard) signal() {
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work handles the queued events in batches, swapping the queue with the
+// previous batch so that both buffers are reused
+func (sh *loopShard) work() {
+	var batch []loopEvent
+	for range sh.wake {
+		sh.mu.Lock()
+		batch, sh.queue = sh.queue, batch[:0]
+		closed := sh.closed
+		sh.mu.Unlock()
+
+		for i, e := range batch {
+			if e.ev.Kind == callEvent {
+				e.ev.call()
+			} else {
+				e.m.base().execute(e.m, e.m.Handle(e.ev))
+			}
+			batch[i] = loopEvent{}
+			sh.pending.add(-1)
+		}
+
+		if closed {
+			return
+		}
+	}
+}
@@ -1,127 +1,71 @@
 package main
 
 import (
-	"sync"
-
 	"github.com/datism/sip"
 	"github.com/rs/zerolog/log"
 )
 
-var (
-	mu sync.Mutex
-	m  = make(map[sip.TransID]sip.SIPTransaction)
-)
+var stack = sip.NewStack()
 
-func HandleMessage(msg *sip.SIPMessage, transport *sip.SIPTransport) {
-	log.Trace().Interface("message", msg).Msg("Handle message")
+// resolver locates the next hop of requests, over UDP as the proxy only listens on UDP
+var resolver = &sip.Resolver{Transports: []string{"udp"}}
 
-	mu.Lock()
-	if trans := FindTrans(msg); trans != nil {
-		trans.Event(msg)
-		mu.Unlock()
-	} else {
-		mu.Unlock()
-		if msg.Request == nil {
-			//log.Error().Msg("Cannot start new sip with response")
-			return
-		}
+// transport receives the messages of the stack and sends the ones of its transactions
+var transport *sip.TransportLayer
 
-		if msg.Request.Method == sip.Ack {
-			log.Debug().Msg("Cannot start new sip with ack request...process stateless")
-			StatelessRoute(msg, transport)
-			return
-		}
+// HandleMessage handles the messages matching no transaction
+func HandleMessage(msg *sip.SIPMessage, transport sip.Transport) {
+	log.Trace().Interface("message", msg).Msg("Handle message")
 
-		StatefullRoute(msg, transport)
+	if msg.Request == nil {
+		// Responses matching no client transaction
+		return
 	}
-}
 
-func StartServerTrans(
-	msg *sip.SIPMessage,
-	transport *sip.SIPTransport,
-	core_cb func(*sip.SIPTransport, *sip.SIPMessage),
-	tranport_cb func(*sip.SIPTransport, *sip.SIPMessage) bool,
-	term_cb func(sip.TransID, sip.TERM_REASON),
-) sip.SIPTransaction {
-	tid, err := sip.MakeServerTransactionID(msg)
-	if err != nil {
-		log.Error().Msg("Cannot create sip")
-		return nil
+	if msg.Request.Method == sip.Ack {
+		log.Debug().Msg("Cannot start new sip with ack request...process stateless")
+		StatelessRoute(msg, transport)
+		return
 	}
 
-	var trans sip.SIPTransaction
-
-	if msg.Request.Method == sip.Invite {
-		trans = sip.MakeIST(tid, msg, transport, core_cb, tranport_cb, term_cb)
-	} else {
-		trans = sip.MakeNIST(tid, msg, transport, core_cb, tranport_cb, term_cb)
+	if msg.Request.Method == sip.Cancel {
+		CancelRoute(msg, transport)
+		return
 	}
 
-	log.Debug().Msg("Start server sip with trans id: " + tid.String())
-
-	mu.Lock()
-	m[tid] = trans
-	mu.Unlock()
-	go trans.Start()
-	return trans
+	StatefullRoute(msg, transport)
 }
 
-func StartClientTrans(
+func StartServerTrans(
 	msg *sip.SIPMessage,
-	transport *sip.SIPTransport,
-	core_cb func(*sip.SIPTransport, *sip.SIPMessage),
-	tranport_cb func(*sip.SIPTransport, *sip.SIPMessage) bool,
-	term_cb func(sip.TransID, sip.TERM_REASON),
+	transport sip.Transport,
+	core_cb func(sip.Transport, *sip.SIPMessage),
+	tranport_cb func(sip.Transport, *sip.SIPMessage) error,
+	term_cb func(sip.TransID, error),
 ) sip.SIPTransaction {
-
-	tid, err := sip.MakeClientTransactionID(msg)
+	trans, err := stack.StartServerTrans(msg, transport, core_cb, tranport_cb, term_cb)
 	if err != nil {
-		log.Error().Msg("Cannot create sip ID")
+		log.Error().Err(err).Msg("Cannot start server sip")
 		return nil
 	}
 
-	var trans sip.SIPTransaction
-
-	if msg.CSeq.Method == sip.Invite {
-		trans = sip.MakeICT(tid, msg, transport, core_cb, tranport_cb, term_cb)
-	} else {
-		trans = sip.MakeNICT(tid, msg, transport, core_cb, tranport_cb, term_cb)
-	}
-
-	log.Debug().Msg("Start client sip with trans id: " + tid.String())
-
-	mu.Lock()
-	m[tid] = trans
-	mu.Unlock()
-	go trans.Start()
+	log.Debug().Msg("Started server sip")
 	return trans
 }
 
-func DeleteTrans(tid sip.TransID) {
-	log.Debug().Msg("Delete sip with ID: " + tid.String())
-	mu.Lock()
-	delete(m, tid)
-	mu.Unlock()
-}
-
-func FindTrans(msg *sip.SIPMessage) sip.SIPTransaction {
-	var tid sip.TransID
-	var err error
-	if msg.Request != nil {
-		tid, err = sip.MakeServerTransactionID(msg)
-	} else {
-		tid, err = sip.MakeClientTransactionID(msg)
-	}
-
+func StartClientTrans(
+	msg *sip.SIPMessage,
+	targets []sip.Transport,
+	core_cb func(sip.Transport, *sip.SIPMessage),
+	tranport_cb func(sip.Transport, *sip.SIPMessage) error,
+	term_cb func(sip.TransID, error),
+) *sip.Failover {
+	trans, err := stack.StartClientTransFailover(msg, targets, core_cb, tranport_cb, term_cb)
 	if err != nil {
-		log.Error().Msg("Cannot create sip ID")
+		log.Error().Err(err).Msg("Cannot start client sip")
 		return nil
 	}
 
-	if result, ok := m[tid]; ok {
-		log.Debug().Msg("Found sip with ID: " + tid.String())
-		return result
-	}
-
-	return nil
+	log.Debug().Msg("Started client sip")
+	return trans
 }
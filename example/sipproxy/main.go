@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/arl/statsviz"
@@ -46,68 +48,36 @@ func main() {
 
 	go httpServer(":8080")
 
-	// Create UDP address
-	udpAddr, err := net.ResolveUDPAddr("udp", *addr)
-	if err != nil {
-		log.Error().Err(err).Msg("Error resolving UDP address")
-		os.Exit(1)
+	transport = sip.NewTransportLayer(stack, HandleMessage)
+	transport.Options = sip.ParseOptions{
+		ParseFrom:       true,
+		ParseTo:         true,
+		ParseCseqByType: true,
+		ParseTopMostVia: true,
 	}
-
-	// Create UDP socket
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
+	if err := transport.ListenUDP(*addr); err != nil {
 		log.Error().Err(err).Msg("Error creating UDP socket")
 		os.Exit(1)
 	}
-	defer conn.Close()
 
 	log.Info().Msgf("Listening on %s", *addr)
 
-	// Buffer to store incoming data
-	buffer := make([]byte, 1024) // 1 KB buffer
-
-	for {
-		// Read from UDP socket
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Error().Err(err).Msg("Error reading from UDP socket")
-			continue
-		}
-
-		// Copy the data to prevent data races
-		data := make([]byte, n)
-		copy(data, buffer[:n])
-
-		// Handle each message in a new goroutine
-		go handleMessage(conn, clientAddr, data)
-	}
+	gracefulShutdown()
 }
 
-func handleMessage(conn *net.UDPConn, clientAddr *net.UDPAddr, data []byte) {
-	// Log received message
-	log.Debug().
-		Int("bytes", len(data)).
-		Str("client", clientAddr.String()).
-		Msg("Received message")
-
-	msg, err := sip.ParseSipMessage(data, sip.ParseOptions{
-		ParseFrom:       true,
-		ParseTo:         true,
-		ParseCseqByType: true,
-		ParseTopMostVia: true,
-	})
-	if err != nil {
-		log.Error().Err(err).Msg("Error parsing SIP request")
-		return
-	}
-
-	transport := &sip.SIPTransport{
-		Protocol:   "udp",
-		Conn:       conn,
-		LocalAddr:  conn.LocalAddr().String(),
-		RemoteAddr: clientAddr.String(),
+// gracefulShutdown drains the transaction layer on SIGINT/SIGTERM before closing the sockets
+func gracefulShutdown() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	<-sigc
+
+	log.Info().Msg("Shutting down, waiting for transactions to drain")
+	ctx, cancel := context.WithTimeout(context.Background(), 32*time.Second)
+	defer cancel()
+	if err := stack.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Transactions aborted")
 	}
-	HandleMessage(msg, transport)
+	transport.Close()
 }
 
 func httpServer(address string) {
@@ -1,113 +1,134 @@
 package main
 
 import (
-	"math/rand"
+	"context"
 	"net"
-	"strconv"
+	"sync"
 
 	"github.com/datism/sip"
 	"github.com/rs/zerolog/log"
 )
 
 func GetMapSize() int {
-	mu.Lock()
-	defer mu.Unlock()
-	return len(m)
+	return stack.Len()
 }
 
-func StatefullRoute(request *sip.SIPMessage, transp *sip.SIPTransport) {
+// cancels holds the channel of the route of every INVITE being forwarded, by
+// ID of its server transaction
+var cancels sync.Map
+
+// CancelRoute answers a CANCEL hop by hop: the stack answers the matching
+// INVITE server transaction with 487, and the route of the INVITE cancels the
+// forwarded one.
+func CancelRoute(request *sip.SIPMessage, transp sip.Transport) {
+	if tid, err := sip.MakeCancelTargetID(request); err == nil {
+		if route, ok := cancels.Load(tid); ok {
+			select {
+			case route.(chan *sip.SIPMessage) <- request:
+			default: // Already cancelled
+			}
+		}
+	}
+	StartServerTrans(request, transp,
+		func(sip.Transport, *sip.SIPMessage) {},
+		nil,
+		func(sip.TransID, error) {},
+	)
+}
+
+func StatefullRoute(request *sip.SIPMessage, transp sip.Transport) {
 	strans_chan := make(chan *sip.SIPMessage, 3)
 	ctrans_chan := make(chan *sip.SIPMessage, 3)
+	cancel_chan := make(chan *sip.SIPMessage, 1)
 
-	strans_core_cb := func(transport *sip.SIPTransport, message *sip.SIPMessage) {
+	if request.Request.Method == sip.Invite {
+		if tid, err := sip.MakeServerTransactionID(request); err == nil {
+			cancels.Store(tid, cancel_chan)
+			defer cancels.Delete(tid)
+		}
+	}
+
+	strans_core_cb := func(transport sip.Transport, message *sip.SIPMessage) {
 		strans_chan <- message
 	}
 
-	ctrans_core_cb := func(transport *sip.SIPTransport, message *sip.SIPMessage) {
+	ctrans_core_cb := func(transport sip.Transport, message *sip.SIPMessage) {
 		ctrans_chan <- message
 	}
 
-	trpt_cb := func(transport *sip.SIPTransport, msg *sip.SIPMessage) bool {
-		bin := msg.Serialize()
-		if bin == nil {
-			//serialize
-			log.Error().Msg("Error serialize sip message")
-			return false
-		}
-
-		udpConn, ok := transport.Conn.(*net.UDPConn)
-		if !ok {
-			log.Error().Msg("Error transport type")
-			return false
-		}
-
-		daddr, err := net.ResolveUDPAddr("udp", transport.RemoteAddr)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to resolve UDP address")
-			return false
-		}
-
-		_, err = udpConn.WriteTo(bin, daddr)
+	strans_term_cb := func(id sip.TransID, err error) {
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to write to UDP connection")
-			return false
-		}
-
-		return true
-	}
-
-	strans_term_cb := func(id sip.TransID, reason sip.TERM_REASON) {
-		if reason != sip.NORMAL {
-			log.Error().Str("siptrans_id", id.String()).Msg("sip terminated with error " + reason.String())
-			strans_chan <- nil
+			log.Error().Err(err).Str("siptrans_id", id.String()).Msg("sip terminated with error")
 		} else {
 			log.Debug().Str("siptrans_id", id.String()).Msg("sip terminated normally")
 		}
-		DeleteTrans(id)
+		strans_chan <- nil
 	}
 
-	ctrans_term_cb := func(id sip.TransID, reason sip.TERM_REASON) {
-		if reason != sip.NORMAL {
-			log.Error().Str("siptrans_id", id.String()).Msg("sip terminated with error " + reason.String())
-			ctrans_chan <- nil
+	ctrans_term_cb := func(id sip.TransID, err error) {
+		if err != nil {
+			log.Error().Err(err).Str("siptrans_id", id.String()).Msg("sip terminated with error")
 		} else {
 			log.Debug().Str("siptrans_id", id.String()).Msg("sip terminated normally")
 		}
-		DeleteTrans(id)
+		ctrans_chan <- nil
 	}
 
-	server_trans := StartServerTrans(request, transp, strans_core_cb, trpt_cb, strans_term_cb)
+	server_trans := StartServerTrans(request, transp, strans_core_cb, nil, strans_term_cb)
+	if server_trans == nil {
+		return
+	}
 
 	request = <-strans_chan
 
 	to_uri := request.To.Uri
-	dest := net.JoinHostPort(string(to_uri.Domain), strconv.Itoa(to_uri.Port))
-	dest_transp := &sip.SIPTransport{
-		Protocol:   "udp",
-		Conn:       transp.Conn,
-		LocalAddr:  transp.LocalAddr,
-		RemoteAddr: dest,
+	dests, err := resolver.Resolve(context.Background(), to_uri)
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot resolve destination")
+		return
 	}
 
-	request.AddVia(sip.SIPVia{
-		Tranport: "udp",
-		Domain:   []byte(to_uri.Domain),
-		Port:     to_uri.Port,
-		Branch:   randSeq(5),
-	})
+	// Responses come back to the socket of the proxy, through NATs with rport
+	local := transport.UDPAddrs()[0].(*net.UDPAddr).AddrPort()
+	via, err := sip.ParseSipVia([]byte("SIP/2.0/UDP " + local.String() + ";rport"))
+	if err != nil {
+		log.Error().Err(err).Msg("Cannot make Via")
+		return
+	}
+	via.Branch = sip.GenerateBranch()
+	request.AddVia(via)
 
-	StartClientTrans(request, dest_transp, ctrans_core_cb, trpt_cb, ctrans_term_cb)
+	client_trans := StartClientTrans(request, transport.Transports(dests), ctrans_core_cb, nil, ctrans_term_cb)
+	if client_trans == nil {
+		return
+	}
 
-	for {
+	// Both transactions outlive the first 2xx (RFC 6026 accepted state): the
+	// server transaction hands us the ACK for 2xx and the client transaction
+	// hands us 2xx retransmissions and forks, so route until both terminate.
+	var strans_done, ctrans_done, final bool
+	for !strans_done || !ctrans_done {
 		select {
-		case result := <-strans_chan:
-			if result == nil {
-				return
+		case msg := <-strans_chan:
+			if msg == nil {
+				strans_done = true
+			} else if msg.Request != nil && msg.Request.Method == sip.Ack {
+				log.Debug().Msg("Forward ACK for 2xx")
+				StatelessRoute(msg, transp)
+			}
+		case <-cancel_chan:
+			log.Debug().Msg("Cancel client sip")
+			if ict, ok := client_trans.Current().(*sip.Ictrans); ok {
+				ict.Cancel()
 			}
 		case response := <-ctrans_chan:
 			if response == nil {
-				log.Error().Msg("Error in client sip")
-				return
+				ctrans_done = true
+				if !final {
+					log.Error().Msg("Error in client sip")
+					return
+				}
+				continue
 			}
 
 			log.Debug().Msg("Forward response to server sip")
@@ -115,63 +136,29 @@ func StatefullRoute(request *sip.SIPMessage, transp *sip.SIPTransport) {
 			response.DeleteVia()
 			server_trans.Event(response)
 
-			status := response.Response.StatusCode
-			if status >= 200 {
-				return
+			if response.Response.StatusCode >= 200 {
+				final = true
 			}
 		}
 	}
 }
 
-func StatelessRoute(request *sip.SIPMessage, transp *sip.SIPTransport) {
+func StatelessRoute(request *sip.SIPMessage, transp sip.Transport) {
 	if request.Request == nil {
 		return
 	}
 
-	to_uri := request.To.Uri
-	dest := net.JoinHostPort(string(to_uri.Domain), strconv.Itoa(to_uri.Port))
-	daddr, err := net.ResolveUDPAddr("udp", dest)
+	dests, err := resolver.Resolve(context.Background(), request.To.Uri)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to resolve UDP address")
-		return
-	}
-	// conn, err := net.DialUDP("udp", nil, daddr)
-	// if err != nil {
-	// 	log.Error().Err(err).Msg("Failed to dial UDP address")
-	// 	return
-	// }
-
-	bin := request.Serialize()
-	if bin == nil {
-		log.Error().Msg("Serialize error")
+		log.Error().Err(err).Msg("Cannot resolve destination")
 		return
 	}
-
-	// _, err = tr.Write(bin)
-	// if err != nil {
-	// 	log.Error().Err(err).Msg("Failed to write to UDP connection")
-	// 	return
-	// }
-
-	udpConn, ok := transp.Conn.(*net.UDPConn)
-	if !ok {
-		log.Error().Msg("Error transport type")
-		return
-	}
-
-	_, err = udpConn.WriteTo(bin, daddr)
+	target, err := transport.Transport(dests[0])
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to write to UDP connection")
+		log.Error().Err(err).Msg("Cannot send to destination")
 		return
 	}
-}
-
-const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-func randSeq(n int) []byte {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+	if err := sip.SendRequest(target, request); err != nil {
+		log.Error().Err(err).Msg("Failed to write to UDP connection")
 	}
-	return b
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datism/sip"
+	"github.com/rs/zerolog"
+)
+
+var testOptions = sip.ParseOptions{
+	ParseFrom:       true,
+	ParseTo:         true,
+	ParseCallID:     true,
+	ParseCseq:       true,
+	ParseTopMostVia: true,
+}
+
+// listen starts a transport layer of a stack on a local UDP port
+func listen(t *testing.T, s *sip.Stack, handler func(*sip.SIPMessage, sip.Transport)) (*sip.TransportLayer, string) {
+	t.Helper()
+	tl := sip.NewTransportLayer(s, handler)
+	tl.Options = testOptions
+	if err := tl.ListenUDP("127.0.0.1:0"); err != nil {
+		t.Skipf("cannot listen on UDP: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.Shutdown(ctx)
+		tl.Close()
+	})
+	return tl, tl.UDPAddrs()[0].String()
+}
+
+func TestProxyForwardsCancel(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+
+	// The proxy runs on the stack of the package
+	transport = sip.NewTransportLayer(stack, HandleMessage)
+	transport.Options = testOptions
+	if err := transport.ListenUDP("127.0.0.1:0"); err != nil {
+		t.Skipf("cannot listen on UDP: %v", err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	proxy := transport.UDPAddrs()[0].String()
+
+	// The UAS rings and waits for the CANCEL
+	cancelled := make(chan *sip.SIPMessage, 1)
+	uas := sip.NewStack()
+	_, uasAddr := listen(t, uas, func(msg *sip.SIPMessage, tp sip.Transport) {
+		if msg.Request.Method == sip.Cancel {
+			cancelled <- msg
+		}
+		trans, err := uas.StartServerTrans(msg, tp, func(sip.Transport, *sip.SIPMessage) {}, nil, func(sip.TransID, error) {})
+		if err == nil && msg.Request.Method == sip.Invite {
+			trans.Event(respond(t, msg, "180 Ringing"))
+		}
+	})
+
+	responses := make(chan *sip.SIPMessage, 10)
+	uac := sip.NewStack()
+	uacLayer, uacAddr := listen(t, uac, func(*sip.SIPMessage, sip.Transport) {})
+	invite, err := sip.ParseSipMessage([]byte(fmt.Sprintf("INVITE sip:bob@%[1]s SIP/2.0\r\n"+
+		"Via: SIP/2.0/UDP %[2]s;branch=z9hG4bKcancel1;rport\r\n"+
+		"Max-Forwards: 70\r\n"+
+		"From: Alice <sip:alice@%[2]s>;tag=uac\r\n"+
+		"To: Bob <sip:bob@%[1]s>\r\n"+
+		"Call-ID: cancel@%[2]s\r\n"+
+		"CSeq: 1 INVITE\r\n"+
+		"Content-Length: 0\r\n\r\n", uasAddr, uacAddr)), testOptions)
+	if err != nil {
+		t.Fatalf("ParseSipMessage() error = %v", err)
+	}
+	target, _ := uacLayer.Transport(sip.Destination{Protocol: "udp", Addr: proxy})
+	trans, err := uac.StartClientTrans(invite, target,
+		func(_ sip.Transport, msg *sip.SIPMessage) { responses <- msg }, nil, func(sip.TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+
+	// The 180 of the UAS, forwarded by the proxy
+	for res := range responses {
+		if res.Response.StatusCode == 180 {
+			break
+		}
+	}
+	trans.(*sip.Ictrans).Cancel()
+
+	select {
+	case msg := <-cancelled:
+		if string(msg.CallID) != "cancel@"+uacAddr {
+			t.Errorf("UAS received a CANCEL of Call-ID %s", msg.CallID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the CANCEL did not reach the UAS")
+	}
+}
+
+// respond builds a response to a request from its Via, From, To, Call-ID and
+// CSeq header fields, with a To tag
+func respond(t *testing.T, req *sip.SIPMessage, status string) *sip.SIPMessage {
+	t.Helper()
+	raw := "SIP/2.0 " + status + "\r\n"
+	for _, line := range strings.Split(string(req.Serialize()), "\r\n")[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		switch strings.ToLower(name) {
+		case "via", "from", "call-id", "cseq":
+			raw += line + "\r\n"
+		case "to":
+			raw += line + ";tag=uas\r\n"
+		}
+	}
+	res, err := sip.ParseSipMessage([]byte(raw+"Content-Length: 0\r\n\r\n"), testOptions)
+	if err != nil {
+		t.Fatalf("ParseSipMessage() error = %v", err)
+	}
+	return res
+}
@@ -0,0 +1,133 @@
+package sip
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoTargets is returned when a request is sent to an empty list of targets
+var ErrNoTargets = errors.New("no target to send the request to")
+
+// Failover sends a request to the transports of the destinations returned by
+// Resolve in order: as of RFC 3263 4.3, when the client transaction of a
+// target times out, fails to send the request or receives a 503, the request
+// is sent to the next target with a new branch, and thus a new client
+// transaction. The TU sees the responses of the current target only, and a
+// single termination.
+type Failover struct {
+	stack   *Stack
+	request *SIPMessage
+	targets []Transport
+
+	core_cb func(Transport, *SIPMessage)
+	trpt_cb func(Transport, *SIPMessage) error
+	term_cb func(TransID, error)
+
+	mu       sync.Mutex
+	next     int            // Index of the next target
+	current  SIPTransaction // Transaction of the current target
+	answered bool           // The current target sent a response other than a 503
+}
+
+// StartClientTransFailover starts a client transaction to the first target, and
+// to the next ones as needed. The callbacks are those of StartClientTrans, the
+// top Via of the request must be parsed to be given new branches.
+func (s *Stack) StartClientTransFailover(
+	msg *SIPMessage,
+	targets []Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
+) (*Failover, error) {
+	f := &Failover{
+		stack:   s,
+		request: msg,
+		targets: targets,
+		core_cb: core_callback,
+		trpt_cb: transport_callback,
+		term_cb: term_callback,
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start_next(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Current returns the client transaction of the current target, such as the
+// one to CANCEL
+func (f *Failover) Current() SIPTransaction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+// start_next sends the request to the next target that accepts it, with a
+// new branch after the first one. It must be called with mu held. The current
+// target is unchanged if no target accepts the request.
+func (f *Failover) start_next() error {
+	err := ErrNoTargets
+	current := f.next
+	for f.next < len(f.targets) {
+		msg := f.request
+		if f.next > 0 {
+			retry := *f.request
+			retry.TopmostVia.Branch = GenerateBranch()
+			msg = &retry
+		}
+		target := f.targets[f.next]
+		f.next++
+
+		attempt := f.next
+		var trans SIPTransaction
+		trans, err = f.stack.StartClientTrans(msg, target,
+			func(transport Transport, msg *SIPMessage) { f.core_callback(attempt, transport, msg) },
+			f.trpt_cb,
+			func(id TransID, err error) { f.term_callback(attempt, id, err) },
+		)
+		if err == nil {
+			f.current = trans
+			f.answered = false
+			return nil
+		}
+	}
+	f.next = current
+	return err
+}
+
+// core_callback passes the messages of the current target to the TU, but a
+// 503 that can be retried with the next target
+func (f *Failover) core_callback(attempt int, transport Transport, msg *SIPMessage) {
+	f.mu.Lock()
+	if attempt != f.next {
+		f.mu.Unlock()
+		return
+	}
+	if msg.Response != nil && msg.Response.StatusCode == 503 && !f.answered && f.start_next() == nil {
+		f.mu.Unlock()
+		return
+	}
+	if msg.Response != nil {
+		f.answered = true
+	}
+	f.mu.Unlock()
+	f.core_cb(transport, msg)
+}
+
+// term_callback informs the TU of the termination of the last transaction,
+// unless its target failed and the next one can be tried
+func (f *Failover) term_callback(attempt int, id TransID, err error) {
+	f.mu.Lock()
+	if attempt != f.next {
+		f.mu.Unlock()
+		return
+	}
+	if (errors.Is(err, ErrTimeout) || errors.Is(err, ErrTransport)) && !f.answered && f.start_next() == nil {
+		f.mu.Unlock()
+		return
+	}
+	f.mu.Unlock()
+	f.term_cb(id, err)
+}
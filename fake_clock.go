@@ -0,0 +1,129 @@
+package sip
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// FakeClock is a Scheduler for tests whose time only moves with Advance, so
+// that transaction timers fire at exact instants regardless of the load of the
+// machine running the test.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers fakeTimers
+	seq    uint64 // Orders the timers due at the same instant by scheduling
+
+	settle func() // Waits for the work caused by a timer, if set
+}
+
+// fakeTimer is a function scheduled on a FakeClock
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	seq   uint64
+	f     func()
+	index int // Position in the heap, -1 once fired or stopped
+}
+
+// NewFakeClock creates a clock stopped at the Unix epoch
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(0, 0).UTC()}
+}
+
+// Now returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to run once the clock has advanced by d, it never runs
+// f itself
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) TimerHandle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{clock: c, at: c.now.Add(d), seq: c.seq, f: f}
+	heap.Push(&c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the timers due in the
+// meantime in the goroutine of the caller, in order, each at its own instant.
+// Timers scheduled by the functions run are fired too if they are due before
+// the end. Advance must not be called concurrently nor from a timer.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		if c.settle != nil {
+			c.settle()
+		}
+
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&c.timers).(*fakeTimer)
+		c.now = t.at
+		c.mu.Unlock()
+
+		t.f()
+	}
+}
+
+// Pending returns the number of timers waiting to fire
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+// fakeTimers is a heap of timers, earliest first
+type fakeTimers []*fakeTimer
+
+func (h fakeTimers) Len() int { return len(h) }
+
+func (h fakeTimers) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h fakeTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fakeTimers) Push(x any) {
+	t := x.(*fakeTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *fakeTimers) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,140 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Largest message accepted on a stream, headers and body
+const stream_max_msg_len = 1 << 20
+
+// Size of the reads of a framer
+const stream_read_len = 4096
+
+// Errors closing a stream whose messages cannot be delimited
+var (
+	ErrMissingContentLength = errors.New("message without Content-Length on a stream")
+	ErrMessageTooLarge      = errors.New("message too large")
+)
+
+/*
+	RFC 3261 18.3
+		In the case of stream-oriented transports such as TCP, the Content-
+		Length header field indicates the size of the body.  All stream-
+		oriented transports MUST use Content-Length.
+*/
+// framer splits a stream into messages. Data is kept between calls to next, so
+// that a read interrupted by a deadline can be resumed.
+type framer struct {
+	buf []byte
+	max int
+
+	pongs func() bool // Reports whether pongs are expected, see split
+}
+
+func newFramer() *framer {
+	return &framer{max: stream_max_msg_len}
+}
+
+// next returns the next message of the stream, reading from r as needed. The
+// message is a copy that the caller owns.
+func (f *framer) next(r io.Reader) ([]byte, error) {
+	for {
+		msg, err := f.split()
+		if msg != nil || err != nil {
+			return msg, err
+		}
+		if len(f.buf) >= f.max {
+			return nil, ErrMessageTooLarge
+		}
+
+		if f.buf, err = readMore(f.buf, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readMore appends the data of a read to buf, growing it as needed
+func readMore(buf []byte, r io.Reader) ([]byte, error) {
+	if cap(buf)-len(buf) < stream_read_len {
+		grown := make([]byte, len(buf), 2*cap(buf)+stream_read_len)
+		copy(grown, buf)
+		buf = grown
+	}
+	n, err := r.Read(buf[len(buf):cap(buf)])
+	return buf[:len(buf)+n], err
+}
+
+// split removes the first complete message from the buffer, it returns nil if
+// more data is needed
+func (f *framer) split() ([]byte, error) {
+	// Keep-alives between messages (RFC 5626 3.5.1), a double CRLF is a ping
+	// and a CRLF a pong. A read may end in the middle of a ping: a lone CRLF
+	// is only taken for a pong where pongs are expected, on the flows of the
+	// client sending the pings, and a ping waits for its second CRLF otherwise.
+	if bytes.Equal(f.buf, keepalive_ping[:3]) || bytes.Equal(f.buf, keepalive_pong) && (f.pongs == nil || !f.pongs()) {
+		return nil, nil
+	}
+	for _, keepalive := range [][]byte{keepalive_ping, keepalive_pong} {
+		if bytes.HasPrefix(f.buf, keepalive) {
+			f.consume(len(keepalive))
+			return bytes.Clone(keepalive), nil
+		}
+	}
+
+	end := bytes.Index(f.buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil
+	}
+	end += 4
+
+	length, err := contentLength(f.buf[:end])
+	if err != nil {
+		return nil, err
+	}
+	if end+length > f.max {
+		return nil, ErrMessageTooLarge
+	}
+	if len(f.buf) < end+length {
+		return nil, nil
+	}
+
+	msg := make([]byte, end+length)
+	copy(msg, f.buf)
+	f.consume(end + length)
+	return msg, nil
+}
+
+// consume drops the first n bytes of the buffer
+func (f *framer) consume(n int) {
+	if n == 0 {
+		return
+	}
+	rest := copy(f.buf, f.buf[n:])
+	f.buf = f.buf[:rest]
+}
+
+// contentLength reads the Content-Length header, or its compact form, in the
+// header section of a message
+func contentLength(head []byte) (int, error) {
+	lines := bytes.Split(head, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		name = bytes.TrimSpace(name)
+		if h, err := ParseHeaderName(name); (err != nil || h != ContentLength) && !bytes.EqualFold(name, []byte("l")) {
+			continue
+		}
+
+		length, err := strconv.Atoi(string(bytes.TrimSpace(value)))
+		if err != nil || length < 0 {
+			return 0, ErrMissingContentLength
+		}
+		return length, nil
+	}
+	return 0, ErrMissingContentLength
+}
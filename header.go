@@ -62,6 +62,7 @@ const (
 	HistoryInfo
 	Diversion
 	SessionID
+	FlowTimer
 )
 
 var sipHeaderNames = map[SIPHeader][]byte{
@@ -119,6 +120,7 @@ var sipHeaderNames = map[SIPHeader][]byte{
 	HistoryInfo:            []byte("History-Info"),
 	Diversion:              []byte("Diversion"),
 	SessionID:              []byte("Session-ID"),
+	FlowTimer:              []byte("Flow-Timer"),
 }
 
 // SIPHeaderName returns the name of a SIP header.
@@ -181,6 +183,7 @@ var nameSipHeaders = map[string]SIPHeader{
 	"history-info":             HistoryInfo,
 	"diversion":                Diversion,
 	"session-id":               SessionID,
+	"flow-timer":               FlowTimer,
 }
 
 // ParseHader parses a header name and returns the corresponding SIPHeader.
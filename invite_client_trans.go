@@ -1,147 +1,147 @@
 package sip
 
-//                     |INVITE from TU
-//              Timer A fires     |INVITE sent
-//              Reset A,          V                      Timer B fires
-//              INVITE sent +-----------+                or Transport Err.
-//                +---------|           |---------------+inform TU
-//                |         |  Calling  |               |
-//                +-------->|           |-------------->|
-//                          +-----------+ 2xx           |
-//                             |  |       2xx to TU     |
-//                             |  |1xx                  |
-//     300-699 +---------------+  |1xx to TU            |
-//    ACK sent |                  |                     |
-// resp. to TU |  1xx             V                     |
-//             |  1xx to TU  -----------+               |
-//             |  +---------|           |               |
-//             |  |         |Proceeding |-------------->|
-//             |  +-------->|           | 2xx           |
-//             |            +-----------+ 2xx to TU     |
-//             |       300-699    |                     |
-//             |       ACK sent,  |                     |
-//             |       resp. to TU|                     |
-//             |                  |                     |      NOTE:
-//             |  300-699         V                     |
-//             |  ACK sent  +-----------+Transport Err. |  transitions
-//             |  +---------|           |Inform TU      |  labeled with
-//             |  |         | Completed |-------------->|  the event
-//             |  +-------->|           |               |  over the action
-//             |            +-----------+               |  to take
-//             |              ^   |                     |
-//             |              |   | Timer D fires       |
-//             +--------------+   | -                   |
-//                                |                     |
-//                                V                     |
-//                          +-----------+               |
-//                          |           |               |
-//                          | Terminated|<--------------+
-//                          |           |
-//                          +-----------+
+import (
+	"context"
+)
+
+//                               |INVITE from TU
+//             Timer A fires     |INVITE sent      Timer B fires
+//             Reset A,          V                 or Transport Err.
+//             INVITE sent +-----------+           inform TU
+//               +---------|           |--------------------------+
+//               |         |  Calling  |                          |
+//               +-------->|           |-----------+              |
+//  300-699                +-----------+ 2xx       |              |
+//  ACK sent                  |  |       2xx to TU |              |
+//  resp. to TU               |  |1xx              |              |
+//  +-------------------------+  |1xx to TU        |              |
+//  |                            |                 |              |
+//  |                1xx         V                 |              |
+//  |                1xx to TU +-----------+       |              |
+//  |                +---------|           |       |              |
+//  |                |         |Proceeding |       |              |
+//  |                +-------->|           |       |              |
+//  |                          +-----------+ 2xx   |              |
+//  |         300-699             |    |     2xx to TU            |
+//  |         ACK sent,  +--------+    +---------------+          |
+//  |         resp. to TU|                             |          |
+//  |                    |                             |          |
+//  |                    V                             V          |
+//  |              +-----------+                   +----------+   |
+//  +------------->|           |Transport Err.     |          |   |
+//                 | Completed |Inform TU          | Accepted |   |
+//              +--|           |-------+           |          |-+ |
+//      300-699 |  +-----------+       |           +----------+ | |
+//      ACK sent|    ^  |              |               |  ^     | |
+//              |    |  |              |               |  |     | |
+//              +----+  |              |               |  +-----+ |
+//                      |Timer D fires |  Timer M fires|    2xx   |
+//                      |-             |             - |    2xx to TU
+//                      +--------+     |   +-----------+          |
+//     NOTE:                     V     V   V                      |
+//  Transitions                 +------------+                    |
+//  are labeled                 |            |                    |
+//  with the event              | Terminated |<-------------------+
+//  over the action             |            |
+//  to take.                    +------------+
+//
+//                 INVITE client transaction (RFC 6026)
 
 // Ictrans represents a SIP INVITE client transaction
 type Ictrans struct {
-	id        TransID       // Transaction ID
-	state     state         // Current state of the transaction
-	transport *SIPTransport // Transport layer
-	message   *SIPMessage   // The SIP message being processed (INVITE or response)
-	ack       *SIPMessage   // The ACK message to be generated
-	timera    *transTimer
-	timerb    *transTimer
-	timerd    *transTimer
-	transc    chan *SIPMessage                      // Channel for receiving events and processing them
-	trpt_cb   func(*SIPTransport, *SIPMessage) bool // Transport callback
-	core_cb   func(*SIPTransport, *SIPMessage)      // Core callback
-	term_cb   func(TransID, TERM_REASON)
+	transaction
+	ack      *SIPMessage // The ACK message to be generated
+	last_res *SIPMessage // The last final response received
+	timera   *transTimer
+	timerb   *transTimer
+	timerd   *transTimer
+	timerm   *transTimer // Timer M for absorbing 2xx retransmissions (RFC 6026)
+	cancel   *SIPMessage // CANCEL requested by the TU, waiting for a provisional response
 }
 
 // Make creates a new instance of a client transaction, initializing timers and setting initial state
 func MakeICT(
 	id TransID, // siptrans ID
 	msg *SIPMessage, // The INVITE message to be processed
-	transport *SIPTransport, // Transport layer
-	core_callback func(*SIPTransport, *SIPMessage), // Core callback
-	transport_callback func(*SIPTransport, *SIPMessage) bool, // Transport layer callback
-	term_callback func(TransID, TERM_REASON), // Termination callback
+	transport Transport, // Transport layer
+	core_callback func(Transport, *SIPMessage), // Core callback
+	transport_callback func(Transport, *SIPMessage) error, // Transport layer callback
+	term_callback func(TransID, error), // Termination callback
 ) *Ictrans {
-	//log.Trace().Str("siptrans_id", id.String()).Interface("message", msg).Interface("transport", transport).Msg("Creating new INVITE client transaction")
 	return &Ictrans{
-		id:        id,                        // Set transaction ID
-		message:   msg,                       // The initial SIP message (INVITE)
-		ack:       initAck(msg),              // ACK message to be generated
-		transc:    make(chan *SIPMessage, 5), // Channel to communicate events
-		timera:    newTransTimer("timer a"),
-		timerb:    newTransTimer("timer b"),
-		timerd:    newTransTimer("timer d"),
-		state:     calling,            // Start with the calling state
-		trpt_cb:   transport_callback, // Set transport callback
-		core_cb:   core_callback,      // Set core callback
-		term_cb:   term_callback,      // Set termination callback
-		transport: transport,          // Set transport
+		// Start with the calling state
+		transaction: makeTransaction(id, INVITE_CLIENT, Calling, msg, transport, core_callback, transport_callback, term_callback),
+		ack:         initAck(msg), // ACK message to be generated
+		timera:      newTransTimer("timer a"),
+		timerb:      newTransTimer("timer b"),
+		timerd:      newTransTimer("timer d"),
+		timerm:      newTransTimer("timer m"),
 	}
 }
 
-// Event triggers an event in the transaction. The event can be a SIP message or timeout.
-func (trans Ictrans) Event(msg *SIPMessage) {
-	if trans.state == terminated {
-		return
-	}
-
-	trans.transc <- msg
+// Start runs the transaction in the calling goroutine.
+// It returns when the transaction terminates or ctx is done.
+func (trans *Ictrans) Start(ctx context.Context) {
+	trans.run(ctx, trans)
 }
 
-// start is the main loop that processes events in the client transaction.
-func (trans *Ictrans) Start() {
-	//log.Trace().Str("transaction_id", trans.id.String()).Msg("Starting INVITE client transaction")
-
-	// Initial action: Call transport callback to send INVITE message
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", trans.message).Msg("Initial action: Sending request")
-	trans.call_transport_callback(trans.message)
-	// Start Timer A (T1) for retransmissions and Timer B (64*T1) for transaction timeout
-	trans.timera.start(tia_dur)
-	trans.timerb.start(tib_dur)
-
-	// Event loop that listens for events (SIP messages or timer expirations)
-	for {
-		select {
-		case msg := <-trans.transc: // Message event (SIP response)
-			trans.handle_msg(msg)
-		case <-trans.timera.Timer.C: // Timer A expired, triggering a retransmission
-			trans.handle_timer(trans.timera)
-		case <-trans.timerb.Timer.C: // Timer B expired, transaction timed out
-			trans.handle_timer(trans.timerb)
-		case <-trans.timerd.Timer.C: // Timer D expired, termination after final response
-			trans.handle_timer(trans.timerd)
-		}
+// Handle runs the state machine on an event and returns the actions to execute
+func (trans *Ictrans) Handle(ev TransEvent) []Action {
+	if trans.state == Terminated {
+		return nil
+	}
 
-		// If the transaction is terminated, exit the loop
-		if trans.state == terminated {
-			//log.Trace().Str("transaction_id", trans.id.String()).Msg("Transaction terminated")
-			close(trans.transc) // Close the event channel when the transaction ends
+	switch ev.Kind {
+	case StartEvent:
+		trans.init_timers(trans.timera, trans.timerb, trans.timerd, trans.timerm)
+		if trans.resume_timers() { // Restored transaction, the INVITE has already been sent
 			break
 		}
+		// Initial action: send the INVITE
+		trans.send(trans.message)
+		// Start Timer A (T1) for retransmissions over an unreliable transport and Timer B (64*T1) for transaction timeout
+		if !trans.reliable() {
+			trans.timera.start(tia_dur)
+		}
+		trans.timerb.start(tib_dur)
+	case MessageEvent: // SIP response, or CANCEL queued by the TU
+		trans.handle_msg(ev.Msg)
+	case TimerEvent: // Timer A, B, D or M expired
+		if timer := trans.expired(ev); timer != nil {
+			trans.handle_timer(timer)
+		}
+	default:
+		trans.handle_error(ev)
 	}
+	return trans.flush()
+}
+
+func (trans *Ictrans) last_response() *SIPMessage {
+	return trans.last_res
 }
 
 // handle_timer processes timeout events, which can trigger retransmissions or state transitions
 func (trans *Ictrans) handle_timer(timer *transTimer) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Str("timer", timer.ID).Msg("Handling timer event")
-
 	if timer == trans.timerb { // Timer B expired, inform TU of timeout and terminate transaction
-		trans.state = terminated
-		trans.call_term_callback(TIMEOUT)
-	} else if timer == trans.timera && trans.state == calling { // Timer A expired in calling state, retransmit INVITE
+		trans.terminate(&TimeoutError{Timer: timer.ID})
+	} else if timer == trans.timera && trans.state == Calling { // Timer A expired in calling state, retransmit INVITE
 		trans.timera.start(trans.timera.Duration * 2) // Double Timer A duration
-		trans.call_transport_callback(trans.message)
-	} else if timer == trans.timerd && trans.state == completed { // Timer D expired in completed state, terminate transaction
-		trans.state = terminated
-		trans.call_term_callback(NORMAL)
+		trans.retransmit(trans.message)
+	} else if timer == trans.timerd && trans.state == Completed { // Timer D expired in completed state, terminate transaction
+		trans.terminate(nil)
+	} else if timer == trans.timerm && trans.state == Accepted { // Timer M expired in accepted state, terminate transaction
+		trans.terminate(nil)
 	}
 }
 
 // handle_msg processes received SIP messages, transitioning states based on response codes
 func (trans *Ictrans) handle_msg(response *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", response).Msg("Handling message event")
+	if response.Request != nil { // CANCEL queued by the TU, other requests are ignored
+		if response.Request.Method == Cancel {
+			trans.handle_cancel(response)
+		}
+		return
+	}
 
 	if response.Response == nil { // Invalid or missing response, ignore the event
 		return
@@ -150,50 +150,79 @@ func (trans *Ictrans) handle_msg(response *SIPMessage) {
 	status_code := response.Response.StatusCode // Get the response's status code
 
 	if status_code >= 100 && status_code < 200 { // Provisional response (1xx)
-		if trans.state == calling { // If in calling state, transition to proceeding
-			trans.timera.stop()                // Stop Timer A as no more retransmissions are needed
-			trans.state = proceeding           // Transition to proceeding state
-			trans.call_core_callback(response) // Pass 1xx response to the core callback
-		} else if trans.state == proceeding { // In proceeding state, pass 1xx to the TU
-			trans.call_core_callback(response)
+		if trans.state == Calling { // If in calling state, transition to proceeding
+			trans.timera.stop()                   // Stop Timer A as no more retransmissions are needed
+			trans.set_state(Proceeding, response) // Transition to proceeding state
+			trans.pass(response)                  // Pass 1xx response to the core callback
+			if trans.cancel != nil {              // A CANCEL may be sent now that the request was received
+				trans.send_cancel()
+			}
+		} else if trans.state == Proceeding { // In proceeding state, pass 1xx to the TU
+			trans.pass(response)
+		}
+	} else if status_code >= 200 && status_code < 300 { // Final success response (2xx)
+		if trans.state < Completed { // RFC 6026: wait in accepted state for 2xx retransmissions and forks
+			trans.timera.stop()                 // Stop Timer A
+			trans.timerb.stop()                 // Stop Timer B (transaction timeout)
+			trans.timerm.start(tim_dur)         // Start Timer M
+			trans.set_state(Accepted, response) // Transition to accepted state
+			trans.last_res = response
+			trans.pass(response) // Pass the final response to the core
+		} else if trans.state == Accepted { // Every 2xx, retransmitted or forked, goes to the TU
+			trans.pass(response)
 		}
-	} else if status_code >= 200 && status_code <= 300 && trans.state < completed { // Final success response (2xx)
-		trans.state = terminated           // Transition to terminated state
-		trans.call_core_callback(response) // Pass the final response to the core
-		trans.call_term_callback(NORMAL)
-	} else if status_code > 300 { // Error response (3xx-6xx)
-		if trans.state < completed { // If in calling or proceeding state, generate ACK and stop Timer B
-			updateAck(trans.ack, response)           // Create an ACK for the response
-			trans.timerb.stop()                      // Stop Timer B (transaction timeout)
-			trans.timerd.start(tid_dur)              // Start Timer D (completion timeout)
-			trans.state = completed                  // Transition to completed state
-			trans.call_transport_callback(trans.ack) // Send the ACK
-			trans.call_core_callback(response)
-		} else if trans.state == completed { // In completed state, just retransmit the ACK
+	} else if status_code >= 300 { // Error response (3xx-6xx)
+		if trans.state < Completed { // If in calling or proceeding state, generate ACK and stop Timer B
+			updateAck(trans.ack, response) // Create an ACK for the response
+			trans.last_res = response
+			trans.timerb.stop()                           // Stop Timer B (transaction timeout)
+			trans.timerd.start(trans.absorb_dur(tid_dur)) // Start Timer D (completion timeout)
+			trans.set_state(Completed, response)          // Transition to completed state
+			trans.send(trans.ack)                         // Send the ACK
+			trans.pass(response)
+		} else if trans.state == Completed { // In completed state, just retransmit the ACK
 			updateAck(trans.ack, response)
-			trans.call_transport_callback(trans.ack)
+			trans.retransmit(trans.ack)
 		}
 	}
 }
 
-// call_core_callback invokes the core callback to handle transaction-related events
-func (citrans Ictrans) call_core_callback(message *SIPMessage) {
-	//log.Trace().Str("transaction_id", citrans.id.String()).Interface("message", message).Msg("Invoking core callback")
-	citrans.core_cb(citrans.transport, message) // Call the core callback
+// Cancel asks the transaction to cancel its INVITE. The CANCEL is built as
+// described in RFC 3261 section 9.1 and runs in its own non-INVITE client
+// transaction, sent as soon as a provisional response has been received. It is
+// dropped if a final response arrives first. Responses to the CANCEL are not
+// passed to the TU, the outcome is the final response of the INVITE itself. If
+// the transaction of the CANCEL cannot be started, such as once the stack has
+// been aborted, the INVITE transaction terminates with the error. Cancel reports whether the request was accepted by the transaction.
+func (trans *Ictrans) Cancel() bool {
+	return trans.Event(MakeCancel(trans.message))
 }
 
-// call_transport_callback invokes the transport callback to send or receive messages
-func (citrans Ictrans) call_transport_callback(message *SIPMessage) {
-	//log.Trace().Str("transaction_id", citrans.id.String()).Interface("message", message).Msg("Invoking transport callback")
-	if !citrans.trpt_cb(citrans.transport, message) { // Call the transport callback
-		citrans.state = terminated
-		citrans.call_term_callback(ERROR)
+// handle_cancel sends the CANCEL in proceeding state or keeps it until a provisional response
+func (trans *Ictrans) handle_cancel(cancel *SIPMessage) {
+	if trans.state != Calling && trans.state != Proceeding || trans.cancel != nil {
+		return
+	}
+
+	trans.cancel = cancel
+	if trans.state == Proceeding {
+		trans.send_cancel()
 	}
 }
 
-func (citrans Ictrans) call_term_callback(reason TERM_REASON) {
-	//log.Trace().Str("transaction_id", citrans.id.String()).Interface("termination_reason", reason).Msg("Invoking termination callback")
-	citrans.term_cb(citrans.id, reason)
+// send_cancel starts the client transaction of the CANCEL
+func (trans *Ictrans) send_cancel() {
+	tid, err := MakeClientTransactionID(trans.cancel)
+	if err != nil {
+		return
+	}
+
+	nict := MakeNICT(tid, trans.cancel, trans.transport,
+		func(Transport, *SIPMessage) {},
+		trans.trpt_cb,
+		func(TransID, error) {},
+	)
+	trans.emit(Action{Kind: SpawnAction, ID: tid, Trans: nict})
 }
 
 /*
@@ -222,18 +251,50 @@ func (citrans Ictrans) call_term_callback(reason TERM_REASON) {
 		  	stateless proxies.
 */
 func initAck(inv *SIPMessage) *SIPMessage {
-	ack_hdr := make(map[SIPHeader][][]byte)
-	if val, ok := inv.Headers[SessionID]; ok {
-		ack_hdr[SessionID] = val
-	}
-	if val, ok := inv.Headers[Route]; ok {
-		ack_hdr[Route] = val
+	return makeInviteRequest(inv, Ack)
+}
+
+func updateAck(ack *SIPMessage, response *SIPMessage) {
+	ack.To = response.To
+	ack.Options.ParseTo = response.Options.ParseTo
+	copyHeaders(ack.Headers, response.Headers, To)
+}
+
+/*
+	 RFC 3261 9.1
+			The Request-URI, Call-ID, To, the numeric part of CSeq, and From header
+			fields in the CANCEL request MUST be identical to those in the
+			request being cancelled, including tags.  A CANCEL constructed by a
+			client MUST have only a single Via header field value matching the
+			top Via value in the request being cancelled.
+
+			If the request being cancelled contains a Route header field, the
+			CANCEL request MUST include that Route header field's values.
+*/
+// MakeCancel builds the CANCEL request for an INVITE
+func MakeCancel(inv *SIPMessage) *SIPMessage {
+	cancel := makeInviteRequest(inv, Cancel)
+	cancel.To = inv.To
+	cancel.Options.ParseTo = inv.Options.ParseTo
+	copyHeaders(cancel.Headers, inv.Headers, To)
+	return cancel
+}
+
+// makeInviteRequest builds a request with the Request-URI, Call-ID, From, CSeq
+// number, topmost Via and Route header fields of an INVITE
+func makeInviteRequest(inv *SIPMessage, method SIPMethod) *SIPMessage {
+	hdr := make(map[SIPHeader][][]byte)
+	copyHeaders(hdr, inv.Headers, From, CallID, Route, SessionID)
+	if !inv.Options.ParseTopMostVia && len(inv.Headers[Via]) > 0 {
+		hdr[Via] = inv.Headers[Via][:1]
 	}
+	hdr[MaxForwards] = [][]byte{[]byte("70")}
+	hdr[ContentLength] = [][]byte{[]byte("0")}
 
 	return &SIPMessage{
 		Startline: Startline{
 			Request: &Request{
-				Method:     Ack,
+				Method:     method,
 				RequestURI: inv.Request.RequestURI,
 			},
 		},
@@ -241,13 +302,15 @@ func initAck(inv *SIPMessage) *SIPMessage {
 		CallID:     inv.CallID,
 		TopmostVia: inv.TopmostVia,
 		CSeq: SIPCseq{
-			Method: Ack,
-			Seq:    inv.CSeq.Seq,
+			Method: method,
+			Seq:    inv.cseq().Seq,
+		},
+		Headers: hdr,
+		Options: ParseOptions{
+			ParseFrom:       inv.Options.ParseFrom,
+			ParseCallID:     inv.Options.ParseCallID,
+			ParseCseq:       true,
+			ParseTopMostVia: inv.Options.ParseTopMostVia,
 		},
-		Headers: ack_hdr,
 	}
 }
-
-func updateAck(ack *SIPMessage, response *SIPMessage) {
-	ack.To = response.To
-}
@@ -1,177 +1,245 @@
 package sip
 
+import (
+	"bytes"
+	"context"
+)
+
+/*
+                                    |INVITE
+                                    |pass INV to TU
+                 INVITE             V send 100 if TU won't in 200 ms
+                 send response+------------+
+                     +--------|            |--------+ 101-199 from TU
+                     |        |            |        | send response
+                     +------->|            |<-------+
+                              | Proceeding |
+                              |            |--------+ Transport Err.
+                              |            |        | Inform TU
+                              |            |<-------+
+                              +------------+
+                 300-699 from TU |    |2xx from TU
+                 send response   |    |send response
+                  +--------------+    +------------+
+                  |                                |
+ INVITE           V          Timer G fires         |
+ send response +-----------+ send response         |
+      +--------|           |--------+              |
+      |        |           |        |              |
+      +------->| Completed |<-------+      INVITE  |  Transport Err.
+               |           |              -       |  Inform TU
+      +--------|           |----+          +-----+ |  +---+
+      |        +-----------+    | ACK      |     v v  |   v
+      |          ^   |          | -        |  +------------+
+      |          |   |          |          |  |            |---+ ACK
+      +----------+   |          |          +--|  Accepted  |   | to TU
+      Transport Err. |          |             |            |<--+
+      Inform TU      |          V             +------------+
+                     |      +-----------+        |  ^     |
+                     |      |           |        |  |     |
+                     |      | Confirmed |        |  +-----+
+                     |      |           |        |  2xx from TU
+       Timer H fires |      +-----------+        |  send response
+       -             |          |                |
+                     |          | Timer I fires  |
+                     |          | -              | Timer L fires
+                     |          V                | -
+                     |        +------------+     |
+                     |        |            |<----+
+                     +------->| Terminated |
+                              |            |
+                              +------------+
+
+                INVITE server transaction (RFC 6026)
+*/
+
 // Sitrans represents the state machine for an INVITE server transaction
 type Sitrans struct {
-	id        TransID                               // Transaction ID
-	state     state                                 // Current state of the transaction
-	message   *SIPMessage                           // The SIP message associated with the transaction
-	transport *SIPTransport                         // Transport layer for sending and receiving messages
-	last_res  *SIPMessage                           // The last response received
-	timerprv  *transTimer                           // Timer for provisional responses
-	timerg    *transTimer                           // Timer G for retransmissions
-	timerh    *transTimer                           // Timer H for timeouts
-	timeri    *transTimer                           // Timer I for termination
-	transc    chan *SIPMessage                      // Channel for receiving events like timeouts or messages
-	trpt_cb   func(*SIPTransport, *SIPMessage) bool // Transport callback
-	core_cb   func(*SIPTransport, *SIPMessage)      // Core callback
-	term_cb   func(TransID, TERM_REASON)            // Termination callback
+	transaction
+	last_res *SIPMessage // The last response sent
+	timerprv *transTimer // Timer for provisional responses
+	timerg   *transTimer // Timer G for retransmissions
+	timerh   *transTimer // Timer H for timeouts
+	timeri   *transTimer // Timer I for termination
+	timerl   *transTimer // Timer L for absorbing INVITE retransmissions after a 2xx (RFC 6026)
 }
 
 // MakeIST creates and initializes a new Sitrans instance with the given message and callbacks
 func MakeIST(
 	id TransID,
 	msg *SIPMessage,
-	transport *SIPTransport,
-	core_callback func(*SIPTransport, *SIPMessage),
-	transport_callback func(*SIPTransport, *SIPMessage) bool,
-	term_callback func(TransID, TERM_REASON),
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
 ) *Sitrans {
-	//log.Trace().Str("transaction_id", id.String()).Interface("message", msg).Interface("transport", transport).Msg("Creating new INVITE server transaction")
 	return &Sitrans{
-		id:        id,
-		message:   msg,
-		transport: transport,
-		transc:    make(chan *SIPMessage, 5),
-		timerprv:  newTransTimer("timer prv"),
-		timerg:    newTransTimer("timer g"),
-		timerh:    newTransTimer("timer h"),
-		timeri:    newTransTimer("timer i"),
-		state:     proceeding,
-		trpt_cb:   transport_callback,
-		core_cb:   core_callback,
-		term_cb:   term_callback,
+		transaction: makeTransaction(id, INVITE_SERVER, Proceeding, msg, transport, core_callback, transport_callback, term_callback),
+		timerprv:    newTransTimer("timer prv"),
+		timerg:      newTransTimer("timer g"),
+		timerh:      newTransTimer("timer h"),
+		timeri:      newTransTimer("timer i"),
+		timerl:      newTransTimer("timer l"),
 	}
 }
 
-// Event is used to send events to the transaction, which are handled in the Start() method
-func (trans Sitrans) Event(msg *SIPMessage) {
-	if trans.state == terminated {
-		return
-	}
-
-	trans.transc <- msg
+// Start runs the transaction in the calling goroutine.
+// It returns when the transaction terminates or ctx is done.
+func (trans *Sitrans) Start(ctx context.Context) {
+	trans.run(ctx, trans)
 }
 
-// Start initiates the transaction processing by running the main event loop
-func (trans *Sitrans) Start() {
-	//log.Trace().Str("transaction_id", trans.id.String()).Msg("Starting INVITE server transaction")
-	trans.timerprv.start(tiprovsion_dur)
-
-	trans.call_core_callback(trans.message)
-
-	for {
-		select {
-		case msg := <-trans.transc:
-			trans.handle_msg(msg)
-		case <-trans.timerprv.Timer.C:
-			trans.handle_timer(trans.timerprv)
-		case <-trans.timerg.Timer.C:
-			trans.handle_timer(trans.timerg)
-		case <-trans.timerh.Timer.C:
-			trans.handle_timer(trans.timerh)
-		case <-trans.timeri.Timer.C:
-			trans.handle_timer(trans.timeri)
-		}
+// Handle runs the state machine on an event and returns the actions to execute
+func (trans *Sitrans) Handle(ev TransEvent) []Action {
+	if trans.state == Terminated {
+		return nil
+	}
 
-		if trans.state == terminated {
-			//log.Trace().Str("transaction_id", trans.id.String()).Msg("Transaction terminated")
-			close(trans.transc)
+	switch ev.Kind {
+	case StartEvent:
+		trans.init_timers(trans.timerprv, trans.timerg, trans.timerh, trans.timeri, trans.timerl)
+		if trans.resume_timers() { // Restored transaction, the TU already has the INVITE
 			break
 		}
+		trans.timerprv.start(tiprovsion_dur)
+		trans.pass(trans.message)
+	case MessageEvent:
+		trans.handle_msg(ev.Msg)
+	case TimerEvent:
+		if timer := trans.expired(ev); timer != nil {
+			trans.handle_timer(timer)
+		}
+	default:
+		trans.handle_error(ev)
 	}
+	return trans.flush()
+}
+
+func (trans *Sitrans) last_response() *SIPMessage {
+	return trans.last_res
 }
 
 // handle_timer processes events triggered by timer expirations
 func (trans *Sitrans) handle_timer(timer *transTimer) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Str("timer", timer.ID).Msg("Handling timer event")
 	switch timer {
 	case trans.timerh:
-		trans.state = terminated
-		trans.call_term_callback(TIMEOUT)
+		trans.terminate(&TimeoutError{Timer: timer.ID})
 	case trans.timerprv:
-		if trans.state == proceeding {
+		if trans.state == Proceeding {
 			trying100 := makeGenericResponse(100, []byte("TRYING"), trans.message)
-			trans.call_transport_callback(trying100)
+			trans.send(trying100)
 		}
 	case trans.timerg:
-		if trans.state == completed {
+		if trans.state == Completed {
 			trans.timerg.start(min(2*trans.timerg.Duration, t2))
-			trans.call_transport_callback(trans.last_res)
+			trans.retransmit(trans.last_res)
 		}
 	case trans.timeri:
-		if trans.state == confirmed {
-			trans.state = terminated
-			trans.call_term_callback(NORMAL)
+		if trans.state == Confirmed {
+			trans.terminate(nil)
+		}
+	case trans.timerl:
+		if trans.state == Accepted {
+			trans.terminate(nil)
 		}
 	}
 }
 
 // handle_msg processes received SIP messages (requests or responses)
 func (trans *Sitrans) handle_msg(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Handling message event")
-
 	if msg.Request != nil {
-		if msg.Request.Method == Ack && trans.state == completed {
+		if msg.Request.Method == Ack && !trans.match_ack(msg) {
+			return
+		}
+
+		if msg.Request.Method == Ack && trans.state == Completed {
 			trans.timerg.stop()
 			trans.timerh.stop()
-			trans.timeri.start(tii_dur)
-			trans.state = confirmed
-		} else if msg.Request.Method == Invite && trans.state == completed {
-			trans.call_transport_callback(trans.last_res)
+			trans.timeri.start(trans.absorb_dur(tii_dur))
+			trans.set_state(Confirmed, msg)
+		} else if msg.Request.Method == Ack && trans.state == Accepted {
+			// ACK for a 2xx belongs to the TU, the transaction only matches it
+			trans.pass(msg)
+		} else if msg.Request.Method == Invite && trans.last_res != nil && (trans.state == Proceeding || trans.state == Completed) {
+			trans.retransmit(trans.last_res)
+		} else if msg.Request.Method == Cancel && trans.state == Proceeding {
+			trans.handle_cancel()
 		}
 		return
 	}
 
 	status_code := msg.Response.StatusCode
-	if status_code >= 100 && status_code < 200 && trans.state == proceeding {
+	if status_code >= 100 && status_code < 200 && trans.state == Proceeding {
 		trans.timerprv.stop()
-		trans.call_transport_callback(msg)
-	} else if status_code >= 200 && status_code <= 300 && trans.state == proceeding {
-		trans.state = terminated
-		trans.call_term_callback(NORMAL)
-		trans.call_transport_callback(msg)
-	} else if status_code > 300 {
-		trans.timerg.start(tig_dur)
+		trans.last_res = msg
+		trans.send(msg)
+	} else if status_code >= 200 && status_code < 300 && trans.state == Proceeding {
+		trans.timerprv.stop()
+		trans.timerl.start(til_dur)
+		trans.last_res = msg
+		trans.set_state(Accepted, msg)
+		trans.send(msg)
+	} else if status_code >= 200 && status_code < 300 && trans.state == Accepted {
+		// 2xx retransmitted by the TU
+		trans.send(msg)
+	} else if status_code >= 300 && trans.state == Proceeding {
+		trans.timerprv.stop()
+		if !trans.reliable() {
+			trans.timerg.start(tig_dur)
+		}
 		trans.timerh.start(tih_dur)
 		trans.last_res = msg
-		trans.state = completed
-		trans.call_transport_callback(msg)
+		trans.set_state(Completed, msg)
+		trans.send(msg)
 	}
 }
 
-// Helper functions for callbacks
-func (sitrans Sitrans) call_core_callback(message *SIPMessage) {
-	//log.Trace().Str("transaction_id", sitrans.id.String()).Interface("message", message).Msg("Invoking core callback")
-	sitrans.core_cb(sitrans.transport, message)
-}
-
-func (sitrans Sitrans) call_transport_callback(message *SIPMessage) {
-	//log.Trace().Str("transaction_id", sitrans.id.String()).Interface("message", message).Msg("Invoking transport callback")
-	if !sitrans.trpt_cb(sitrans.transport, message) {
-		sitrans.state = terminated
-		sitrans.call_term_callback(ERROR)
+// match_ack checks the To tag of an ACK matched without the magic cookie (RFC 3261 17.2.3),
+// branches of RFC 3261 compliant clients are unique and need no further check
+func (trans *Sitrans) match_ack(ack *SIPMessage) bool {
+	if hasMagicCookie(trans.message.TopmostVia.Branch) {
+		return true
 	}
+	return trans.last_res != nil && bytes.Equal(ack.toTag(), trans.last_res.toTag())
 }
 
-func (sitrans Sitrans) call_term_callback(reason TERM_REASON) {
-	//log.Trace().Str("transaction_id", sitrans.id.String()).Interface("termination_reason", reason).Msg("Invoking termination callback")
-	sitrans.term_cb(sitrans.id, reason)
+/*
+	 RFC 3261 9.2
+			If the UAS did not find a matching transaction for the CANCEL
+			according to the procedure above, it SHOULD respond to the CANCEL
+			with a 481 (Call Leg/Transaction Does Not Exist).  If the transaction
+			for the original request still exists, the behavior of the UAS on
+			receiving a CANCEL request depends on whether it has already sent a
+			final response for the original request.  If it has, the CANCEL
+			request has no effect on the processing of the original request, no
+			effect on any session state, and no effect on the responses generated
+			for the original request.  If the UAS has not issued a final response
+			for the original request, its behavior depends on the method of the
+			original request.  If the original request was an INVITE, the UAS
+			SHOULD immediately respond to the INVITE with a 487 (Request
+			Terminated).
+*/
+// handle_cancel answers the INVITE with 487, the TU is notified of the CANCEL
+// by the server transaction of the CANCEL itself
+func (trans *Sitrans) handle_cancel() {
+	request_terminated := makeGenericResponse(487, []byte("Request Terminated"), trans.message)
+	if trans.last_res != nil {
+		request_terminated.setToTag(trans.last_res.toTag()) // Same dialog as the provisional responses
+	} else {
+		request_terminated.setToTag(GenerateTag())
+	}
+	trans.handle_msg(request_terminated)
 }
 
+// makeGenericResponse builds a response to a request, copying the header fields of RFC 3261 8.2.6.2
 func makeGenericResponse(status_code int, reason []byte, request *SIPMessage) *SIPMessage {
-	req_hdr := request.Headers
 	res_hdr := make(map[SIPHeader][][]byte)
-
-	if value, ok := req_hdr[Via]; ok {
-		res_hdr[Via] = value
-	}
-
-	if value, ok := req_hdr[SessionID]; ok {
-		res_hdr[SessionID] = value
-	}
-
+	copyHeaders(res_hdr, request.Headers, Via, From, To, CallID, CSeq, SessionID)
 	res_hdr[ContentLength] = [][]byte{[]byte("0")}
 
+	options := request.Options
+	options.ParseContacts = false
+
 	return &SIPMessage{
 		Startline:  Startline{Response: &Response{StatusCode: status_code, ReasonPhrase: reason}},
 		From:       request.From,
@@ -180,5 +248,6 @@ func makeGenericResponse(status_code int, reason []byte, request *SIPMessage) *S
 		TopmostVia: request.TopmostVia,
 		CSeq:       request.CSeq,
 		Headers:    res_hdr,
+		Options:    options,
 	}
 }
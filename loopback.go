@@ -0,0 +1,76 @@
+package sip
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Size of the queue of the messages sent over a Loopback
+const loopback_len = 64
+
+// Loopback is an in-memory transport for tests: the messages sent over it are
+// serialized and parsed back, as they would be by the remote end, and queued
+// for Sent. It is reliable for connection oriented protocols.
+type Loopback struct {
+	protocol string
+	laddr    string
+	raddr    string
+	sent     chan *SIPMessage
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewLoopback creates a loopback transport of a protocol, such as udp or tcp,
+// between two addresses
+func NewLoopback(protocol, laddr, raddr string) *Loopback {
+	return &Loopback{
+		protocol: protocol,
+		laddr:    laddr,
+		raddr:    raddr,
+		sent:     make(chan *SIPMessage, loopback_len),
+	}
+}
+
+// Send queues a copy of the message, it fails once the transport is closed or
+// when the queue is full
+func (l *Loopback) Send(msg *SIPMessage) error {
+	cp, err := ParseSipMessage(msg.Serialize(), msg.Options)
+	if err != nil {
+		return fmt.Errorf("loopback: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrTransportClosed
+	}
+	select {
+	case l.sent <- cp:
+		return nil
+	default:
+		return fmt.Errorf("loopback: %d messages are waiting", loopback_len)
+	}
+}
+
+// Sent returns the queue of the messages sent, closed once the transport is
+func (l *Loopback) Sent() <-chan *SIPMessage {
+	return l.sent
+}
+
+func (l *Loopback) LocalAddr() string  { return l.laddr }
+func (l *Loopback) RemoteAddr() string { return l.raddr }
+func (l *Loopback) Protocol() string   { return l.protocol }
+func (l *Loopback) Reliable() bool     { return reliable(l.protocol) }
+func (l *Loopback) Secure() bool       { return l.protocol == "tls" || l.protocol == "wss" }
+
+// Close stops the transport, the messages already sent are still queued
+func (l *Loopback) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.sent)
+	}
+	return nil
+}
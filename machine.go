@@ -0,0 +1,231 @@
+package sip
+
+import (
+	"context"
+	"time"
+)
+
+// EventKind tells what happened to a transaction
+type EventKind int
+
+const (
+	StartEvent          EventKind = iota // The transaction is started by its executor
+	MessageEvent                         // A message was queued with Event
+	TimerEvent                           // A timer of the transaction expired
+	TransportErrorEvent                  // A SendAction failed with Err
+	SpawnErrorEvent                      // A SpawnAction failed with Err
+	ShutdownEvent                        // The transaction layer is shutting down
+
+	callEvent // Runs call on the executor, never passed to Handle
+)
+
+// TransEvent is an input of a transaction state machine
+type TransEvent struct {
+	Kind EventKind
+	Msg  *SIPMessage // MessageEvent
+	Err  error       // TransportErrorEvent and SpawnErrorEvent
+
+	timer *transTimer // TimerEvent
+	gen   uint64      // Generation of the timer when it was started
+	call  func()      // callEvent
+}
+
+// ActionKind tells what a state machine asks its executor to do
+type ActionKind int
+
+const (
+	SendAction       ActionKind = iota // Send Msg with the transport callback
+	PassAction                         // Pass Msg to the TU with the core callback
+	StartTimerAction                   // Queue a TimerEvent after Delay
+	StopTimerAction                    // Cancel a timer started before
+	SpawnAction                        // Run the transaction Trans, with ID, such as a CANCEL
+	TerminateAction                    // Inform the TU of the termination, Err is nil if normal
+)
+
+// Action is an output of a transaction state machine
+type Action struct {
+	Kind  ActionKind
+	Msg   *SIPMessage
+	Err   error
+	Delay time.Duration
+	ID    TransID
+	Trans SIPTransaction
+
+	timer *transTimer
+	gen   uint64
+}
+
+// StateMachine is the pure side of a transaction: Handle updates the state of
+// the transaction and returns the side effects of the event, in order, instead
+// of running them. The four transactions are state machines, run either by
+// Start in a goroutine of their own or by an EventLoop.
+type StateMachine interface {
+	Handle(ev TransEvent) []Action
+}
+
+// machine is implemented by the four transactions
+type machine interface {
+	SIPTransaction
+	StateMachine
+	base() *transaction
+	last_response() *SIPMessage
+}
+
+func (trans *transaction) base() *transaction {
+	return trans
+}
+
+// run is the executor of Start: the transaction runs in the calling goroutine
+// until it terminates or ctx is done
+func (trans *transaction) run(ctx context.Context, m StateMachine) {
+	if trans.spawn == nil {
+		trans.spawn = func(_ TransID, t SIPTransaction) error {
+			go t.Start(ctx)
+			return nil
+		}
+	}
+
+	trans.execute(m, m.Handle(TransEvent{Kind: StartEvent}))
+	for trans.state != Terminated {
+		var ev TransEvent
+		select {
+		case msg := <-trans.transc:
+			ev = TransEvent{Kind: MessageEvent, Msg: msg}
+		case ev = <-trans.timerc:
+		case call := <-trans.ctrl:
+			call()
+			continue
+		case <-ctx.Done():
+			ev = TransEvent{Kind: ShutdownEvent}
+		}
+		trans.execute(m, m.Handle(ev))
+	}
+}
+
+// execute runs the actions returned by the state machine. A failed send or
+// spawn is handed back to the state machine, whose actions run after the
+// pending ones.
+func (trans *transaction) execute(m StateMachine, actions []Action) {
+	for i := 0; i < len(actions); i++ {
+		a := actions[i]
+		switch a.Kind {
+		case SendAction:
+			if err := trans.call_transport_callback(a.Msg); err != nil {
+				actions = append(actions, m.Handle(TransEvent{Kind: TransportErrorEvent, Err: err})...)
+			}
+		case PassAction:
+			trans.call_core_callback(a.Msg)
+		case StartTimerAction:
+			if a.timer.handle != nil {
+				a.timer.handle.Stop()
+			}
+			ev := TransEvent{Kind: TimerEvent, timer: a.timer, gen: a.gen}
+			a.timer.handle = trans.sched.AfterFunc(a.Delay, func() { trans.expire(ev) })
+		case StopTimerAction:
+			if a.timer.handle != nil {
+				a.timer.handle.Stop()
+				a.timer.handle = nil
+			}
+		case SpawnAction:
+			if err := trans.spawn(a.ID, a.Trans); err != nil {
+				actions = append(actions, m.Handle(TransEvent{Kind: SpawnErrorEvent, Err: err})...)
+			}
+		case TerminateAction:
+			trans.finish(a.Err)
+		}
+	}
+}
+
+// do runs f on the executor of the transaction, between two events, and waits
+// for it. It returns false if the transaction terminates first. It must not be
+// called from a callback of the transaction.
+func (trans *transaction) do(f func()) bool {
+	ran := make(chan struct{})
+	call := func() {
+		f()
+		close(ran)
+	}
+
+	if trans.post != nil {
+		if !trans.post(TransEvent{Kind: callEvent, call: call}, true) {
+			return false
+		}
+	} else {
+		select {
+		case trans.ctrl <- call:
+		case <-trans.done:
+			return false
+		}
+	}
+
+	select {
+	case <-ran:
+		return true
+	case <-trans.done:
+		select {
+		case <-ran:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// conn_failed hands the failure of the connection of the request to the state
+// machine, unless a final response was received
+func (trans *transaction) conn_failed(m StateMachine, err error) {
+	trans.do(func() {
+		if trans.state == Calling || trans.state == Trying || trans.state == Proceeding {
+			trans.execute(m, m.Handle(TransEvent{Kind: TransportErrorEvent, Err: err}))
+		}
+	})
+}
+
+// expire queues a timer expiration, it is called by the scheduler and never
+// blocks it. A firing is dropped when the queue is full, which only happens
+// when the queue is filled by stale firings that the generation check would
+// discard anyway.
+func (trans *transaction) expire(ev TransEvent) {
+	if trans.post != nil {
+		trans.post(ev, true)
+		return
+	}
+
+	select {
+	case trans.timerc <- ev:
+	default:
+	}
+}
+
+// finish releases the timers and informs the TU once the state machine has terminated
+func (trans *transaction) finish(err error) {
+	close(trans.done)
+	for _, timer := range trans.timers {
+		if timer.handle != nil {
+			timer.handle.Stop()
+			timer.handle = nil
+		}
+	}
+	trans.observer.Terminated(trans.id, err)
+	trans.call_term_callback(err)
+	if trans.exit != nil {
+		trans.exit()
+	}
+}
+
+// call_core_callback passes a message to the TU
+func (trans *transaction) call_core_callback(msg *SIPMessage) {
+	trans.note_response(msg)
+	trans.core_cb(trans.transport, msg)
+}
+
+// call_transport_callback sends a message
+func (trans *transaction) call_transport_callback(msg *SIPMessage) error {
+	trans.note_response(msg)
+	return trans.trpt_cb(trans.transport, msg)
+}
+
+// call_term_callback informs the TU that the transaction has terminated
+func (trans *transaction) call_term_callback(err error) {
+	trans.term_cb(trans.id, err)
+}
@@ -128,12 +128,15 @@ func ParseSipMessage(msgRaw []byte, option ParseOptions) (*SIPMessage, error) {
 	// Parse headers
 	msg.Headers = make(map[SIPHeader][][]byte)
 	for len(headersPart) > 0 {
+		var line []byte
 		lineEnd := bytes.Index(headersPart, []byte("\r\n"))
-		if lineEnd == -1 {
-			break
+		if lineEnd == -1 { // Last header, its CRLF is part of the header-body separator
+			line = headersPart
+			headersPart = nil
+		} else {
+			line = headersPart[:lineEnd]
+			headersPart = headersPart[lineEnd+2:]
 		}
-		line := headersPart[:lineEnd]
-		headersPart = headersPart[lineEnd+2:]
 
 		colonIndex := bytes.IndexByte(line, ':')
 		if colonIndex == -1 {
@@ -323,7 +326,8 @@ func (msg SIPMessage) GetHeader(header SIPHeader) [][]byte {
 }
 
 func (msg *SIPMessage) AddVia(v SIPVia) {
-	msg.Headers[Via] = append(msg.Headers[Via], msg.TopmostVia.Serialize())
+	// The previous top Via comes first among the others
+	msg.Headers[Via] = append([][]byte{msg.TopmostVia.Serialize()}, msg.Headers[Via]...)
 	msg.TopmostVia = v
 }
 
@@ -336,6 +340,29 @@ func (msg *SIPMessage) DeleteVia() {
 	msg.Headers[Via] = msg.Headers[Via][1:]
 }
 
+// topVia returns the top Via, parsed or not
+func (msg *SIPMessage) topVia() (SIPVia, error) {
+	if msg.Options.ParseTopMostVia {
+		return msg.TopmostVia, nil
+	}
+	vias := msg.Headers[Via]
+	if len(vias) == 0 {
+		return SIPVia{}, fmt.Errorf("missing Via header")
+	}
+	return ParseSipVia(vias[0])
+}
+
+// setTopVia replaces the top Via, parsed or not
+func (msg *SIPMessage) setTopVia(via SIPVia) {
+	if msg.Options.ParseTopMostVia {
+		msg.TopmostVia = via
+		return
+	}
+	if vias := msg.Headers[Via]; len(vias) > 0 {
+		msg.Headers[Via] = append([][]byte{via.Serialize()}, vias[1:]...)
+	}
+}
+
 func (msg *SIPMessage) AddHeader(header SIPHeader, value []byte) {
 	msg.Headers[header] = append(msg.Headers[header], value)
 }
@@ -344,6 +371,120 @@ func (msg *SIPMessage) DeleteHeader(header SIPHeader) {
 	delete(msg.Headers, header)
 }
 
+// cseq returns the CSeq of the message, parsing the raw header if the parser skipped it
+func (msg *SIPMessage) cseq() SIPCseq {
+	if msg.Options.ParseCseq {
+		return msg.CSeq
+	}
+	if raw := msg.Headers[CSeq]; len(raw) > 0 {
+		if cseq, err := ParseSipCseq(raw[0]); err == nil {
+			return cseq
+		}
+	}
+	return SIPCseq{Seq: -1}
+}
+
+// callID returns the Call-ID of the message whether or not the parser extracted it
+func (msg *SIPMessage) callID() []byte {
+	if msg.Options.ParseCallID {
+		return msg.CallID
+	}
+	if raw := msg.Headers[CallID]; len(raw) > 0 {
+		return raw[0]
+	}
+	return nil
+}
+
+// contacts returns the Contact header field values, parsing the raw header if the parser skipped it
+func (msg *SIPMessage) contacts() ([]SIPContact, error) {
+	if msg.Options.ParseContacts {
+		return msg.Contacts, nil
+	}
+	var contacts []SIPContact
+	for _, raw := range msg.Headers[Contact] {
+		contact, err := ParseSipContact(raw)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, nil
+}
+
+// from returns the From header field, parsing the raw header if the parser skipped it
+func (msg *SIPMessage) from() (SIPFromTo, error) {
+	if msg.Options.ParseFrom {
+		return msg.From, nil
+	}
+	if raw := msg.Headers[From]; len(raw) > 0 {
+		return ParseSipFromTo(raw[0])
+	}
+	return SIPFromTo{}, fmt.Errorf("missing From header")
+}
+
+// fromTag returns the tag of the From header field, parsing the raw header if the parser skipped it
+func (msg *SIPMessage) fromTag() []byte {
+	if msg.Options.ParseFrom {
+		return msg.From.Tag
+	}
+	if raw := msg.Headers[From]; len(raw) > 0 {
+		if from, err := ParseSipFromTo(raw[0]); err == nil {
+			return from.Tag
+		}
+	}
+	return nil
+}
+
+// to returns the To header field, parsing the raw header if the parser skipped it
+func (msg *SIPMessage) to() (SIPFromTo, error) {
+	if msg.Options.ParseTo {
+		return msg.To, nil
+	}
+	if raw := msg.Headers[To]; len(raw) > 0 {
+		return ParseSipFromTo(raw[0])
+	}
+	return SIPFromTo{}, fmt.Errorf("missing To header")
+}
+
+// toTag returns the tag of the To header field, parsing the raw header if the parser skipped it
+func (msg *SIPMessage) toTag() []byte {
+	if msg.Options.ParseTo {
+		return msg.To.Tag
+	}
+	if raw := msg.Headers[To]; len(raw) > 0 {
+		if to, err := ParseSipFromTo(raw[0]); err == nil {
+			return to.Tag
+		}
+	}
+	return nil
+}
+
+// setToTag adds a tag to the To header field, parsed or raw
+func (msg *SIPMessage) setToTag(tag []byte) {
+	if msg.Options.ParseTo {
+		msg.To.Tag = tag
+		return
+	}
+	if raw := msg.Headers[To]; len(raw) > 0 {
+		to := make([]byte, 0, len(raw[0])+5+len(tag))
+		to = append(to, raw[0]...)
+		to = append(to, ";tag="...)
+		to = append(to, tag...)
+		msg.Headers[To] = [][]byte{to}
+	}
+}
+
+// copyHeaders makes the raw values of the given headers in dst equal to those in src
+func copyHeaders(dst, src map[SIPHeader][][]byte, headers ...SIPHeader) {
+	for _, header := range headers {
+		if values, ok := src[header]; ok {
+			dst[header] = values
+		} else {
+			delete(dst, header)
+		}
+	}
+}
+
 // func GetValue(header string) string {
 // 	end := strings.Index(header, ";")
 // 	if end == -1 {
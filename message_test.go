@@ -187,3 +187,61 @@ func TestParseSIPMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestSipViaParams(t *testing.T) {
+	tests := []struct {
+		via        string
+		domain     string
+		port       int
+		branch     string
+		serialized string
+	}{
+		{"SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1;rport", "192.0.2.1", 5060, "z9hG4bK1", "SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1;rport"},
+		{"SIP/2.0/UDP 192.0.2.1;rport;branch=z9hG4bK1", "192.0.2.1", -1, "z9hG4bK1", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1;rport"},
+		{"SIP/2.0/TCP pc.example.com;received=192.0.2.1", "pc.example.com", -1, "", "SIP/2.0/TCP pc.example.com;received=192.0.2.1"},
+		{"SIP/2.0/UDP [2001:db8::1]:5070;branch=z9hG4bK1", "[2001:db8::1]", 5070, "z9hG4bK1", "SIP/2.0/UDP [2001:db8::1]:5070;branch=z9hG4bK1"},
+		{"SIP/2.0/UDP [2001:db8::1];branch=z9hG4bK1", "[2001:db8::1]", -1, "z9hG4bK1", "SIP/2.0/UDP [2001:db8::1];branch=z9hG4bK1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.via, func(t *testing.T) {
+			via, err := ParseSipVia([]byte(tt.via))
+			if err != nil {
+				t.Fatalf("ParseSipVia() error = %v", err)
+			}
+			if string(via.Domain) != tt.domain || via.Port != tt.port || string(via.Branch) != tt.branch {
+				t.Errorf("ParseSipVia() = %s:%d branch %q, want %s:%d branch %q", via.Domain, via.Port, via.Branch, tt.domain, tt.port, tt.branch)
+			}
+			if got := string(via.Serialize()); got != tt.serialized {
+				t.Errorf("Serialize() = %q, want %q", got, tt.serialized)
+			}
+		})
+	}
+
+	via, _ := ParseSipVia([]byte("SIP/2.0/UDP 192.0.2.1;rport;branch=z9hG4bK1;ttl=1"))
+	via.SetParam("rport", []byte("5070"))
+	via.SetParam("received", []byte("198.51.100.1"))
+	if got, want := string(via.Serialize()), "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1;ttl=1;rport=5070;received=198.51.100.1"; got != want {
+		t.Errorf("Serialize() after SetParam() = %q, want %q", got, want)
+	}
+	if rport, ok := via.Param("rport"); !ok || string(rport) != "5070" {
+		t.Errorf("Param(rport) = %q, %v, want 5070", rport, ok)
+	}
+}
+
+func TestAddViaKeepsOrder(t *testing.T) {
+	msg, err := ParseSipMessage([]byte("SIP/2.0 200 OK\r\n"+
+		"Via: SIP/2.0/UDP b.example.com;branch=z9hG4bKb\r\n"+
+		"Via: SIP/2.0/UDP a.example.com;branch=z9hG4bKa\r\n"+
+		"Content-Length: 0\r\n\r\n"), ParseOptions{ParseTopMostVia: true})
+	if err != nil {
+		t.Fatalf("ParseSipMessage() error = %v", err)
+	}
+
+	msg.AddVia(SIPVia{Tranport: "udp", Domain: []byte("c.example.com"), Port: -1, Branch: []byte("z9hG4bKc")})
+	msg.DeleteVia()
+	msg.DeleteVia()
+	if string(msg.TopmostVia.Domain) != "a.example.com" {
+		t.Errorf("top Via after removing two = %s, want a.example.com", msg.TopmostVia.Domain)
+	}
+}
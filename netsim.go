@@ -0,0 +1,264 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrHostUnreachable is returned when sending over a reliable transport of a
+// Network to an address without a host, as a refused connection would be
+var ErrHostUnreachable = errors.New("host unreachable")
+
+// Link holds the conditions of the path from a host of a Network to another.
+// Messages sent over reliable transports are only delayed by Latency: a
+// stream delivers them once and in order.
+type Link struct {
+	Latency   time.Duration // One way delay
+	Jitter    time.Duration // Random delay of up to Jitter added to Latency
+	Loss      float64       // Probability that a datagram is lost
+	Duplicate float64       // Probability that a datagram is delivered twice
+	Reorder   float64       // Probability that a datagram is held back by an extra Latency+Jitter
+}
+
+// Network simulates an IP network in memory to run several stacks, such as a
+// UAC, a proxy and a UAS, in one test process. Time is a FakeClock driving
+// both the delivery of messages and the transaction timers, and every
+// transaction runs on a single EventLoop worker. Advancing the clock fires
+// the timers and delivers the messages due, in order, waiting for the work
+// they cause before the next one, so that a seeded Network always runs a call
+// flow the same way.
+type Network struct {
+	Clock *FakeClock
+
+	loop *EventLoop
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	link    Link                    // Conditions of the paths without a Link of their own
+	links   map[[2]string]Link      // Conditions by source and destination address
+	streams map[[3]string]time.Time // Last delivery by source, destination and protocol
+	hosts   map[string]*Host
+	tap     func(src, dst string, msg *SIPMessage)
+}
+
+// Host is a node of a Network with a stack of its own
+type Host struct {
+	Stack   *Stack
+	Options ParseOptions // Options of ParseSipMessage for received messages
+
+	network *Network
+	addr    string
+	handler func(*SIPMessage, Transport)
+}
+
+// netTransport is a transport between two hosts of a Network
+type netTransport struct {
+	host     *Host
+	protocol string
+	raddr    string
+}
+
+// NewNetwork creates a network without hosts whose random conditions are
+// drawn from seed. Close must be called to release it.
+func NewNetwork(seed uint64) *Network {
+	n := &Network{
+		Clock:   NewFakeClock(),
+		loop:    NewEventLoop(1),
+		rand:    rand.New(rand.NewPCG(seed, seed)),
+		links:   make(map[[2]string]Link),
+		streams: make(map[[3]string]time.Time),
+		hosts:   make(map[string]*Host),
+	}
+	n.Clock.settle = n.loop.settle
+	return n
+}
+
+// SetDefaultLink sets the conditions of the paths without a Link of their own
+func (n *Network) SetDefaultLink(link Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.link = link
+}
+
+// SetLink sets the conditions of the path from src to dst, the reverse path is
+// left alone. Messages already in flight are not affected.
+func (n *Network) SetLink(src, dst string, link Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]string{src, dst}] = link
+}
+
+// Tap calls f for every message sent on the network, before it is lost or
+// delayed. f is called by the sender and must not block.
+func (n *Network) Tap(f func(src, dst string, msg *SIPMessage)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tap = f
+}
+
+// AddHost creates a host reachable at addr, an IP address and port such as
+// 192.0.2.1:5060. Its stack runs on the clock and the event loop of the network.
+func (n *Network) AddHost(addr string) *Host {
+	stack := NewStack()
+	stack.SetScheduler(n.Clock)
+	stack.SetEventLoop(n.loop)
+	h := &Host{
+		Stack: stack,
+		Options: ParseOptions{
+			ParseFrom:       true,
+			ParseTo:         true,
+			ParseCallID:     true,
+			ParseCseq:       true,
+			ParseTopMostVia: true,
+		},
+		network: n,
+		addr:    addr,
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hosts[addr] = h
+	return h
+}
+
+// Close terminates the transactions of every host and releases the network
+func (n *Network) Close() {
+	n.mu.Lock()
+	hosts := make([]*Host, 0, len(n.hosts))
+	for _, h := range n.hosts {
+		hosts = append(hosts, h)
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, h := range hosts {
+		h.Stack.Shutdown(ctx)
+	}
+	n.loop.Close()
+}
+
+// transmit puts a message on the wire and schedules its deliveries
+func (n *Network) transmit(src, dst, protocol string, msg *SIPMessage) error {
+	data := msg.Serialize()
+
+	n.mu.Lock()
+	tap := n.tap
+	_, reachable := n.hosts[dst]
+	link, ok := n.links[[2]string{src, dst}]
+	if !ok {
+		link = n.link
+	}
+
+	var delays []time.Duration
+	if reliable(protocol) {
+		if !reachable {
+			n.mu.Unlock()
+			return fmt.Errorf("%s: %w", dst, ErrHostUnreachable)
+		}
+		// Nothing overtakes the previous message of the stream
+		key := [3]string{src, dst, protocol}
+		at := n.Clock.Now().Add(link.Latency)
+		if last := n.streams[key]; at.Before(last) {
+			at = last
+		}
+		n.streams[key] = at
+		delays = append(delays, at.Sub(n.Clock.Now()))
+	} else if n.rand.Float64() >= link.Loss {
+		copies := 1
+		if n.rand.Float64() < link.Duplicate {
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			delay := link.Latency
+			if link.Jitter > 0 {
+				delay += time.Duration(n.rand.Int64N(int64(link.Jitter) + 1))
+			}
+			if n.rand.Float64() < link.Reorder {
+				delay += link.Latency + link.Jitter
+			}
+			delays = append(delays, delay)
+		}
+	}
+	n.mu.Unlock()
+
+	if tap != nil {
+		tap(src, dst, msg)
+	}
+	for _, delay := range delays {
+		n.Clock.AfterFunc(delay, func() { n.deliver(src, dst, protocol, data) })
+	}
+	return nil
+}
+
+// deliver dispatches a message received by a host as its transport layer
+// would, except that the handler runs in the calling goroutine
+func (n *Network) deliver(src, dst, protocol string, data []byte) {
+	n.mu.Lock()
+	h := n.hosts[dst]
+	n.mu.Unlock()
+	if h == nil { // Datagrams to nowhere are lost
+		return
+	}
+
+	msg, err := ParseSipMessage(data, h.Options)
+	if err != nil {
+		return
+	}
+	transport := &netTransport{host: h, protocol: protocol, raddr: src}
+	if msg.Request != nil {
+		stampVia(msg, transport)
+	}
+
+	if trans := h.Stack.FindTrans(msg); trans != nil {
+		trans.Event(msg)
+		return
+	}
+	if h.handler != nil {
+		h.handler(msg, transport)
+	}
+}
+
+// Addr returns the address of the host
+func (h *Host) Addr() string {
+	return h.addr
+}
+
+// Handle sets the handler of the messages received by the host that do not
+// match a transaction of its stack. It is called by FakeClock.Advance and,
+// like the callbacks of the transactions, must not block.
+func (h *Host) Handle(handler func(*SIPMessage, Transport)) {
+	h.handler = handler
+}
+
+// Transport returns the transport to send messages from the host to a
+// destination, which does not need to be a host of the network
+func (h *Host) Transport(dest Destination) (Transport, error) {
+	protocol := strings.ToLower(dest.Protocol)
+	switch protocol {
+	case "udp", "tcp", "tls", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("%q: %w", dest.Protocol, ErrUnsupportedTransport)
+	}
+	return &netTransport{host: h, protocol: protocol, raddr: dest.Addr}, nil
+}
+
+func (t *netTransport) Send(msg *SIPMessage) error {
+	return t.host.network.transmit(t.host.addr, t.raddr, t.protocol, msg)
+}
+
+func (t *netTransport) LocalAddr() string  { return t.host.addr }
+func (t *netTransport) RemoteAddr() string { return t.raddr }
+func (t *netTransport) Protocol() string   { return t.protocol }
+func (t *netTransport) Reliable() bool     { return reliable(t.protocol) }
+func (t *netTransport) Secure() bool       { return t.protocol == "tls" || t.protocol == "wss" }
+func (t *netTransport) Close() error       { return nil }
+
+func (t *netTransport) withRemoteAddr(raddr string) Transport {
+	return &netTransport{host: t.host, protocol: t.protocol, raddr: raddr}
+}
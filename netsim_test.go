@@ -0,0 +1,257 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	uacAddr   = "192.0.2.1:5060"
+	uasAddr   = "192.0.2.2:5060"
+	uas2Addr  = "192.0.2.3:5060"
+	proxyAddr = "192.0.2.10:5060"
+)
+
+func newTestNetwork(t *testing.T, seed uint64) *Network {
+	n := NewNetwork(seed)
+	t.Cleanup(n.Close)
+	return n
+}
+
+// answerWith makes a host answer every request with responses of the given
+// status codes, the final one with a To tag of its own
+func answerWith(h *Host, codes ...int) {
+	h.Handle(func(msg *SIPMessage, transport Transport) {
+		trans, err := h.Stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+		if err != nil {
+			return
+		}
+		tag := GenerateTag()
+		for _, code := range codes {
+			res := makeGenericResponse(code, []byte("Reason"), msg)
+			res.setToTag(tag)
+			trans.Event(res)
+		}
+	})
+}
+
+// startClient sends a request from a host to an address over UDP, the
+// responses and the termination are recorded with the time of the clock
+func startClient(t *testing.T, n *Network, h *Host, raw string, raddr string) (responses *[]*SIPMessage, terminated *[]error, at *[]time.Duration) {
+	t.Helper()
+	responses, terminated, at = new([]*SIPMessage), new([]error), new([]time.Duration)
+	start := n.Clock.Now()
+
+	transport, err := h.Transport(Destination{Protocol: "udp", Addr: raddr})
+	if err != nil {
+		t.Fatalf("Transport() error = %v", err)
+	}
+	_, err = h.Stack.StartClientTrans(parseTestMessage(t, raw), transport,
+		func(_ Transport, msg *SIPMessage) {
+			*responses = append(*responses, msg)
+			*at = append(*at, n.Clock.Now().Sub(start))
+		},
+		nil,
+		func(_ TransID, err error) { *terminated = append(*terminated, err) },
+	)
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	return responses, terminated, at
+}
+
+// sendTimes records when the requests from src are put on the wire
+func sendTimes(n *Network, src string) *[]time.Duration {
+	times := new([]time.Duration)
+	start := n.Clock.Now()
+	n.Tap(func(from, _ string, msg *SIPMessage) {
+		if from == src && msg.Request != nil {
+			*times = append(*times, n.Clock.Now().Sub(start))
+		}
+	})
+	return times
+}
+
+func ms(values ...int) []time.Duration {
+	durations := make([]time.Duration, len(values))
+	for i, v := range values {
+		durations[i] = time.Duration(v) * time.Millisecond
+	}
+	return durations
+}
+
+func TestNetworkNICTRetransmissions(t *testing.T) {
+	n := newTestNetwork(t, 1)
+	uac := n.AddHost(uacAddr)
+	answerWith(n.AddHost(uasAddr), 200)
+	n.SetDefaultLink(Link{Latency: 10 * time.Millisecond})
+	n.SetLink(uacAddr, uasAddr, Link{Latency: 10 * time.Millisecond, Loss: 1})
+
+	sent := sendTimes(n, uacAddr)
+	responses, _, at := startClient(t, n, uac, testOptions, uasAddr)
+
+	// Timer E doubles from T1 up to T2
+	n.Clock.Advance(10 * time.Second)
+	if want := ms(0, 500, 1500, 3500, 7500); !slices.Equal(*sent, want) {
+		t.Fatalf("OPTIONS sent at %v, want %v", *sent, want)
+	}
+	if len(*responses) != 0 {
+		t.Fatalf("received %d responses through a lossy link", len(*responses))
+	}
+
+	n.SetLink(uacAddr, uasAddr, Link{Latency: 10 * time.Millisecond})
+	n.Clock.Advance(5 * time.Second)
+	if want := ms(0, 500, 1500, 3500, 7500, 11500); !slices.Equal(*sent, want) {
+		t.Errorf("OPTIONS sent at %v, want %v", *sent, want)
+	}
+	if want := ms(11520); !slices.Equal(*at, want) {
+		t.Errorf("responses received at %v, want %v", *at, want)
+	}
+}
+
+func TestNetworkICTTimeout(t *testing.T) {
+	n := newTestNetwork(t, 1)
+	uac := n.AddHost(uacAddr)
+	n.AddHost(uasAddr)
+	n.SetDefaultLink(Link{Loss: 1})
+
+	sent := sendTimes(n, uacAddr)
+	_, terminated, _ := startClient(t, n, uac, testInvite, uasAddr)
+
+	// Timer A doubles without bound until Timer B fires after 64*T1
+	n.Clock.Advance(tib_dur*time.Millisecond - time.Millisecond)
+	if want := ms(0, 500, 1500, 3500, 7500, 15500, 31500); !slices.Equal(*sent, want) {
+		t.Errorf("INVITE sent at %v, want %v", *sent, want)
+	}
+	if len(*terminated) != 0 {
+		t.Fatalf("terminated before Timer B with %v", *terminated)
+	}
+
+	n.Clock.Advance(time.Millisecond)
+	if len(*terminated) != 1 || !errors.Is((*terminated)[0], ErrTimeout) {
+		t.Errorf("terminated with %v, want a timeout", *terminated)
+	}
+}
+
+func TestNetworkForking(t *testing.T) {
+	n := newTestNetwork(t, 1)
+	uac := n.AddHost(uacAddr)
+	proxy := n.AddHost(proxyAddr)
+	answerWith(n.AddHost(uasAddr), 180, 200)
+	answerWith(n.AddHost(uas2Addr), 200)
+	n.SetDefaultLink(Link{Latency: 10 * time.Millisecond})
+	n.SetLink(proxyAddr, uas2Addr, Link{Latency: 50 * time.Millisecond})
+
+	// The proxy forwards the INVITE to both UASs and every response but 100
+	// back upstream
+	proxy.Handle(func(msg *SIPMessage, transport Transport) {
+		server, err := proxy.Stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+		if err != nil {
+			t.Errorf("StartServerTrans() error = %v", err)
+			return
+		}
+		for _, addr := range []string{uasAddr, uas2Addr} {
+			branch, _ := ParseSipMessage(msg.Serialize(), msg.Options)
+			via, _ := ParseSipVia([]byte("SIP/2.0/UDP " + proxyAddr + ";rport"))
+			via.Branch = GenerateBranch()
+			branch.AddVia(via)
+
+			target, _ := proxy.Transport(Destination{Protocol: "udp", Addr: addr})
+			proxy.Stack.StartClientTrans(branch, target,
+				func(_ Transport, res *SIPMessage) {
+					if res.Response.StatusCode != 100 {
+						res.DeleteVia()
+						server.Event(res)
+					}
+				},
+				nil,
+				func(TransID, error) {},
+			)
+		}
+	})
+
+	responses, _, _ := startClient(t, n, uac, testInvite, proxyAddr)
+	n.Clock.Advance(time.Second)
+
+	// The early and the confirmed dialog of the first UAS, before the proxy
+	// sends a 100 of its own, then the late 2xx of the second one
+	var got []string
+	for _, res := range *responses {
+		got = append(got, fmt.Sprint(res.Response.StatusCode))
+	}
+	if want := []string{"180", "200", "200"}; !slices.Equal(got, want) {
+		t.Fatalf("UAC received %v, want %v", got, want)
+	}
+	if tag1, tag2 := (*responses)[1].toTag(), (*responses)[2].toTag(); string(tag1) == string(tag2) {
+		t.Errorf("both 2xx have To tag %s, want one per UAS", tag1)
+	}
+}
+
+func TestNetworkDeterministic(t *testing.T) {
+	// Lossy conditions yield the same call flow for the same seed
+	run := func(seed uint64) (trace []string) {
+		n := newTestNetwork(t, seed)
+		uac := n.AddHost(uacAddr)
+		answerWith(n.AddHost(uasAddr), 200)
+		n.SetDefaultLink(Link{
+			Latency:   20 * time.Millisecond,
+			Jitter:    30 * time.Millisecond,
+			Loss:      0.3,
+			Duplicate: 0.3,
+			Reorder:   0.3,
+		})
+		start := n.Clock.Now()
+		n.Tap(func(src, dst string, msg *SIPMessage) {
+			line, _, _ := strings.Cut(string(msg.Serialize()), "\r\n")
+			trace = append(trace, fmt.Sprintf("%v %s>%s %s", n.Clock.Now().Sub(start), src, dst, line))
+		})
+
+		responses, terminated, _ := startClient(t, n, uac, testOptions, uasAddr)
+		n.Clock.Advance(time.Minute)
+		if len(*terminated) != 1 {
+			t.Fatalf("terminated %d times, want once", len(*terminated))
+		}
+		// Duplicated and retransmitted responses are absorbed
+		if len(*responses) > 1 {
+			t.Errorf("received %d final responses, want at most one", len(*responses))
+		}
+		trace = append(trace, fmt.Sprintf("%d responses, %v", len(*responses), (*terminated)[0]))
+		return trace
+	}
+
+	first := run(7)
+	if second := run(7); !slices.Equal(first, second) {
+		t.Errorf("first run:\n%v\nsecond run:\n%v", first, second)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock()
+	var fired []int
+	clock.AfterFunc(20*time.Millisecond, func() { fired = append(fired, 20) })
+	clock.AfterFunc(10*time.Millisecond, func() {
+		fired = append(fired, 10)
+		// Due within the same Advance
+		clock.AfterFunc(5*time.Millisecond, func() { fired = append(fired, 15) })
+	})
+	stopped := clock.AfterFunc(10*time.Millisecond, func() { fired = append(fired, -1) })
+	if !stopped.Stop() {
+		t.Fatalf("Stop() = false for a pending timer")
+	}
+
+	clock.Advance(19 * time.Millisecond)
+	if want := []int{10, 15}; !slices.Equal(fired, want) {
+		t.Errorf("fired %v after 19ms, want %v", fired, want)
+	}
+	clock.Advance(time.Millisecond)
+	if want := []int{10, 15, 20}; !slices.Equal(fired, want) {
+		t.Errorf("fired %v after 20ms, want %v", fired, want)
+	}
+	if got := clock.Now().Sub(time.Unix(0, 0)); got != 20*time.Millisecond {
+		t.Errorf("Now() is %v after the epoch, want 20ms", got)
+	}
+}
@@ -1,5 +1,9 @@
 package sip
 
+import (
+	"context"
+)
+
 /*
                              |Request from TU
                              |send request
@@ -45,143 +49,109 @@ package sip
 
 // NIctrans represents the state machine for a Non-Invite Client Transaction
 type NIctrans struct {
-	id        TransID                               // Transaction ID
-	state     state                                 // Current state of the transaction
-	message   *SIPMessage                           // The SIP message associated with the transaction
-	transport *SIPTransport                         // Transport layer for sending and receiving messages
-	timerE    *transTimer                           // Timer E for retransmissions
-	timerF    *transTimer                           // Timer F for transaction timeout
-	timerK    *transTimer                           // Timer K for termination after completion
-	transc    chan *SIPMessage                      // Channel for receiving events like timeouts or messages
-	trpt_cb   func(*SIPTransport, *SIPMessage) bool // Callback for transport layer
-	core_cb   func(*SIPTransport, *SIPMessage)      // Callback for core layer
-	term_cb   func(TransID, TERM_REASON)            // Termination callback
+	transaction
+	timerE *transTimer // Timer E for retransmissions
+	timerF *transTimer // Timer F for transaction timeout
+	timerK *transTimer // Timer K for termination after completion
 }
 
 // MakeNICT creates and initializes a new NIctrans instance with the given message and callbacks
 func MakeNICT(
 	id TransID,
 	msg *SIPMessage,
-	transport *SIPTransport,
-	core_callback func(*SIPTransport, *SIPMessage),
-	transport_callback func(*SIPTransport, *SIPMessage) bool,
-	term_callback func(TransID, TERM_REASON),
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
 ) *NIctrans {
-	//log.Trace().Str("transaction_id", id.String()).Interface("message", msg).Interface("transport", transport).Msg("Creating new Non-Invite client transaction")
 	return &NIctrans{
-		id:        id,
-		message:   msg,
-		transport: transport,
-		transc:    make(chan *SIPMessage, 5),
-		timerE:    newTransTimer("Timer E"),
-		timerF:    newTransTimer("Timer F"),
-		timerK:    newTransTimer("Timer K"),
-		state:     trying,
-		trpt_cb:   transport_callback,
-		core_cb:   core_callback,
-		term_cb:   term_callback,
+		transaction: makeTransaction(id, NON_INVITE_CLIENT, Trying, msg, transport, core_callback, transport_callback, term_callback),
+		timerE:      newTransTimer("Timer E"),
+		timerF:      newTransTimer("Timer F"),
+		timerK:      newTransTimer("Timer K"),
 	}
 }
 
-// Event is used to send events to the transaction, which are handled in the Start() method
-func (trans *NIctrans) Event(msg *SIPMessage) {
-	if trans.state == terminated {
-		return
-	}
-
-	trans.transc <- msg
+// Start runs the transaction in the calling goroutine.
+// It returns when the transaction terminates or ctx is done.
+func (trans *NIctrans) Start(ctx context.Context) {
+	trans.run(ctx, trans)
 }
 
-// Start initiates the transaction processing by running the main event loop
-func (trans *NIctrans) Start() {
-	//log.Trace().Str("transaction_id", trans.id.String()).Msg("Starting Non-Invite client transaction")
-	// Start Timer F (64*T1)
-	trans.timerF.start(tif_dur)
-
-	// Send the request to the transport layer
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", trans.message).Msg("Initial action: Sending request")
-	trans.call_transport_callback(trans.message)
-
-	// Set Timer E for retransmission to fire at T1
-	trans.timerE.start(tie_dur)
-
-	for {
-		select {
-		case msg := <-trans.transc:
-			trans.handle_message(msg)
-		case <-trans.timerE.Timer.C:
-			trans.handle_timer(trans.timerE)
-		case <-trans.timerF.Timer.C:
-			trans.handle_timer(trans.timerF)
-		case <-trans.timerK.Timer.C:
-			trans.handle_timer(trans.timerK)
-		}
+// Handle runs the state machine on an event and returns the actions to execute
+func (trans *NIctrans) Handle(ev TransEvent) []Action {
+	if trans.state == Terminated {
+		return nil
+	}
 
-		if trans.state == terminated {
-			//log.Trace().Str("transaction_id", trans.id.String()).Msg("Transaction terminated")
-			close(trans.transc)
+	switch ev.Kind {
+	case StartEvent:
+		trans.init_timers(trans.timerE, trans.timerF, trans.timerK)
+		if trans.resume_timers() { // Restored transaction, the request has already been sent
 			break
 		}
+		// Start Timer F (64*T1)
+		trans.timerF.start(tif_dur)
+		// Send the request to the transport layer
+		trans.send(trans.message)
+		// Set Timer E for retransmission to fire at T1 over an unreliable transport
+		if !trans.reliable() {
+			trans.timerE.start(tie_dur)
+		}
+	case MessageEvent:
+		trans.handle_message(ev.Msg)
+	case TimerEvent:
+		if timer := trans.expired(ev); timer != nil {
+			trans.handle_timer(timer)
+		}
+	default:
+		trans.handle_error(ev)
 	}
+	return trans.flush()
+}
+
+func (trans *NIctrans) last_response() *SIPMessage {
+	return nil
 }
 
 // handle_timer processes timeout events (Timer E, F, K)
 func (trans *NIctrans) handle_timer(timer *transTimer) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Str("timer", timer.ID).Msg("Handling timer event")
 	switch timer {
 	case trans.timerF:
-		if trans.state < completed {
-			trans.state = terminated
-			trans.call_term_callback(TIMEOUT)
+		if trans.state < Completed {
+			trans.terminate(&TimeoutError{Timer: timer.ID})
 		}
 	case trans.timerE:
-		if trans.state < completed {
+		if trans.state < Completed {
 			trans.timerE.start(min(trans.timerE.Duration*2, t2))
-			trans.call_transport_callback(trans.message)
+			trans.retransmit(trans.message)
 		}
 	case trans.timerK:
-		if trans.state == completed {
-			trans.state = terminated
-			trans.call_term_callback(NORMAL)
+		if trans.state == Completed {
+			trans.terminate(nil)
 		}
 	}
 }
 
+/*
+	RFC 3261 17.1.2.2
+		The "Completed" state exists to buffer any additional response
+		retransmissions that may be received (which is why the client
+		transaction remains there only for unreliable transports).
+*/
 // handle_message processes received SIP messages (responses)
 func (trans *NIctrans) handle_message(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Handling message event")
-	if msg.Response == nil {
+	if msg.Response == nil || trans.state == Completed {
 		return
 	}
 
 	status_code := msg.Response.StatusCode
 	if status_code >= 100 && status_code < 200 {
-		trans.state = proceeding
-		trans.call_core_callback(msg)
+		trans.set_state(Proceeding, msg)
+		trans.pass(msg)
 	} else if status_code >= 200 && status_code <= 699 {
-		trans.timerK.start(tik_dur)
-		trans.state = completed
-		trans.call_core_callback(msg)
+		trans.timerK.start(trans.absorb_dur(tik_dur))
+		trans.set_state(Completed, msg)
+		trans.pass(msg)
 	}
 }
-
-// call_core_callback invokes the core callback with the provided event
-func (trans *NIctrans) call_core_callback(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Invoking core callback")
-	trans.core_cb(trans.transport, msg)
-}
-
-// call_transport_callback invokes the transport callback with the provided event
-func (trans *NIctrans) call_transport_callback(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Invoking transport callback")
-	if !trans.trpt_cb(trans.transport, msg) {
-		trans.state = terminated
-		trans.call_term_callback(ERROR)
-	}
-}
-
-// call_term_callback invokes the termination callback with the provided reason
-func (trans *NIctrans) call_term_callback(reason TERM_REASON) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("termination_reason", reason).Msg("Invoking termination callback")
-	trans.term_cb(trans.id, reason)
-}
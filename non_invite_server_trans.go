@@ -1,5 +1,9 @@
 package sip
 
+import (
+	"context"
+)
+
 /*
                              |Request received
                          |pass to TU
@@ -45,125 +49,93 @@ package sip
 
 // NIstrans represents the state machine for a Non-Invite Server Transaction
 type NIstrans struct {
-	id        TransID                               // Transaction ID
-	state     state                                 // Current state of the transaction
-	message   *SIPMessage                           // The SIP message associated with the transaction
-	transport *SIPTransport                         // Transport layer for sending and receiving messages
-	last_res  *SIPMessage                           // The last response received
-	timerJ    *transTimer                           // Timer J for retransmission
-	transc    chan *SIPMessage                      // Channel for receiving events like timeouts or messages
-	trpt_cb   func(*SIPTransport, *SIPMessage) bool // Callback for transport layer
-	core_cb   func(*SIPTransport, *SIPMessage)      // Callback for core layer
-	term_cb   func(TransID, TERM_REASON)            // Termination callback
+	transaction
+	last_res *SIPMessage // The last response received
+	timerJ   *transTimer // Timer J for retransmission
 }
 
 // MakeNIST creates and initializes a new NIstrans instance with the given message and callbacks
 func MakeNIST(
 	id TransID,
 	msg *SIPMessage,
-	transport *SIPTransport,
-	core_callback func(*SIPTransport, *SIPMessage),
-	transport_callback func(*SIPTransport, *SIPMessage) bool,
-	term_callback func(TransID, TERM_REASON),
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
 ) *NIstrans {
-	//log.Trace().Str("transaction_id", id.String()).Interface("message", msg).Interface("transport", transport).Msg("Creating new Non-Invite server transaction")
 	return &NIstrans{
-		id:        id,
-		message:   msg,
-		transport: transport,
-		transc:    make(chan *SIPMessage, 5),
-		timerJ:    newTransTimer("Timer J"),
-		state:     trying,
-		trpt_cb:   transport_callback,
-		core_cb:   core_callback,
-		term_cb:   term_callback,
+		transaction: makeTransaction(id, NON_INVITE_SERVER, Trying, msg, transport, core_callback, transport_callback, term_callback),
+		timerJ:      newTransTimer("Timer J"),
 	}
 }
 
-// Event is used to send events to the transaction, which are handled in the Start() method
-func (trans *NIstrans) Event(msg *SIPMessage) {
-	if trans.state == terminated {
-		return
-	}
-
-	trans.transc <- msg
+// Start runs the transaction in the calling goroutine.
+// It returns when the transaction terminates or ctx is done.
+func (trans *NIstrans) Start(ctx context.Context) {
+	trans.run(ctx, trans)
 }
 
-// Start initiates the transaction processing by running the main event loop
-func (trans *NIstrans) Start() {
-	//log.Trace().Str("transaction_id", trans.id.String()).Msg("Starting Non-Invite server transaction")
-
-	// Call the core callback with the original message
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", trans.message).Msg("Initial action: Passing request to core")
-	trans.call_core_callback(trans.message)
-
-	for {
-		select {
-		case msg := <-trans.transc:
-			trans.handle_msg(msg)
-		case <-trans.timerJ.Timer.C:
-			trans.handle_timer(trans.timerJ)
-		}
+// Handle runs the state machine on an event and returns the actions to execute
+func (trans *NIstrans) Handle(ev TransEvent) []Action {
+	if trans.state == Terminated {
+		return nil
+	}
 
-		if trans.state == terminated {
-			//log.Trace().Str("transaction_id", trans.id.String()).Msg("Transaction terminated")
-			close(trans.transc)
+	switch ev.Kind {
+	case StartEvent:
+		trans.init_timers(trans.timerJ)
+		if trans.resume_timers() { // Restored transaction, the TU already has the request
 			break
 		}
+		// Pass the original message to the core
+		trans.pass(trans.message)
+	case MessageEvent:
+		trans.handle_msg(ev.Msg)
+	case TimerEvent:
+		if timer := trans.expired(ev); timer != nil {
+			trans.handle_timer(timer)
+		}
+	default:
+		trans.handle_error(ev)
 	}
+	return trans.flush()
+}
+
+func (trans *NIstrans) last_response() *SIPMessage {
+	return trans.last_res
 }
 
 // handle_timer processes timeout events (Timer J)
 func (trans *NIstrans) handle_timer(timer *transTimer) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Str("timer", timer.ID).Msg("Handling timer event")
-	if timer == trans.timerJ && trans.state == completed {
-		trans.state = terminated
-		trans.call_term_callback(NORMAL)
+	if timer == trans.timerJ && trans.state == Completed {
+		trans.terminate(nil)
 	}
 }
 
 // handle_msg processes received SIP messages (requests or responses)
 func (trans *NIstrans) handle_msg(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Handling message event")
-
 	if msg.Request != nil {
-		if trans.state == proceeding || trans.state == completed {
-			trans.call_transport_callback(trans.last_res)
+		if trans.state == Proceeding || trans.state == Completed {
+			trans.retransmit(trans.last_res)
 		}
 		return
 	}
 
+	if trans.state >= Completed { // The request has already been answered
+		return
+	}
+
 	status_code := msg.Response.StatusCode
 	if status_code >= 100 && status_code < 200 {
-		trans.state = proceeding
-		trans.call_core_callback(msg)
-		trans.call_transport_callback(msg)
+		trans.set_state(Proceeding, msg)
+		trans.last_res = msg
+		trans.pass(msg)
+		trans.send(msg)
 	} else if status_code >= 200 && status_code <= 699 {
-		trans.state = completed
+		trans.set_state(Completed, msg)
 		trans.last_res = msg
-		trans.call_core_callback(msg)
-		trans.call_transport_callback(msg)
-		trans.timerJ.start(tij_dur)
+		trans.pass(msg)
+		trans.send(msg)
+		trans.timerJ.start(trans.absorb_dur(tij_dur))
 	}
 }
-
-// call_core_callback invokes the core callback with the provided event
-func (trans *NIstrans) call_core_callback(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Invoking core callback")
-	trans.core_cb(trans.transport, msg)
-}
-
-// call_transport_callback invokes the transport callback with the provided event
-func (trans *NIstrans) call_transport_callback(msg *SIPMessage) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("message", msg).Msg("Invoking transport callback")
-	if !trans.trpt_cb(trans.transport, msg) {
-		trans.state = terminated
-		trans.call_term_callback(ERROR)
-	}
-}
-
-// call_term_callback invokes the termination callback with the provided reason
-func (trans *NIstrans) call_term_callback(reason TERM_REASON) {
-	//log.Trace().Str("transaction_id", trans.id.String()).Interface("termination_reason", reason).Msg("Invoking termination callback")
-	trans.term_cb(trans.id, reason)
-}
@@ -0,0 +1,27 @@
+package sip
+
+// Observer is notified of everything happening inside transactions, so that
+// logging, metrics or tracing can be attached to the transaction layer. Methods
+// are called from the goroutine or event loop worker running the transaction,
+// in order, and must not block.
+type Observer interface {
+	// StateChanged is called on every transition, msg is the message that caused
+	// it or nil if it was caused by a timer or the transaction layer
+	StateChanged(id TransID, from State, to State, msg *SIPMessage)
+	// TimerFired is called when a timer expires, before the expiration is handled
+	TimerFired(id TransID, timer string, state State)
+	// Retransmitted is called before a message is sent again
+	Retransmitted(id TransID, msg *SIPMessage)
+	// Terminated is called once, before the termination callback, err is nil
+	// for a normal termination
+	Terminated(id TransID, err error)
+}
+
+// NopObserver ignores every notification. Embed it to implement only some of
+// the Observer methods.
+type NopObserver struct{}
+
+func (NopObserver) StateChanged(TransID, State, State, *SIPMessage) {}
+func (NopObserver) TimerFired(TransID, string, State)               {}
+func (NopObserver) Retransmitted(TransID, *SIPMessage)              {}
+func (NopObserver) Terminated(TransID, error)                       {}
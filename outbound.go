@@ -0,0 +1,234 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default keep-alive intervals of RFC 5626 flows without Flow-Timer, short
+// enough for NATs dropping UDP bindings after 30 seconds
+const (
+	DefaultUDPKeepAlive    = 25 * time.Second
+	DefaultStreamKeepAlive = 120 * time.Second
+)
+
+// DefaultKeepAliveTimeout is the time to wait for a pong or a STUN response
+const DefaultKeepAliveTimeout = 10 * time.Second
+
+// ErrFlowFailed is returned when a flow is closed, does not answer keep-alives
+// or is mapped to another address by a NAT (RFC 5626 4.4)
+var ErrFlowFailed = errors.New("flow failed")
+
+/*
+	RFC 5626 3.5.1
+		This approach can only be used with connection-oriented transports
+		such as TCP or SCTP.  The client periodically sends a double-CRLF
+		(the "ping") then waits to receive a single CRLF (the "pong").
+*/
+// Keep-alives of connections
+var (
+	keepalive_ping = []byte("\r\n\r\n")
+	keepalive_pong = []byte("\r\n")
+)
+
+// isKeepAlive reports whether a message read from a stream is a ping or a pong
+func isKeepAlive(msg []byte) bool {
+	return len(msg) > 0 && len(bytes.Trim(msg, "\r\n")) == 0
+}
+
+// keepAlive answers a ping and passes a pong to the keep-alives of the connection
+func (tl *TransportLayer) keepAlive(sc *streamConn, msg []byte) {
+	if bytes.Equal(msg, keepalive_ping) {
+		sc.write(keepalive_pong)
+		return
+	}
+	select {
+	case sc.pong <- struct{}{}:
+	default:
+	}
+}
+
+// FlowToken returns a token identifying the flow a message was received on:
+// its connection, or its UDP socket and remote address. The token is signed
+// with a key of the transport layer, so that it cannot be forged to send
+// requests over another flow (RFC 5626 5.2).
+func (tl *TransportLayer) FlowToken(transport Transport) string {
+	flow := transport.Protocol() + " " + transport.LocalAddr() + " " + transport.RemoteAddr()
+	mac := hmac.New(sha256.New, tl.flow_key)
+	mac.Write([]byte(flow))
+	return base64.RawURLEncoding.EncodeToString(append(mac.Sum(nil)[:10], flow...))
+}
+
+// Flow returns the transport of a flow token to send requests over the flow
+// with, ErrFlowFailed if its connection is closed
+func (tl *TransportLayer) Flow(token string) (Transport, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < 10 {
+		return nil, fmt.Errorf("invalid flow token %q", token)
+	}
+	mac := hmac.New(sha256.New, tl.flow_key)
+	mac.Write(data[10:])
+	if !hmac.Equal(mac.Sum(nil)[:10], data[:10]) {
+		return nil, fmt.Errorf("invalid flow token %q", token)
+	}
+	fields := strings.Fields(string(data[10:]))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid flow token %q", token)
+	}
+	protocol, laddr, raddr := fields[0], fields[1], fields[2]
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if protocol == "udp" {
+		for _, conn := range tl.udp {
+			if conn.LocalAddr().String() == laddr {
+				return &UDPTransport{layer: tl, conn: conn, raddr: raddr}, nil
+			}
+		}
+		return nil, ErrFlowFailed
+	}
+
+	ap, err := netip.ParseAddrPort(raddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flow token %q", token)
+	}
+	sc := tl.conns[connKey{protocol, unmap(ap)}]
+	if sc == nil || sc.LocalAddr().String() != laddr {
+		return nil, ErrFlowFailed
+	}
+	return tl.streamTransport(protocol, raddr, "", sc), nil
+}
+
+/*
+	RFC 5626 4.4.1
+		If the Flow-Timer header field was present [...] the UA MUST send
+		keep-alives at least as often as this number of seconds.  If the UA
+		uses the server-recommended keep-alive frequency it SHOULD send its
+		keep-alives so that the interval between each keep-alive is randomly
+		distributed between 80% and 100% of the server-provided time.
+*/
+// KeepAliveInterval returns the keep-alive interval recommended by a
+// registrar in the Flow-Timer header field of a response
+func KeepAliveInterval(msg *SIPMessage) (time.Duration, bool) {
+	values := msg.Headers[FlowTimer]
+	if len(values) == 0 {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(string(values[0]))
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// KeepAlive sends keep-alives on a flow until stop is called: CRLF pings
+// answered by pongs on connections, STUN Binding requests over UDP. The
+// interval is the Flow-Timer of the registration, or the default of the
+// transport if zero. failed is called once if the flow fails, the keep-alives
+// are stopped then. The flow must be a transport of the transport layer.
+func (tl *TransportLayer) KeepAlive(flow Transport, interval time.Duration, failed func(error)) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultStreamKeepAlive
+		if !flow.Reliable() {
+			interval = DefaultUDPKeepAlive
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		var mapped netip.AddrPort // Address of the flow seen by the server
+		for {
+			wait := interval - time.Duration(rand.Int64N(int64(interval)/5+1))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			err := tl.ping(ctx, flow, &mapped)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				failed(err)
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// ping sends a keep-alive on a flow and waits for its answer
+func (tl *TransportLayer) ping(ctx context.Context, flow Transport, mapped *netip.AddrPort) error {
+	timeout := tl.KeepAliveTimeout
+	if timeout <= 0 {
+		timeout = DefaultKeepAliveTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var addr netip.AddrPort
+	var err error
+	switch t := flow.(type) {
+	case interface{ base() *streamTransport }:
+		return pingStream(ctx, t.base())
+	case *UDPTransport:
+		addr, err = tl.stunBinding(ctx, t)
+	default:
+		return fmt.Errorf("%w: %s transport of another transport layer", ErrFlowFailed, flow.Protocol())
+	}
+
+	/*
+		RFC 5626 4.4.2
+			If the XOR-MAPPED-ADDRESS in the STUN Binding Response changes,
+			the UA MUST treat this event as a failure on the flow.
+	*/
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFlowFailed, err)
+	}
+	if mapped.IsValid() && addr != *mapped {
+		return fmt.Errorf("%w: mapped to %s instead of %s", ErrFlowFailed, addr, *mapped)
+	}
+	*mapped = addr
+	return nil
+}
+
+/*
+	RFC 5626 4.4.1
+		If a pong is not received within 10 seconds after sending a ping
+		(or immediately after processing any incoming message being received
+		when that message is not a pong), then the client MUST treat the flow
+		as failed.
+*/
+// pingStream sends a ping on the connection of a flow and waits for the pong
+func pingStream(ctx context.Context, flow *streamTransport) error {
+	sc := flow.connection()
+	if sc == nil || sc.closed.Load() {
+		return ErrFlowFailed
+	}
+
+	select { // A pong received after the timeout of the previous ping
+	case <-sc.pong:
+	default:
+	}
+	sc.pinged.Store(true)
+	if err := sc.write(keepalive_ping); err != nil {
+		return fmt.Errorf("%w: %w", ErrFlowFailed, err)
+	}
+	select {
+	case <-sc.pong:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: no pong", ErrFlowFailed)
+	}
+}
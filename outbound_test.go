@@ -0,0 +1,207 @@
+package sip
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRegister = "REGISTER sip:example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/TCP 127.0.0.1:5060;branch=z9hG4bKreg1;rport\r\n" +
+	"From: Alice <sip:alice@example.com>;tag=4711\r\n" +
+	"To: Alice <sip:alice@example.com>\r\n" +
+	"Call-ID: reg@pc33.example.com\r\n" +
+	"CSeq: 1 REGISTER\r\n" +
+	"Supported: outbound\r\n" +
+	"Contact: <sip:alice@127.0.0.1;transport=tcp;ob>;+sip.instance=\"<urn:uuid:00000000-0000-1000-8000-000A95A0E128>\";reg-id=1\r\n" +
+	"Expires: 600\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+func TestCRLFKeepAliveIsAnswered(t *testing.T) {
+	server, _ := newTestLayer(t, "tcp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+
+	conn, err := net.Dial("tcp", server.TCPAddrs()[0].String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(keepalive_ping); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	pong := make([]byte, 4)
+	n, err := conn.Read(pong)
+	if err != nil || string(pong[:n]) != "\r\n" {
+		t.Errorf("Read() = %q, %v, want a CRLF pong", pong[:n], err)
+	}
+}
+
+func TestKeepAliveDetectsFailedFlow(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			server, _ := newTestLayer(t, network, "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+			client, _ := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+			client.KeepAliveTimeout = 300 * time.Millisecond
+
+			var flow Transport
+			if network == "udp" {
+				flow = testTransport(t, client, Destination{Protocol: network, Addr: server.UDPAddrs()[0].String()})
+			} else {
+				flow = testTransport(t, client, Destination{Protocol: network, Addr: server.TCPAddrs()[0].String()})
+				// The connection of the flow
+				if err := flow.Send(parseTestMessage(t, testOptions)); err != nil {
+					t.Fatalf("Send() error = %v", err)
+				}
+			}
+
+			failed := make(chan error, 1)
+			stop := client.KeepAlive(flow, 50*time.Millisecond, func(err error) { failed <- err })
+			defer stop()
+
+			select {
+			case err := <-failed:
+				t.Fatalf("keep-alives failed with %v on a working flow", err)
+			case <-time.After(400 * time.Millisecond):
+			}
+
+			server.Close()
+			select {
+			case err := <-failed:
+				if !errors.Is(err, ErrFlowFailed) {
+					t.Errorf("keep-alives failed with %v, want ErrFlowFailed", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("keep-alives did not fail once the server is closed")
+			}
+		})
+	}
+}
+
+func TestRegistrarRoutesOverOutboundFlow(t *testing.T) {
+	var registrar *Registrar
+	server, _ := newTestLayer(t, "tcp", "127.0.0.1:0", func(tl *TransportLayer, msg *SIPMessage, transport Transport) {
+		if msg.Request != nil && msg.Request.Method == Register {
+			transport.Send(registrar.Register(msg, transport))
+		}
+	})
+	registrar = NewRegistrar(server)
+	registrar.FlowTimer = 25 * time.Second
+
+	received := make(chan *SIPMessage, 2)
+	client, _ := newTestLayer(t, "", "", queueHandler(received))
+	flow := testTransport(t, client, Destination{Protocol: "tcp", Addr: server.TCPAddrs()[0].String()})
+	if err := flow.Send(parseTestMessage(t, testRegister)); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	res := receive(t, received)
+	if res.Response == nil || res.Response.StatusCode != 200 {
+		t.Fatalf("received %v, want 200", res.Startline)
+	}
+	if !hasOptionTag(res.Headers[Require], "outbound") {
+		t.Errorf("Require = %q, want outbound", res.Headers[Require])
+	}
+	if interval, ok := KeepAliveInterval(res); !ok || interval != 25*time.Second {
+		t.Errorf("KeepAliveInterval() = %v, %v, want 25s", interval, ok)
+	}
+	if contacts := res.Headers[Contact]; len(contacts) != 1 || !strings.Contains(string(contacts[0]), "expires=600") {
+		t.Errorf("Contact = %q, want the binding with expires=600", contacts)
+	}
+
+	aor, _ := ParseSipUri([]byte("sip:alice@example.com"))
+	targets, err := registrar.Targets(aor)
+	if err != nil || len(targets) != 1 || targets[0].Flow == "" {
+		t.Fatalf("Targets() = %v, %v, want the flow of the registration", targets, err)
+	}
+	// The contact is not reachable, the request goes over the flow
+	if err := targets[0].Transport.Send(parseTestMessage(t, testOptions)); err != nil {
+		t.Fatalf("Send() over the flow error = %v", err)
+	}
+	if req := receive(t, received); req.Request == nil || req.Request.Method != Options {
+		t.Fatalf("received %v over the flow, want the OPTIONS", req.Startline)
+	}
+
+	client.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := registrar.Targets(aor)
+		if errors.Is(err, ErrFlowFailed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Targets() error = %v once the flow is closed, want ErrFlowFailed", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistrarBindings(t *testing.T) {
+	registrar := NewRegistrar(nil)
+	aor, _ := ParseSipUri([]byte("sip:alice@EXAMPLE.com"))
+	register := func(contact, expires string) int {
+		raw := strings.Replace(testRegister, "Expires: 600", "Expires: "+expires, 1)
+		raw = strings.Replace(raw, "Contact: <sip:alice@127.0.0.1;transport=tcp;ob>;+sip.instance=\"<urn:uuid:00000000-0000-1000-8000-000A95A0E128>\";reg-id=1", "Contact: "+contact, 1)
+		return registrar.Register(parseTestMessage(t, raw), nil).Response.StatusCode
+	}
+
+	if code := register("<sip:alice@192.0.2.1>", "600"); code != 200 {
+		t.Fatalf("Register() = %d, want 200", code)
+	}
+	if code := register("<sip:alice@192.0.2.2>;expires=60", "600"); code != 200 {
+		t.Fatalf("Register() = %d, want 200", code)
+	}
+	if code := register("<sip:alice@192.0.2.1>", "300"); code != 200 {
+		t.Fatalf("Register() refresh = %d, want 200", code)
+	}
+	if bindings := registrar.Lookup(aor); len(bindings) != 2 {
+		t.Fatalf("Lookup() = %d bindings, want 2", len(bindings))
+	}
+
+	// Outbound is not used without flow, reg-id still identifies the binding
+	if code := register("<sip:alice@192.0.2.3>;+sip.instance=\"<urn:uuid:1>\";reg-id=1", "600"); code != 200 {
+		t.Fatalf("Register() = %d, want 200", code)
+	}
+	if code := register("<sip:alice@192.0.2.4>;+sip.instance=\"<urn:uuid:1>\";reg-id=1", "600"); code != 200 {
+		t.Fatalf("Register() = %d, want 200", code)
+	}
+	if bindings := registrar.Lookup(aor); len(bindings) != 3 || bindings[2].Contact.Uri.Domain == nil || string(bindings[2].Contact.Uri.Domain) != "192.0.2.4" {
+		t.Fatalf("Lookup() = %v, want the binding of the instance replaced", bindings)
+	}
+	if code := register("<sip:alice@192.0.2.5>;reg-id=1", "600"); code != 400 {
+		t.Errorf("Register() with reg-id but no instance = %d, want 400", code)
+	}
+
+	if code := register("<sip:alice@192.0.2.2>", "0"); code != 200 {
+		t.Fatalf("Register() removal = %d, want 200", code)
+	}
+	if bindings := registrar.Lookup(aor); len(bindings) != 2 {
+		t.Fatalf("Lookup() = %d bindings after a removal, want 2", len(bindings))
+	}
+	if code := register("*", "600"); code != 400 {
+		t.Errorf("Register() with * and an expiration = %d, want 400", code)
+	}
+	if code := register("*", "0"); code != 200 {
+		t.Fatalf("Register() with * = %d, want 200", code)
+	}
+	if bindings := registrar.Lookup(aor); len(bindings) != 0 {
+		t.Errorf("Lookup() = %d bindings after removing all, want 0", len(bindings))
+	}
+}
+
+func TestFlowTokenCannotBeForged(t *testing.T) {
+	tl := NewTransportLayer(NewStack(), func(*SIPMessage, Transport) {})
+	flow := NewLoopback("tcp", "127.0.0.1:5060", "192.0.2.1:40000")
+	token := tl.FlowToken(flow)
+
+	if _, err := tl.Flow(token); !errors.Is(err, ErrFlowFailed) {
+		t.Errorf("Flow() of a closed connection error = %v, want ErrFlowFailed", err)
+	}
+	forged := NewTransportLayer(NewStack(), func(*SIPMessage, Transport) {}).FlowToken(flow)
+	if _, err := tl.Flow(forged); err == nil || errors.Is(err, ErrFlowFailed) {
+		t.Errorf("Flow() of a token of another transport layer error = %v, want an invalid token", err)
+	}
+}
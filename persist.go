@@ -0,0 +1,243 @@
+package sip
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TransRecord is the serializable state of a transaction, taken by
+// Stack.Checkpoint so that the transaction can be resumed by RestoreTrans on
+// another instance. Messages are kept as bytes on the wire.
+type TransRecord struct {
+	ID           TransID
+	Kind         TransType
+	State        State
+	Started      time.Time
+	Retransmits  int
+	Protocol     string
+	LocalAddr    string
+	RemoteAddr   string
+	Domain       string
+	Request      []byte       // The request that created the transaction
+	Options      ParseOptions // Options to parse Request and LastResponse with
+	LastResponse []byte       // Last response sent by a server transaction, or final response received by a client one
+	Timers       []TimerRecord
+}
+
+// TimerRecord is a running timer of a transaction
+type TimerRecord struct {
+	ID       string
+	Deadline time.Time
+	Interval int // Duration of the timer in milliseconds, doubled by retransmission timers
+}
+
+// TransStore keeps the records of transactions across instances
+type TransStore interface {
+	Save(rec *TransRecord) error
+	Load() ([]*TransRecord, error)
+	Delete(id TransID) error
+}
+
+// record returns the state of the transaction, it must run on its executor
+func (trans *transaction) record(last_res *SIPMessage) *TransRecord {
+	rec := &TransRecord{
+		ID:          trans.id,
+		Kind:        trans.kind,
+		State:       trans.state,
+		Started:     trans.started,
+		Retransmits: trans.retransmits,
+		Request:     trans.message.Serialize(),
+		Options:     trans.message.Options,
+	}
+	if trans.transport != nil {
+		rec.Protocol = trans.transport.Protocol()
+		rec.LocalAddr = trans.transport.LocalAddr()
+		rec.RemoteAddr = trans.transport.RemoteAddr()
+		if t, ok := trans.transport.(interface{ Domain() string }); ok && trans.transport.Secure() {
+			rec.Domain = t.Domain()
+		}
+	}
+	if last_res != nil {
+		rec.LastResponse = last_res.Serialize()
+	}
+	for _, timer := range trans.timers {
+		if timer.running {
+			rec.Timers = append(rec.Timers, TimerRecord{ID: timer.ID, Deadline: timer.deadline, Interval: timer.Duration})
+		}
+	}
+	return rec
+}
+
+// Record returns the state of a running transaction, or nil if it terminates first
+func Record(trans SIPTransaction) *TransRecord {
+	m, ok := trans.(machine)
+	if !ok {
+		return nil
+	}
+
+	var rec *TransRecord
+	if !m.base().do(func() { rec = m.base().record(m.last_response()) }) {
+		return nil
+	}
+	return rec
+}
+
+// RestoreTrans recreates a transaction from its record, with new callbacks
+// and transport. Once started, it restarts the timers of the record instead of
+// its initial actions, timers past their deadline fire right away.
+func RestoreTrans(
+	rec *TransRecord,
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
+) (SIPTransaction, error) {
+	msg, err := ParseSipMessage(rec.Request, rec.Options)
+	if err != nil {
+		return nil, fmt.Errorf("parsing request of %s: %w", rec.ID, err)
+	}
+
+	var last_res *SIPMessage
+	if rec.LastResponse != nil {
+		if last_res, err = ParseSipMessage(rec.LastResponse, rec.Options); err != nil {
+			return nil, fmt.Errorf("parsing last response of %s: %w", rec.ID, err)
+		}
+	}
+
+	var m machine
+	switch rec.Kind {
+	case INVITE_CLIENT:
+		ict := MakeICT(rec.ID, msg, transport, core_callback, transport_callback, term_callback)
+		if last_res != nil {
+			ict.last_res = last_res
+			updateAck(ict.ack, last_res)
+		}
+		m = ict
+	case INVITE_SERVER:
+		ist := MakeIST(rec.ID, msg, transport, core_callback, transport_callback, term_callback)
+		ist.last_res = last_res
+		m = ist
+	case NON_INVITE_CLIENT:
+		m = MakeNICT(rec.ID, msg, transport, core_callback, transport_callback, term_callback)
+	case NON_INVITE_SERVER:
+		nist := MakeNIST(rec.ID, msg, transport, core_callback, transport_callback, term_callback)
+		nist.last_res = last_res
+		m = nist
+	default:
+		return nil, fmt.Errorf("unknown transaction kind %v", rec.Kind)
+	}
+
+	b := m.base()
+	b.state = rec.State
+	b.started = rec.Started
+	b.changed = time.Now()
+	b.retransmits = rec.Retransmits
+	b.resume = rec.Timers
+	if b.resume == nil {
+		b.resume = []TimerRecord{} // Restored without running timers, still no initial actions
+	}
+	return m, nil
+}
+
+// resume_timers restarts the timers of a restored transaction, it reports
+// false for a new transaction, which runs its initial actions instead
+func (trans *transaction) resume_timers() bool {
+	if trans.resume == nil {
+		return false
+	}
+
+	now := trans.sched.Now()
+	for _, rec := range trans.resume {
+		for _, timer := range trans.timers {
+			if timer.ID == rec.ID {
+				timer.schedule(max(rec.Deadline.Sub(now), 0))
+				timer.Duration = rec.Interval
+			}
+		}
+	}
+	trans.resume = nil
+	return true
+}
+
+// FileStore is a TransStore keeping one JSON file per transaction in a directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates the directory of the store if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the file of a transaction, IDs are hex encoded as they contain
+// characters that are not allowed in file names
+func (fs *FileStore) path(id TransID) string {
+	return filepath.Join(fs.dir, hex.EncodeToString([]byte(id))+".json")
+}
+
+// Save writes the record to a temporary file renamed over the previous one, so
+// that a crash never leaves a partial record
+func (fs *FileStore) Save(rec *TransRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(fs.dir, "save-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path(rec.ID))
+}
+
+// Load reads every record of the store
+func (fs *FileStore) Load() ([]*TransRecord, error) {
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recs []*TransRecord
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(fs.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var rec TransRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", entry.Name(), err)
+		}
+		recs = append(recs, &rec)
+	}
+	return recs, nil
+}
+
+// Delete removes the record of a transaction, if any
+func (fs *FileStore) Delete(id TransID) error {
+	err := os.Remove(fs.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,253 @@
+package sip
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restoreAll restores every record of the store on a new stack
+func restoreAll(t *testing.T, store TransStore, send func(Transport, *SIPMessage) error) (*Stack, []SIPTransaction) {
+	t.Helper()
+	recs, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	stack := NewStack()
+	var restored []SIPTransaction
+	for _, rec := range recs {
+		trans, err := stack.RestoreTrans(rec, NewLoopback(rec.Protocol, rec.LocalAddr, rec.RemoteAddr),
+			func(Transport, *SIPMessage) {}, send, func(TransID, error) {})
+		if err != nil {
+			t.Fatalf("RestoreTrans() error = %v", err)
+		}
+		restored = append(restored, trans)
+	}
+	return stack, restored
+}
+
+func shutdownNow(stack *Stack) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stack.Shutdown(ctx)
+}
+
+func TestCheckpointRestoresServerTransaction(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	old := NewStack()
+	invite := parseTestMessage(t, testInvite)
+	ringing := make(chan *SIPMessage, 10)
+	trans, err := old.StartServerTrans(invite, NewLoopback("udp", "", "192.168.1.1:5060"),
+		func(Transport, *SIPMessage) {},
+		func(_ Transport, msg *SIPMessage) error { ringing <- msg; return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+	// Checkpoint once the 180 is sent, the record would not have it otherwise
+	trans.Event(makeGenericResponse(180, []byte("Ringing"), invite))
+	for msg := range ringing {
+		if msg.Response.StatusCode == 180 {
+			break
+		}
+	}
+
+	if err := old.Checkpoint(store); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	shutdownNow(old)
+
+	sent := make(chan *SIPMessage, 10)
+	stack, restored := restoreAll(t, store, func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil })
+	defer shutdownNow(stack)
+	if len(restored) != 1 {
+		t.Fatalf("restored %d transactions, want 1", len(restored))
+	}
+
+	snap := restored[0].Snapshot()
+	if snap.State != Proceeding || snap.RemoteAddr != "192.168.1.1:5060" {
+		t.Errorf("restored state, remote address = %v, %q", snap.State, snap.RemoteAddr)
+	}
+
+	// The retransmitted INVITE matches the restored transaction, which answers
+	// with the 180 sent before the hand-off
+	if found := stack.FindTrans(invite); found != restored[0] {
+		t.Fatalf("FindTrans() did not return the restored transaction")
+	}
+	restored[0].Event(invite)
+	select {
+	case msg := <-sent:
+		if msg.Response == nil || msg.Response.StatusCode != 180 {
+			t.Errorf("restored transaction sent %v, want the 180", msg.Response)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("restored transaction did not answer the retransmitted INVITE")
+	}
+}
+
+func TestCheckpointRestoresTimers(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	old := NewStack()
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	_, err = old.StartClientTrans(options, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	if err := old.Checkpoint(store); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	shutdownNow(old)
+
+	recs, _ := store.Load()
+	if len(recs) != 1 || len(recs[0].Timers) != 2 {
+		t.Fatalf("records = %+v, want one with Timer E and F", recs)
+	}
+
+	// Timer E keeps its deadline: the request is retransmitted after T1, not sent again right away
+	sent := make(chan *SIPMessage, 10)
+	stack, _ := restoreAll(t, store, func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil })
+	defer shutdownNow(stack)
+	select {
+	case msg := <-sent:
+		if msg.Request == nil || msg.Request.Method != Options {
+			t.Errorf("restored transaction sent %v, want the OPTIONS", msg.Startline)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timer E did not fire on the restored transaction")
+	}
+	if n := stack.Snapshot()[0].Retransmits; n != 1 {
+		t.Errorf("Retransmits = %d, want 1", n)
+	}
+
+	if err := store.Delete(recs[0].ID); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if recs, _ := store.Load(); len(recs) != 0 {
+		t.Errorf("Load() after Delete() returned %d records", len(recs))
+	}
+}
+
+func TestCheckpointTimersFollowScheduler(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	clock := NewFakeClock()
+	clock.Advance(time.Hour)
+	old := NewStack()
+	old.SetScheduler(clock)
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	_, err = old.StartClientTrans(options, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	if err := old.Checkpoint(store); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	shutdownNow(old)
+
+	recs, _ := store.Load()
+	if len(recs) != 1 {
+		t.Fatalf("Load() returned %d records, want 1", len(recs))
+	}
+	timerE := clock.Now().Add(tie_dur * time.Millisecond)
+	var deadline time.Time
+	for _, timer := range recs[0].Timers {
+		if timer.ID == "Timer E" {
+			deadline = timer.Deadline
+		}
+	}
+	if !deadline.Equal(timerE) {
+		t.Fatalf("Timer E deadline = %v, want %v", deadline, timerE)
+	}
+
+	// Restored 200ms later on the clock of the new stack, Timer E fires 300ms after
+	clock = NewFakeClock()
+	clock.Advance(time.Hour + 200*time.Millisecond)
+	stack := NewStack()
+	stack.SetScheduler(clock)
+	defer shutdownNow(stack)
+	sent := make(chan *SIPMessage, 10)
+	trans, err := stack.RestoreTrans(recs[0], NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("RestoreTrans() error = %v", err)
+	}
+	Record(trans) // Waits for the timers to be restarted
+
+	clock.Advance(299 * time.Millisecond)
+	select {
+	case <-sent:
+		t.Fatalf("Timer E fired before its deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("Timer E did not fire at its deadline")
+	}
+}
+
+func TestCheckpointDeletesTerminated(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	stack := NewStack()
+	defer shutdownNow(stack)
+	terminated := make(chan struct{})
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	trans, err := stack.StartServerTrans(options, NewLoopback("tcp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) { close(terminated) },
+	)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+	if err := stack.Checkpoint(store); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	if recs, _ := store.Load(); len(recs) != 1 {
+		t.Fatalf("Load() returned %d records, want 1", len(recs))
+	}
+
+	// Timer J is zero over TCP, the transaction terminates with its response
+	trans.Event(makeGenericResponse(200, []byte("OK"), options))
+	<-terminated
+	for stack.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := stack.Checkpoint(store); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	if recs, _ := store.Load(); len(recs) != 0 {
+		t.Errorf("Load() returned %d records of terminated transactions", len(recs))
+	}
+}
@@ -0,0 +1,293 @@
+package sip
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultExpires is the duration of a registration without expires parameter
+// nor Expires header field
+const DefaultExpires = time.Hour
+
+// Binding is a contact registered for an address-of-record
+type Binding struct {
+	Contact  SIPContact
+	Expires  time.Time
+	Instance string // +sip.instance of the UA without its quotes, such as <urn:uuid:...>
+	RegID    int    // reg-id of the flow of the instance (RFC 5626 4.2), zero without
+	Flow     string // Token of the flow the binding was registered on with outbound, empty without
+
+	updated time.Time
+}
+
+// replaces reports whether a binding is an update of another one: of the same
+// flow of the same instance, or of the same contact
+func (b *Binding) replaces(old *Binding) bool {
+	if b.RegID != 0 || old.RegID != 0 {
+		return b.RegID == old.RegID && b.Instance == old.Instance
+	}
+	return bytes.EqualFold(b.Contact.Uri.Serialize(), old.Contact.Uri.Serialize())
+}
+
+// Target is a binding with the transport to send requests to it with
+type Target struct {
+	Binding
+	Transport Transport // nil if the registrar has no transport layer
+}
+
+// Registrar is a location service updated by REGISTER requests (RFC 3261
+// 10.3). It supports outbound (RFC 5626): a binding whose contact has reg-id
+// and +sip.instance parameters, registered directly by a UA supporting
+// outbound, keeps the flow it was registered on, and requests to the UA are
+// sent over that flow.
+type Registrar struct {
+	Transport  *TransportLayer // Transports of the targets and tokens of the flows of outbound registrations, no outbound if nil
+	FlowTimer  time.Duration   // Keep-alive interval of outbound registrations, none if zero
+	MaxExpires time.Duration   // Longest registration, unlimited if zero
+
+	mu       sync.Mutex
+	bindings map[string][]*Binding // By address-of-record
+}
+
+// NewRegistrar creates a registrar without binding, supporting outbound over
+// the flows of a transport layer if not nil
+func NewRegistrar(tl *TransportLayer) *Registrar {
+	return &Registrar{
+		Transport: tl,
+		bindings:  make(map[string][]*Binding),
+	}
+}
+
+// Register updates the bindings of the address-of-record of a REGISTER
+// received on a transport, and returns the response to send: 200 with the
+// bindings of the address-of-record, or 400 for a malformed request.
+func (r *Registrar) Register(req *SIPMessage, transport Transport) *SIPMessage {
+	if req.Request == nil || req.Request.Method != Register {
+		return makeGenericResponse(400, []byte("Bad Request"), req)
+	}
+	to, err := req.to()
+	if err != nil {
+		return makeGenericResponse(400, []byte("Bad Request"), req)
+	}
+	contacts, err := req.contacts()
+	if err != nil {
+		return makeGenericResponse(400, []byte("Bad Contact"), req)
+	}
+
+	expires := DefaultExpires
+	if values := req.Headers[Expires]; len(values) > 0 {
+		seconds, err := strconv.Atoi(string(values[0]))
+		if err != nil || seconds < 0 {
+			return makeGenericResponse(400, []byte("Bad Expires"), req)
+		}
+		expires = time.Duration(seconds) * time.Second
+	}
+
+	// Flows are only known to the first hop of the UA
+	outbound := r.Transport != nil && transport != nil && hasOptionTag(req.Headers[Supported], "outbound") && viaCount(req) == 1
+
+	now := time.Now()
+	aor := aorKey(to.Uri)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bindings := slices.Clone(r.live(aor, now)) // Unchanged if the request is rejected
+
+	/*
+		RFC 3261 10.3
+			If the request has additional Contact fields or an expiration
+			time other than zero, the request is invalid, and the server MUST
+			return a 400 (Invalid Request) and skip the remaining steps.
+	*/
+	if len(contacts) > 0 && bytes.Equal(contacts[0].DisName, []byte("*")) {
+		if len(contacts) > 1 || expires != 0 {
+			return makeGenericResponse(400, []byte("Invalid Request"), req)
+		}
+		delete(r.bindings, aor)
+		return r.response(req, nil, false, now)
+	}
+
+	flows := false
+	for _, contact := range contacts {
+		if bytes.Equal(contact.DisName, []byte("*")) {
+			return makeGenericResponse(400, []byte("Invalid Request"), req)
+		}
+
+		b := &Binding{Contact: contact, updated: now}
+		exp := expires
+		if value, ok := lookupParam(contact.Paras, "expires"); ok {
+			seconds, err := strconv.Atoi(string(value))
+			if err != nil || seconds < 0 {
+				return makeGenericResponse(400, []byte("Bad Contact"), req)
+			}
+			exp = time.Duration(seconds) * time.Second
+		}
+		if r.MaxExpires > 0 && exp > r.MaxExpires {
+			exp = r.MaxExpires
+		}
+		b.Expires = now.Add(exp)
+
+		instance, hasInstance := lookupParam(contact.Paras, "+sip.instance")
+		b.Instance = strings.Trim(string(instance), `"`)
+		if value, ok := lookupParam(contact.Paras, "reg-id"); ok {
+			regID, err := strconv.Atoi(string(value))
+			if err != nil || regID <= 0 || !hasInstance {
+				return makeGenericResponse(400, []byte("Bad Contact"), req)
+			}
+			b.RegID = regID
+			if outbound {
+				b.Flow = r.Transport.FlowToken(transport)
+				flows = true
+			}
+		}
+
+		i := slices.IndexFunc(bindings, b.replaces)
+		switch {
+		case exp == 0 && i >= 0:
+			bindings = slices.Delete(bindings, i, i+1)
+		case exp == 0:
+		case i >= 0:
+			bindings[i] = b
+		default:
+			bindings = append(bindings, b)
+		}
+	}
+
+	if len(bindings) == 0 {
+		delete(r.bindings, aor)
+	} else {
+		r.bindings[aor] = bindings
+	}
+	return r.response(req, bindings, flows, now)
+}
+
+/*
+	RFC 3261 10.3
+		The registrar returns a 200 (OK) response.  The response MUST
+		contain Contact header field values enumerating all current
+		bindings.  Each Contact value MUST feature an "expires" parameter
+		indicating its expiration interval chosen by the registrar.
+*/
+// response builds the 200 of a REGISTER, with Require: outbound and the
+// Flow-Timer if a flow was registered (RFC 5626 6)
+func (r *Registrar) response(req *SIPMessage, bindings []*Binding, flows bool, now time.Time) *SIPMessage {
+	res := makeGenericResponse(200, []byte("OK"), req)
+	res.setToTag(GenerateTag())
+	for _, b := range bindings {
+		contact := b.Contact
+		if contact.DisName == nil {
+			contact.DisName = []byte{} // The parameters are not those of the URI
+		}
+		seconds := int(b.Expires.Sub(now).Round(time.Second) / time.Second)
+		contact.Paras = setParam(contact.Paras, "expires", []byte(strconv.Itoa(seconds)))
+		res.AddHeader(Contact, contact.Serialize())
+	}
+	if flows {
+		res.AddHeader(Require, []byte("outbound"))
+		if r.FlowTimer > 0 {
+			res.AddHeader(FlowTimer, []byte(strconv.Itoa(int(r.FlowTimer/time.Second))))
+		}
+	}
+	return res
+}
+
+// Lookup returns the bindings of an address-of-record that have not expired
+func (r *Registrar) Lookup(aor SIPUri) []Binding {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var bindings []Binding
+	for _, b := range r.live(aorKey(aor), time.Now()) {
+		bindings = append(bindings, *b)
+	}
+	return bindings
+}
+
+// Targets returns where to send a request to an address-of-record: one target
+// per binding, the transport of its contact URI, but for outbound instances
+// that are reached over the flow of their latest registration still open. It
+// fails with ErrFlowFailed if the address-of-record is only bound to failed
+// flows, for which RFC 5626 5.3 answers 430 (Flow Failed).
+func (r *Registrar) Targets(aor SIPUri) ([]Target, error) {
+	bindings := r.Lookup(aor)
+	slices.SortStableFunc(bindings, func(a, b Binding) int {
+		return b.updated.Compare(a.updated)
+	})
+
+	var targets []Target
+	reached := make(map[string]bool) // Instances reached over a flow
+	failed := false
+	for _, b := range bindings {
+		if b.Flow == "" {
+			target := Target{Binding: b}
+			if r.Transport != nil {
+				var err error
+				if target.Transport, err = r.Transport.Transport(URIDestination(b.Contact.Uri)); err != nil {
+					continue // Contact of a transport the layer does not support
+				}
+			}
+			targets = append(targets, target)
+			continue
+		}
+		if reached[b.Instance] {
+			continue
+		}
+		transport, err := r.Transport.Flow(b.Flow)
+		if err != nil {
+			failed = true
+			continue
+		}
+		reached[b.Instance] = true
+		targets = append(targets, Target{b, transport})
+	}
+
+	if len(targets) == 0 && failed {
+		return nil, ErrFlowFailed
+	}
+	return targets, nil
+}
+
+// live returns the bindings of an address-of-record, without the expired
+// ones, r.mu must be held
+func (r *Registrar) live(aor string, now time.Time) []*Binding {
+	bindings := slices.DeleteFunc(r.bindings[aor], func(b *Binding) bool {
+		return !b.Expires.After(now)
+	})
+	if len(bindings) == 0 {
+		delete(r.bindings, aor)
+	} else {
+		r.bindings[aor] = bindings
+	}
+	return bindings
+}
+
+// aorKey is the address-of-record of a To URI, without its parameters, case
+// insensitive but for the user part
+func aorKey(uri SIPUri) string {
+	key := strings.ToLower(string(uri.Scheme)) + ":" + string(uri.User) + "@" + strings.ToLower(string(uri.Domain))
+	if uri.Port != -1 {
+		key += ":" + strconv.Itoa(uri.Port)
+	}
+	return key
+}
+
+// hasOptionTag reports whether an option tag is among the values of a
+// Supported or Require header field
+func hasOptionTag(values [][]byte, tag string) bool {
+	for _, value := range values {
+		if strings.EqualFold(string(bytes.TrimSpace(value)), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// viaCount returns the number of Via header field values of a message
+func viaCount(msg *SIPMessage) int {
+	if msg.Options.ParseTopMostVia {
+		return 1 + len(msg.Headers[Via])
+	}
+	return len(msg.Headers[Via])
+}
@@ -0,0 +1,304 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ErrNoTarget is returned by Resolve when DNS has no address for a URI
+var ErrNoTarget = errors.New("no target found")
+
+// NAPTR is a NAPTR record (RFC 3403)
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// DNS is the backend of a Resolver. Names that do not exist are reported as
+// no records rather than as an error.
+type DNS interface {
+	LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error)
+	LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) // name is such as _sip._udp.example.com
+	LookupIP(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+// SystemDNS is the DNS backend of net.DefaultResolver. The Go resolver has no
+// NAPTR lookup: it reports no NAPTR record and Resolve queries SRV records of
+// every supported transport instead, as RFC 3263 4.1 does without NAPTR records.
+var SystemDNS DNS = systemDNS{net.DefaultResolver}
+
+type systemDNS struct {
+	r *net.Resolver
+}
+
+func (d systemDNS) LookupNAPTR(ctx context.Context, name string) ([]NAPTR, error) {
+	return nil, nil
+}
+
+func (d systemDNS) LookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, srvs, err := d.r.LookupSRV(ctx, "", "", name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return srvs, err
+}
+
+func (d systemDNS) LookupIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	ips, err := d.r.LookupNetIP(ctx, "ip", host)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return ips, err
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// NAPTR services and SRV prefixes of the transports (RFC 3263 4.1, RFC 7118 7)
+var (
+	naptr_services = map[string]string{
+		"SIP+D2U":  "udp",
+		"SIP+D2T":  "tcp",
+		"SIPS+D2T": "tls",
+		"SIP+D2W":  "ws",
+		"SIPS+D2W": "wss",
+	}
+	srv_prefixes = map[string]string{
+		"udp": "_sip._udp.",
+		"tcp": "_sip._tcp.",
+		"tls": "_sips._tcp.",
+		"ws":  "_sip._ws.",
+		"wss": "_sips._ws.",
+	}
+)
+
+// DefaultTransports are the transports a Resolver selects by default, in
+// order of preference when there is no NAPTR record
+var DefaultTransports = []string{"tls", "tcp", "udp"}
+
+// Resolver locates the servers of a URI as of RFC 3263
+type Resolver struct {
+	DNS        DNS      // SystemDNS if nil
+	Transports []string // Transports supported by the client, DefaultTransports if empty
+}
+
+// NewResolver creates a resolver querying a DNS backend
+func NewResolver(dns DNS) *Resolver {
+	return &Resolver{DNS: dns}
+}
+
+// srvName is an SRV query for a transport
+type srvName struct {
+	protocol string
+	name     string
+}
+
+// Resolve returns the destinations of a URI, in the order they must be tried.
+// The transport is the transport parameter of the URI, else the one of the
+// preferred NAPTR record, else the first with SRV records, else UDP, or TLS
+// for a SIPS URI. Addresses come from the SRV records of the transport,
+// ordered by priority and weight, else from the A and AAAA records of the host
+// with the port of the URI or the default port of the transport. A numeric
+// host, or maddr, is used as it is.
+func (r *Resolver) Resolve(ctx context.Context, uri SIPUri) ([]Destination, error) {
+	domain := strings.Trim(string(uri.Domain), "[]")
+	host := domain
+	if maddr, ok := uri.Param("maddr"); ok {
+		host = strings.Trim(string(maddr), "[]")
+	}
+	_, explicit := uri.Param("transport")
+	protocol := uri.Transport()
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		port := uri.Port
+		if port == -1 {
+			port = defaultPort(protocol)
+		}
+		return []Destination{target(protocol, ip, uint16(port), domain)}, nil
+	}
+	if uri.Port != -1 {
+		return r.lookupHost(ctx, protocol, host, uint16(uri.Port), domain)
+	}
+
+	var names []srvName
+	if explicit {
+		names = []srvName{{protocol, srv_prefixes[protocol] + host}}
+	} else if names = r.lookupNAPTR(ctx, host, uri.IsSecure()); len(names) == 0 {
+		for _, p := range r.transports() {
+			if !uri.IsSecure() || p == "tls" || p == "wss" {
+				names = append(names, srvName{p, srv_prefixes[p] + host})
+			}
+		}
+	}
+
+	var targets []Destination
+	for _, name := range names {
+		srvs, err := r.dns().LookupSRV(ctx, name.name)
+		if err != nil {
+			continue
+		}
+		for _, srv := range orderSRV(srvs) {
+			ips, err := r.dns().LookupIP(ctx, strings.TrimSuffix(srv.Target, "."))
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				targets = append(targets, target(name.protocol, ip, srv.Port, domain))
+			}
+		}
+		if len(targets) > 0 {
+			return targets, nil
+		}
+	}
+
+	// Without SRV records, the host is the server
+	return r.lookupHost(ctx, protocol, host, uint16(defaultPort(protocol)), domain)
+}
+
+func (r *Resolver) dns() DNS {
+	if r.DNS == nil {
+		return SystemDNS
+	}
+	return r.DNS
+}
+
+func (r *Resolver) transports() []string {
+	if len(r.Transports) == 0 {
+		return DefaultTransports
+	}
+	return r.Transports
+}
+
+// lookupNAPTR returns the SRV queries of the NAPTR records of a domain for the
+// supported transports, in the order of the records
+func (r *Resolver) lookupNAPTR(ctx context.Context, domain string, secure bool) []srvName {
+	records, err := r.dns().LookupNAPTR(ctx, domain)
+	if err != nil {
+		return nil
+	}
+	slices.SortStableFunc(records, func(a, b NAPTR) int {
+		if a.Order != b.Order {
+			return int(a.Order) - int(b.Order)
+		}
+		return int(a.Preference) - int(b.Preference)
+	})
+
+	var names []srvName
+	for _, rec := range records {
+		protocol, ok := naptr_services[strings.ToUpper(rec.Service)]
+		if !ok || !strings.EqualFold(rec.Flags, "s") || !slices.Contains(r.transports(), protocol) {
+			continue
+		}
+		if secure && protocol != "tls" && protocol != "wss" {
+			continue
+		}
+		names = append(names, srvName{protocol, strings.TrimSuffix(rec.Replacement, ".")})
+	}
+	return names
+}
+
+// lookupHost returns the A and AAAA records of a host as targets
+func (r *Resolver) lookupHost(ctx context.Context, protocol, host string, port uint16, domain string) ([]Destination, error) {
+	ips, err := r.dns().LookupIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("%w for %s: %w", ErrNoTarget, host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoTarget, host)
+	}
+
+	targets := make([]Destination, len(ips))
+	for i, ip := range ips {
+		targets[i] = target(protocol, ip, port, domain)
+	}
+	return targets, nil
+}
+
+func target(protocol string, ip netip.Addr, port uint16, domain string) Destination {
+	return Destination{
+		Protocol: protocol,
+		Addr:     netip.AddrPortFrom(ip.Unmap(), port).String(),
+		Domain:   domain,
+	}
+}
+
+// defaultPort returns the port of a URI without port (RFC 3261 19.1.2)
+func defaultPort(protocol string) int {
+	if protocol == "tls" || protocol == "wss" {
+		return DefaultTLSPort
+	}
+	return DefaultPort
+}
+
+/*
+	RFC 2782
+		A client MUST attempt to contact the target host with the lowest-
+		numbered priority it can reach; target hosts with the same priority
+		SHOULD be tried in an order defined by the weight field.
+*/
+// orderSRV orders SRV records by priority and, among the records of a
+// priority, by a weighted random selection. A single "." target means that
+// the service is not available.
+func orderSRV(srvs []*net.SRV) []*net.SRV {
+	if len(srvs) == 1 && srvs[0].Target == "." {
+		return nil
+	}
+	srvs = slices.Clone(srvs)
+	slices.SortStableFunc(srvs, func(a, b *net.SRV) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+
+	ordered := make([]*net.SRV, 0, len(srvs))
+	for start := 0; start < len(srvs); {
+		end := start
+		for end < len(srvs) && srvs[end].Priority == srvs[start].Priority {
+			end++
+		}
+		// Records of weight 0 come first for the running sum of pickWeighted
+		group := srvs[start:end]
+		slices.SortStableFunc(group, func(a, b *net.SRV) int {
+			return min(int(a.Weight), 1) - min(int(b.Weight), 1)
+		})
+		for len(group) > 0 {
+			i := pickWeighted(group)
+			ordered = append(ordered, group[i])
+			group = slices.Delete(group, i, i+1)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// pickWeighted selects a record with a probability proportional to its
+// weight, records of weight 0 having a small chance to be selected
+func pickWeighted(srvs []*net.SRV) int {
+	total := 0
+	for _, srv := range srvs {
+		total += int(srv.Weight)
+	}
+	if total == 0 {
+		return 0
+	}
+
+	n := rand.IntN(total + 1)
+	sum := 0
+	for i, srv := range srvs {
+		sum += int(srv.Weight)
+		if sum >= n {
+			return i
+		}
+	}
+	return len(srvs) - 1
+}
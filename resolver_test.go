@@ -0,0 +1,197 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testZone is an in-memory DNS backend
+type testZone struct {
+	naptr map[string][]NAPTR
+	srv   map[string][]*net.SRV
+	ip    map[string][]netip.Addr
+}
+
+func (z *testZone) LookupNAPTR(_ context.Context, name string) ([]NAPTR, error) {
+	return z.naptr[name], nil
+}
+
+func (z *testZone) LookupSRV(_ context.Context, name string) ([]*net.SRV, error) {
+	return z.srv[name], nil
+}
+
+func (z *testZone) LookupIP(_ context.Context, host string) ([]netip.Addr, error) {
+	return z.ip[host], nil
+}
+
+func newTestZone() *testZone {
+	return &testZone{
+		naptr: map[string][]NAPTR{
+			"example.com": {
+				{Order: 20, Preference: 10, Flags: "S", Service: "SIP+D2U", Replacement: "_sip._udp.example.com."},
+				{Order: 10, Preference: 20, Flags: "S", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com."},
+				{Order: 10, Preference: 10, Flags: "S", Service: "SIPS+D2T", Replacement: "_sips._tcp.example.com."},
+			},
+		},
+		srv: map[string][]*net.SRV{
+			"_sips._tcp.example.com": {
+				{Target: "backup.example.com.", Port: 5071, Priority: 20},
+				{Target: "proxy.example.com.", Port: 5061, Priority: 10},
+			},
+			"_sip._tcp.example.com": {{Target: "proxy.example.com.", Port: 5060, Priority: 10}},
+			"_sip._udp.example.org": {{Target: "sip.example.org.", Port: 5080, Priority: 10}},
+			"_sip._udp.example.net": {{Target: ".", Port: 0}},
+		},
+		ip: map[string][]netip.Addr{
+			"proxy.example.com":  {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+			"backup.example.com": {netip.MustParseAddr("192.0.2.2")},
+			"sip.example.org":    {netip.MustParseAddr("192.0.2.3")},
+			"example.net":        {netip.MustParseAddr("192.0.2.4")},
+		},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		uri        string
+		transports []string
+		want       []string
+	}{
+		// NAPTR order and preference, SRV priority
+		{"sip:alice@example.com", nil, []string{"tls 192.0.2.1:5061", "tls [2001:db8::1]:5061", "tls 192.0.2.2:5071"}},
+		// Only the NAPTR records of supported transports
+		{"sip:alice@example.com", []string{"udp", "tcp"}, []string{"tcp 192.0.2.1:5060", "tcp [2001:db8::1]:5060"}},
+		// SRV records without NAPTR
+		{"sip:alice@example.org", nil, []string{"udp 192.0.2.3:5080"}},
+		// A record with the default port of the transport
+		{"sip:alice@example.net", nil, []string{"udp 192.0.2.4:5060"}},
+		{"sips:alice@example.net", nil, []string{"tls 192.0.2.4:5061"}},
+		{"sip:alice@example.net;transport=tcp", nil, []string{"tcp 192.0.2.4:5060"}},
+		// Explicit port or numeric host, no SRV
+		{"sip:alice@example.org:5062", nil, nil},
+		{"sip:alice@proxy.example.com:5062", nil, []string{"udp 192.0.2.1:5062", "udp [2001:db8::1]:5062"}},
+		{"sip:alice@192.0.2.9", nil, []string{"udp 192.0.2.9:5060"}},
+		{"sip:alice@example.com;maddr=192.0.2.10", nil, []string{"udp 192.0.2.10:5060"}},
+	}
+
+	for _, tt := range tests {
+		r := NewResolver(newTestZone())
+		r.Transports = tt.transports
+		uri, err := ParseSipUri([]byte(tt.uri))
+		if err != nil {
+			t.Fatalf("ParseSipUri(%q) error = %v", tt.uri, err)
+		}
+
+		targets, err := r.Resolve(context.Background(), uri)
+		if tt.want == nil {
+			if !errors.Is(err, ErrNoTarget) {
+				t.Errorf("Resolve(%q) error = %v, want ErrNoTarget", tt.uri, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Resolve(%q) error = %v", tt.uri, err)
+		}
+		var got []string
+		for _, target := range targets {
+			got = append(got, target.Protocol+" "+target.Addr)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Resolve(%q) = %v, want %v", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestOrderSRVWeights(t *testing.T) {
+	srvs := []*net.SRV{
+		{Target: "heavy", Priority: 10, Weight: 90},
+		{Target: "light", Priority: 10, Weight: 10},
+		{Target: "last", Priority: 20, Weight: 100},
+	}
+	heavy := 0
+	for i := 0; i < 1000; i++ {
+		ordered := orderSRV(srvs)
+		if len(ordered) != 3 || ordered[2].Target != "last" {
+			t.Fatalf("orderSRV() = %v, want the priority 20 record last", ordered)
+		}
+		if ordered[0].Target == "heavy" {
+			heavy++
+		}
+	}
+	if heavy < 800 || heavy > 980 {
+		t.Errorf("record of weight 90 first %d times out of 1000", heavy)
+	}
+}
+
+func TestFailoverOn503AndTransportError(t *testing.T) {
+	// The first target refuses TCP connections, the second answers 503, the
+	// third answers 200
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+
+	answer := func(code int) func(*TransportLayer, *SIPMessage, Transport) {
+		return func(tl *TransportLayer, msg *SIPMessage, transport Transport) {
+			trans, err := tl.stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+			if err == nil {
+				trans.Event(makeGenericResponse(code, []byte("Reason"), msg))
+			}
+		}
+	}
+	unavailable, _ := newTestLayer(t, "udp", "127.0.0.1:0", answer(503))
+	ok, _ := newTestLayer(t, "udp", "127.0.0.1:0", answer(200))
+	client, stack := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+
+	targets := client.Transports([]Destination{
+		{Protocol: "tcp", Addr: refused},
+		{Protocol: "udp", Addr: unavailable.UDPAddrs()[0].String()},
+		{Protocol: "udp", Addr: ok.UDPAddrs()[0].String()},
+	})
+	responses := make(chan *SIPMessage, 3)
+	terminated := make(chan error, 3)
+	options := parseTestMessage(t, testOptions)
+	f, err := stack.StartClientTransFailover(options, targets,
+		func(_ Transport, msg *SIPMessage) { responses <- msg },
+		nil,
+		func(_ TransID, err error) { terminated <- err },
+	)
+	if err != nil {
+		t.Fatalf("StartClientTransFailover() error = %v", err)
+	}
+
+	res := receive(t, responses)
+	if res.Response == nil || res.Response.StatusCode != 200 {
+		t.Fatalf("received %v, want the 200 of the last target", res.Startline)
+	}
+	if branch := string(res.TopmostVia.Branch); branch == "z9hG4bKopt1" || !strings.HasPrefix(branch, MagicCookie) {
+		t.Errorf("branch of the last request = %q, want a new one", branch)
+	}
+	if snap := f.Current().Snapshot(); snap.RemoteAddr != targets[2].RemoteAddr() {
+		t.Errorf("current target = %s, want %s", snap.RemoteAddr, targets[2].RemoteAddr())
+	}
+
+	// The TU only hears of the termination of the last transaction
+	shutdownNow(stack)
+	select {
+	case err := <-terminated:
+		if err != nil && !errors.Is(err, ErrShutdown) {
+			t.Errorf("terminated with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no termination")
+	}
+	select {
+	case err := <-terminated:
+		t.Errorf("terminated twice, with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
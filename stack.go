@@ -0,0 +1,392 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrStackClosed is returned when a new server transaction is requested after Shutdown
+var ErrStackClosed = errors.New("stack is shutting down")
+
+// Stack is the transaction layer. It owns the table of running transactions,
+// matches incoming messages against it and runs every transaction in its own
+// goroutine, or on an EventLoop, until it terminates or the stack is shut down.
+type Stack struct {
+	mu       sync.Mutex
+	trans    map[TransID]SIPTransaction
+	closing  bool
+	observer Observer   // Attached to every transaction started by the stack
+	sched    Scheduler  // Drives the timers of every transaction started by the stack
+	loop     *EventLoop // Runs the transactions if set, instead of a goroutine each
+
+	ctx    context.Context    // Parent context of every transaction
+	cancel context.CancelFunc // Aborts all transactions with ErrShutdown
+	wg     sync.WaitGroup     // Running transactions
+}
+
+// NewStack creates an empty transaction layer
+func NewStack() *Stack {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Stack{
+		trans:    make(map[TransID]SIPTransaction),
+		observer: NopObserver{},
+		sched:    RuntimeScheduler,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// SetObserver attaches an observer to the transactions started from now on
+func (s *Stack) SetObserver(observer Observer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer = observer
+}
+
+// SetScheduler changes the scheduler driving the timers of the transactions
+// started from now on, such as a TimingWheel
+func (s *Stack) SetScheduler(sched Scheduler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sched = sched
+}
+
+// SetEventLoop runs the transactions started from now on with an event loop,
+// whose workers must not be blocked by the callbacks
+func (s *Stack) SetEventLoop(loop *EventLoop) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loop = loop
+}
+
+// StartServerTrans creates a server transaction for an incoming request and starts it.
+// It fails with ErrStackClosed once Shutdown has been called. A CANCEL is also
+// passed to the INVITE server transaction it refers to, which answers the INVITE
+// with 487, and the CANCEL itself is answered with 200, or 481 if there is no
+// such transaction. Responses are sent with the transport given by
+// ResponseTransport for the top Via of the request and the transport it was
+// received on, by the transport callback or by Transport.Send if it is nil.
+func (s *Stack) StartServerTrans(
+	msg *SIPMessage,
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
+) (SIPTransaction, error) {
+	if msg.Request == nil {
+		return nil, fmt.Errorf("cannot start server transaction with a response")
+	}
+
+	tid, err := MakeServerTransactionID(msg)
+	if err != nil {
+		return nil, fmt.Errorf("making server transaction ID: %w", err)
+	}
+
+	if via, err := msg.topVia(); err == nil {
+		transport = ResponseTransport(via, transport)
+	}
+
+	var trans SIPTransaction
+	if msg.Request.Method == Invite {
+		trans = MakeIST(tid, msg, transport, core_callback, transport_callback, term_callback)
+	} else {
+		trans = MakeNIST(tid, msg, transport, core_callback, transport_callback, term_callback)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil, ErrStackClosed
+	}
+	if err := s.run(tid, trans); err != nil {
+		return nil, err
+	}
+	if msg.Request.Method == Cancel {
+		s.match_cancel(trans, msg)
+	}
+	return trans, nil
+}
+
+/*
+	RFC 3261 9.2
+		The To tag of the response to the CANCEL and the To tag
+		in the response to the original request SHOULD be the same.
+*/
+// match_cancel passes a CANCEL to the INVITE server transaction it refers to and
+// answers it from its own transaction, s.mu must be held
+func (s *Stack) match_cancel(trans SIPTransaction, cancel *SIPMessage) {
+	var res *SIPMessage
+	var tag []byte
+	tid, err := MakeCancelTargetID(cancel)
+	if ist, ok := s.trans[tid].(*Sitrans); err == nil && ok && ist.Event(cancel) {
+		res = makeGenericResponse(200, []byte("OK"), cancel)
+		tag = ist.to_tag()
+	} else {
+		res = makeGenericResponse(481, []byte("Call/Transaction Does Not Exist"), cancel)
+	}
+	if tag == nil {
+		tag = GenerateTag()
+	}
+	res.setToTag(tag)
+	trans.Event(res)
+}
+
+// StartClientTrans creates a client transaction for an outgoing request and starts it.
+// Client transactions are still accepted while the stack drains so that pending
+// server transactions can be completed, but not once it has been aborted. The
+// request is sent over the transport by the transport callback, or by
+// Transport.Send if it is nil. A request too large for a UDPTransport is sent
+// over TCP, with TCP in its top Via, if a connection to the destination can be
+// opened, which StartClientTrans waits for.
+func (s *Stack) StartClientTrans(
+	msg *SIPMessage,
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
+) (SIPTransaction, error) {
+	if msg.Request == nil {
+		return nil, fmt.Errorf("cannot start client transaction with a response")
+	}
+
+	tid, err := MakeClientTransactionID(msg)
+	if err != nil {
+		return nil, fmt.Errorf("making client transaction ID: %w", err)
+	}
+
+	transport, msg = requestTransport(msg, transport)
+	var trans SIPTransaction
+	if msg.Request.Method == Invite {
+		trans = MakeICT(tid, msg, transport, core_callback, transport_callback, term_callback)
+	} else {
+		trans = MakeNICT(tid, msg, transport, core_callback, transport_callback, term_callback)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return nil, ErrStackClosed
+	}
+	if err := s.run(tid, trans); err != nil {
+		return nil, err
+	}
+	return trans, nil
+}
+
+// RestoreTrans resumes a transaction saved by Checkpoint, possibly on another
+// instance, see RestoreTrans. It fails with ErrStackClosed once Shutdown has
+// been called.
+func (s *Stack) RestoreTrans(
+	rec *TransRecord,
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
+) (SIPTransaction, error) {
+	trans, err := RestoreTrans(rec, transport, core_callback, transport_callback, term_callback)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil, ErrStackClosed
+	}
+	if err := s.run(rec.ID, trans); err != nil {
+		return nil, err
+	}
+	return trans, nil
+}
+
+// Checkpoint saves the record of every running transaction to the store and
+// deletes the other records, such as those of the transactions terminated
+// since the previous checkpoint, so that they are not restored. It must not
+// be called from a callback of a transaction.
+func (s *Stack) Checkpoint(store TransStore) error {
+	s.mu.Lock()
+	running := make([]SIPTransaction, 0, len(s.trans))
+	for _, trans := range s.trans {
+		running = append(running, trans)
+	}
+	s.mu.Unlock()
+
+	saved := make(map[TransID]bool, len(running))
+	for _, trans := range running {
+		rec := Record(trans)
+		if rec == nil { // Terminated in the meantime
+			continue
+		}
+		if err := store.Save(rec); err != nil {
+			return fmt.Errorf("saving %s: %w", rec.ID, err)
+		}
+		saved[rec.ID] = true
+	}
+
+	recs, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("loading records: %w", err)
+	}
+	for _, rec := range recs {
+		if saved[rec.ID] {
+			continue
+		}
+		if err := store.Delete(rec.ID); err != nil {
+			return fmt.Errorf("deleting %s: %w", rec.ID, err)
+		}
+	}
+	return nil
+}
+
+// run registers the transaction and starts it, s.mu must be held
+func (s *Stack) run(tid TransID, trans SIPTransaction) error {
+	if _, ok := s.trans[tid]; ok {
+		return fmt.Errorf("transaction %s already exists", tid)
+	}
+	m, ok := trans.(machine)
+	if !ok {
+		return ErrNotStateMachine
+	}
+	s.trans[tid] = trans
+
+	b := m.base()
+	b.spawn = s.spawn
+	b.observer = s.observer
+	b.sched = s.sched
+
+	s.wg.Add(1)
+	exit := func() {
+		s.remove(tid, trans)
+		s.wg.Done()
+	}
+	if s.loop != nil {
+		return s.loop.start(s.ctx, trans, exit)
+	}
+	go func() {
+		trans.Start(s.ctx)
+		exit()
+	}()
+	return nil
+}
+
+// spawn runs a transaction created by another one, such as the CANCEL of an
+// INVITE. Like StartClientTrans, it fails once the stack has been aborted.
+func (s *Stack) spawn(tid TransID, trans SIPTransaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return ErrStackClosed
+	}
+	return s.run(tid, trans)
+}
+
+// remove deletes a terminated transaction from the table unless its ID has been reused
+func (s *Stack) remove(tid TransID, trans SIPTransaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.trans[tid] == trans {
+		delete(s.trans, tid)
+	}
+}
+
+/*
+	RFC 3261 18.4
+		If the transport user asks for a request to be sent over a reliable
+		transport, and the result is a connection failure, the transport
+		layer SHOULD inform the transport user of a failure in sending.
+*/
+// conn_failed fails the client transactions whose transport matches a failed
+// connection and that still wait for a final response over it
+func (s *Stack) conn_failed(match func(Transport) bool, err error) {
+	s.mu.Lock()
+	var failed []machine
+	for _, trans := range s.trans {
+		m, ok := trans.(machine)
+		if !ok {
+			continue
+		}
+		b := m.base()
+		if (b.kind == INVITE_CLIENT || b.kind == NON_INVITE_CLIENT) && b.transport != nil && match(b.transport) {
+			failed = append(failed, m)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, m := range failed {
+		go m.base().conn_failed(m, err)
+	}
+}
+
+// FindTrans returns the transaction matching the message, or nil if there is none
+func (s *Stack) FindTrans(msg *SIPMessage) SIPTransaction {
+	var tid TransID
+	var err error
+	if msg.Request != nil {
+		tid, err = MakeServerTransactionID(msg)
+	} else {
+		tid, err = MakeClientTransactionID(msg)
+	}
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trans[tid]
+}
+
+// Len returns the number of running transactions
+func (s *Stack) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.trans)
+}
+
+// Snapshot returns the state of every running transaction, oldest first
+func (s *Stack) Snapshot() []TransSnapshot {
+	s.mu.Lock()
+	snaps := make([]TransSnapshot, 0, len(s.trans))
+	for _, trans := range s.trans {
+		snaps = append(snaps, trans.Snapshot())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Started.Before(snaps[j].Started) })
+	return snaps
+}
+
+// Shutdown stops accepting new server transactions, answers every pending INVITE
+// server transaction with 503 and waits for the running transactions to drain.
+// If ctx is done first, the remaining transactions are terminated with ErrShutdown
+// and ctx.Err() is returned once they have exited.
+func (s *Stack) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for _, trans := range s.trans {
+		if ist, ok := trans.(*Sitrans); ok {
+			res := makeGenericResponse(503, []byte("Service Unavailable"), ist.message)
+			res.setToTag(GenerateTag())
+			ist.Event(res)
+		}
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-drained
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,370 @@
+package sip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// STUN message types and attributes (RFC 5389)
+const (
+	stun_header_len      = 20
+	stun_magic_cookie    = 0x2112A442
+	stun_binding_request = 0x0001
+	stun_binding_success = 0x0101
+	stun_binding_error   = 0x0111
+
+	stun_attr_mapped_address     = 0x0001
+	stun_attr_error_code         = 0x0009
+	stun_attr_unknown_attributes = 0x000A
+	stun_attr_xor_mapped_address = 0x0020
+	stun_attr_fingerprint        = 0x8028
+
+	stun_fingerprint_xor = 0x5354554e
+)
+
+// Retransmissions of a STUN request over UDP (RFC 5389 7.2.1)
+const (
+	stun_rto = 500 * time.Millisecond // Initial retransmission timeout
+	stun_rc  = 7                      // Requests sent
+	stun_rm  = 16                     // Timeouts waited after the last request
+)
+
+// ErrSTUN is returned for malformed STUN messages
+var ErrSTUN = errors.New("malformed STUN message")
+
+// STUNError is an error response to a STUN request
+type STUNError struct {
+	Code   int
+	Reason string
+}
+
+func (e *STUNError) Error() string {
+	return fmt.Sprintf("STUN error response %d %s", e.Code, e.Reason)
+}
+
+// stunMessage is a STUN message, its attributes in order
+type stunMessage struct {
+	typ   uint16
+	txid  [12]byte
+	attrs []stunAttr
+}
+
+type stunAttr struct {
+	typ   uint16
+	value []byte
+}
+
+/*
+	RFC 5389 6
+		The most significant 2 bits of every STUN message MUST be zeroes.
+		This can be used to differentiate STUN packets from other protocols
+		when STUN is multiplexed with other protocols on the same port.
+	[...]
+		The magic cookie field MUST contain the fixed value 0x2112A442 in
+		network byte order.
+*/
+// isSTUN reports whether a datagram is a STUN message rather than a SIP one,
+// which starts with a method or SIP/2.0
+func isSTUN(data []byte) bool {
+	return len(data) >= stun_header_len && data[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(data[4:8]) == stun_magic_cookie
+}
+
+func newSTUNMessage(typ uint16) *stunMessage {
+	m := &stunMessage{typ: typ}
+	rand.Read(m.txid[:])
+	return m
+}
+
+// parseSTUN parses a STUN message, checking its FINGERPRINT if any
+func parseSTUN(data []byte) (*stunMessage, error) {
+	if !isSTUN(data) {
+		return nil, ErrSTUN
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || stun_header_len+length != len(data) {
+		return nil, ErrSTUN
+	}
+
+	m := &stunMessage{typ: binary.BigEndian.Uint16(data[0:2])}
+	copy(m.txid[:], data[8:20])
+	for rest := data[stun_header_len:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, ErrSTUN
+		}
+		typ := binary.BigEndian.Uint16(rest[0:2])
+		n := int(binary.BigEndian.Uint16(rest[2:4]))
+		padded := 4 + (n+3)&^3
+		if len(rest) < padded {
+			return nil, ErrSTUN
+		}
+
+		// FINGERPRINT is the last attribute, a CRC of what precedes it
+		if typ == stun_attr_fingerprint {
+			offset := len(data) - len(rest)
+			if n != 4 || padded != len(rest) ||
+				binary.BigEndian.Uint32(rest[4:8]) != crc32.ChecksumIEEE(data[:offset])^stun_fingerprint_xor {
+				return nil, ErrSTUN
+			}
+			break
+		}
+		m.attrs = append(m.attrs, stunAttr{typ, rest[4 : 4+n]})
+		rest = rest[padded:]
+	}
+	return m, nil
+}
+
+/*
+	RFC 5389 15.5
+		The FINGERPRINT attribute MAY be present in all STUN messages.  The
+		value of the attribute is computed as the CRC-32 of the STUN message
+		up to (but excluding) the FINGERPRINT attribute itself, XOR'ed with
+		the 32-bit value 0x5354554e.
+*/
+// serialize encodes a message, with a FINGERPRINT to tell it from SIP
+func (m *stunMessage) serialize() []byte {
+	buf := make([]byte, stun_header_len, 64)
+	binary.BigEndian.PutUint16(buf[0:2], m.typ)
+	binary.BigEndian.PutUint32(buf[4:8], stun_magic_cookie)
+	copy(buf[8:20], m.txid[:])
+	for _, attr := range m.attrs {
+		buf = binary.BigEndian.AppendUint16(buf, attr.typ)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(attr.value)))
+		buf = append(buf, attr.value...)
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+
+	// The length covers the FINGERPRINT when it is computed
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)+8-stun_header_len))
+	crc := crc32.ChecksumIEEE(buf) ^ stun_fingerprint_xor
+	buf = binary.BigEndian.AppendUint16(buf, stun_attr_fingerprint)
+	buf = binary.BigEndian.AppendUint16(buf, 4)
+	return binary.BigEndian.AppendUint32(buf, crc)
+}
+
+// attr returns the value of the first attribute of a type
+func (m *stunMessage) attr(typ uint16) ([]byte, bool) {
+	for _, attr := range m.attrs {
+		if attr.typ == typ {
+			return attr.value, true
+		}
+	}
+	return nil, false
+}
+
+/*
+	RFC 5389 15.2
+		X-Port is computed by taking the mapped port in host byte order,
+		XOR'ing it with the most significant 16 bits of the magic cookie, and
+		then the converting the result to network byte order.  If the IP
+		address family is IPv4, X-Address is computed by taking the mapped IP
+		address in host byte order, XOR'ing it with the magic cookie, and
+		converting the result into network byte order.  If the IP address
+		family is IPv6, X-Address is computed by taking the mapped IP address
+		in host byte order, XOR'ing it with the concatenation of the magic
+		cookie and the 96-bit transaction ID, and converting the result to
+		network byte order.
+*/
+// xorAddress encodes an XOR-MAPPED-ADDRESS
+func xorAddress(ap netip.AddrPort, txid [12]byte) []byte {
+	key := stunXORKey(txid)
+	ip := ap.Addr().Unmap()
+	value := []byte{0, 0x01}
+	if ip.Is6() {
+		value[1] = 0x02
+	}
+	value = binary.BigEndian.AppendUint16(value, ap.Port()^stun_magic_cookie>>16)
+	for i, b := range ip.AsSlice() {
+		value = append(value, b^key[i])
+	}
+	return value
+}
+
+// parseXORAddress decodes an XOR-MAPPED-ADDRESS
+func parseXORAddress(value []byte, txid [12]byte) (netip.AddrPort, error) {
+	key := stunXORKey(txid)
+	xored := make([]byte, len(value))
+	copy(xored, value)
+	for i := 4; i < len(xored) && i-4 < len(key); i++ {
+		xored[i] ^= key[i-4]
+	}
+	ap, err := parseMappedAddress(xored)
+	if err != nil {
+		return ap, err
+	}
+	return netip.AddrPortFrom(ap.Addr(), ap.Port()^stun_magic_cookie>>16), nil
+}
+
+// parseMappedAddress decodes a MAPPED-ADDRESS, which servers of RFC 3489
+// return instead of an XOR-MAPPED-ADDRESS
+func parseMappedAddress(value []byte) (netip.AddrPort, error) {
+	if len(value) != 8 && len(value) != 20 {
+		return netip.AddrPort{}, ErrSTUN
+	}
+	addr, ok := netip.AddrFromSlice(value[4:])
+	if !ok || (value[1] == 0x01) != addr.Is4() {
+		return netip.AddrPort{}, ErrSTUN
+	}
+	return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(value[2:4])), nil
+}
+
+// stunXORKey is the magic cookie followed by the transaction ID
+func stunXORKey(txid [12]byte) []byte {
+	key := binary.BigEndian.AppendUint32(nil, stun_magic_cookie)
+	return append(key, txid[:]...)
+}
+
+// receiveSTUN answers the Binding requests received on a UDP socket, so that
+// the SIP port is also a STUN server, and passes the responses to the Binding
+// requests sent from it
+func (tl *TransportLayer) receiveSTUN(conn *net.UDPConn, raddr netip.AddrPort, data []byte) {
+	m, err := parseSTUN(data)
+	if err != nil {
+		return
+	}
+
+	switch m.typ {
+	case stun_binding_request:
+		conn.WriteToUDPAddrPort(bindingResponse(m, unmap(raddr)).serialize(), raddr)
+	case stun_binding_success, stun_binding_error:
+		tl.mu.Lock()
+		c := tl.stun[m.txid]
+		tl.mu.Unlock()
+		if c != nil {
+			select {
+			case c <- m:
+			default:
+			}
+		}
+	}
+}
+
+/*
+	RFC 5389 7.3.1
+		If the request contains one or more unknown comprehension-required
+		attributes, the server replies with an error response with an error
+		code of 420 (Unknown Attribute), and includes an UNKNOWN-ATTRIBUTES
+		attribute in the response that lists the unknown comprehension-
+		required attributes.
+*/
+// bindingResponse answers a Binding request with the source address of the
+// request, the reflexive address of the client
+func bindingResponse(req *stunMessage, source netip.AddrPort) *stunMessage {
+	var unknown []byte
+	for _, attr := range req.attrs {
+		if attr.typ < 0x8000 { // Comprehension-required, none is known in a Binding request
+			unknown = binary.BigEndian.AppendUint16(unknown, attr.typ)
+		}
+	}
+	if unknown != nil {
+		res := &stunMessage{typ: stun_binding_error, txid: req.txid}
+		res.attrs = append(res.attrs,
+			stunAttr{stun_attr_error_code, append([]byte{0, 0, 4, 20}, "Unknown Attribute"...)},
+			stunAttr{stun_attr_unknown_attributes, unknown},
+		)
+		return res
+	}
+
+	res := &stunMessage{typ: stun_binding_success, txid: req.txid}
+	res.attrs = append(res.attrs, stunAttr{stun_attr_xor_mapped_address, xorAddress(source, req.txid)})
+	return res
+}
+
+// Reflexive learns the address the UDP socket of the transport layer that
+// reaches a STUN server, such as "stun.example.com:3478", is seen from beyond
+// NATs: its server reflexive address, for the sent-by of the Via and the
+// Contact of the requests sent from the socket (see SIPVia.SetSentBy and
+// SIPUri.SetHostPort).
+func (tl *TransportLayer) Reflexive(ctx context.Context, server string) (netip.AddrPort, error) {
+	return tl.stunBinding(ctx, &UDPTransport{layer: tl, raddr: server})
+}
+
+/*
+	RFC 5389 7.2.1
+		Retransmissions continue until a response is received, or until a
+		total of Rc requests have been sent.  Rc SHOULD be configurable and
+		SHOULD have a default of 7.  If, after the last request, a duration
+		equal to Rm times the RTO has passed without a response (providing
+		ample time to get a response if only this final request actually
+		succeeds), the client SHOULD consider the transaction to have failed.
+		Rm SHOULD be configurable and SHOULD have a default of 16.
+*/
+// stunBinding sends a STUN Binding request over the UDP socket of a
+// transport, or over the socket reaching its remote address, and returns the
+// mapped address of the response
+func (tl *TransportLayer) stunBinding(ctx context.Context, transport *UDPTransport) (netip.AddrPort, error) {
+	raddr, err := tl.addrs.resolve(transport.raddr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	conn := transport.socket(raddr)
+	if conn == nil {
+		return netip.AddrPort{}, ErrTransportClosed
+	}
+
+	req := newSTUNMessage(stun_binding_request)
+	responses := make(chan *stunMessage, 1)
+	tl.mu.Lock()
+	tl.stun[req.txid] = responses
+	tl.mu.Unlock()
+	defer func() {
+		tl.mu.Lock()
+		delete(tl.stun, req.txid)
+		tl.mu.Unlock()
+	}()
+
+	data := req.serialize()
+	rto := stun_rto
+	for sent := 1; ; sent++ {
+		if _, err := conn.WriteToUDPAddrPort(data, raddr); err != nil {
+			return netip.AddrPort{}, err
+		}
+		wait := rto
+		if sent == stun_rc {
+			wait = stun_rm * stun_rto
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case res := <-responses:
+			timer.Stop()
+			return mappedAddress(res)
+		case <-ctx.Done():
+			timer.Stop()
+			return netip.AddrPort{}, fmt.Errorf("STUN Binding request to %s: %w", raddr, ctx.Err())
+		case <-timer.C:
+		}
+		if sent == stun_rc {
+			return netip.AddrPort{}, fmt.Errorf("STUN Binding request to %s: %w", raddr, ErrTimeout)
+		}
+		rto *= 2
+	}
+}
+
+// mappedAddress returns the reflexive address of a Binding response
+func mappedAddress(res *stunMessage) (netip.AddrPort, error) {
+	if res.typ == stun_binding_error {
+		value, _ := res.attr(stun_attr_error_code)
+		if len(value) < 4 {
+			return netip.AddrPort{}, ErrSTUN
+		}
+		return netip.AddrPort{}, &STUNError{Code: int(value[2]&0x07)*100 + int(value[3]), Reason: string(value[4:])}
+	}
+
+	if value, ok := res.attr(stun_attr_xor_mapped_address); ok {
+		return parseXORAddress(value, res.txid)
+	}
+	if value, ok := res.attr(stun_attr_mapped_address); ok {
+		return parseMappedAddress(value)
+	}
+	return netip.AddrPort{}, ErrSTUN
+}
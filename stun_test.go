@@ -0,0 +1,119 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSTUNServerOnSIPPort(t *testing.T) {
+	received := make(chan *SIPMessage, 1)
+	server, _ := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(received))
+	client, _ := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addr, err := client.Reflexive(ctx, server.UDPAddrs()[0].String())
+	if err != nil {
+		t.Fatalf("Reflexive() error = %v", err)
+	}
+	if want := client.UDPAddrs()[0].(*net.UDPAddr).AddrPort(); addr != want {
+		t.Errorf("Reflexive() = %s, want %s", addr, want)
+	}
+
+	// SIP still goes to the handler
+	options := parseTestMessage(t, testOptions)
+	options.TopmostVia.SetSentBy(addr)
+	if err := testTransport(t, client, Destination{Protocol: "udp", Addr: server.UDPAddrs()[0].String()}).Send(options); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if got := receive(t, received); got.TopmostVia.Port != int(addr.Port()) {
+		t.Errorf("sent-by port = %d, want %d", got.TopmostVia.Port, addr.Port())
+	}
+}
+
+func TestReflexiveWithoutServer(t *testing.T) {
+	client, _ := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+	if _, err := client.Reflexive(ctx, silent.LocalAddr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Reflexive() error = %v, want the deadline of the context", err)
+	}
+
+	// The request was retransmitted after the initial RTO
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	var txids []string
+	for i := 0; i < 2; i++ {
+		n, _, err := silent.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%d requests received, want 2: %v", i, err)
+		}
+		txids = append(txids, string(buf[8:20]))
+		if _, err := parseSTUN(buf[:n]); err != nil {
+			t.Errorf("parseSTUN() of the request error = %v", err)
+		}
+	}
+	if txids[0] != txids[1] {
+		t.Errorf("retransmission with another transaction ID")
+	}
+}
+
+func TestSTUNMessages(t *testing.T) {
+	for _, source := range []string{"192.0.2.1:40000", "[2001:db8::1]:40000"} {
+		req := newSTUNMessage(stun_binding_request)
+		parsed, err := parseSTUN(req.serialize())
+		if err != nil {
+			t.Fatalf("parseSTUN() error = %v", err)
+		}
+
+		res, err := parseSTUN(bindingResponse(parsed, netip.MustParseAddrPort(source)).serialize())
+		if err != nil {
+			t.Fatalf("parseSTUN() of the response error = %v", err)
+		}
+		if addr, err := mappedAddress(res); err != nil || addr.String() != source {
+			t.Errorf("mappedAddress() = %s, %v, want %s", addr, err, source)
+		}
+	}
+
+	// Corrupted messages fail the FINGERPRINT
+	data := newSTUNMessage(stun_binding_request).serialize()
+	data[10] ^= 1
+	if _, err := parseSTUN(data); err != ErrSTUN {
+		t.Errorf("parseSTUN() of a corrupted message error = %v, want ErrSTUN", err)
+	}
+
+	// Unknown comprehension-required attributes are rejected
+	req := newSTUNMessage(stun_binding_request)
+	req.attrs = append(req.attrs, stunAttr{0x0006, []byte("user")}, stunAttr{0x8022, []byte("softphone")})
+	var stunErr *STUNError
+	if _, err := mappedAddress(bindingResponse(req, netip.MustParseAddrPort("192.0.2.1:40000"))); !errors.As(err, &stunErr) || stunErr.Code != 420 {
+		t.Errorf("mappedAddress() error = %v, want a 420 error response", err)
+	}
+}
+
+func TestSetSentByAndHostPort(t *testing.T) {
+	addr := netip.MustParseAddrPort("[2001:db8::1]:40000")
+
+	var via SIPVia
+	via.Tranport = "udp"
+	via.SetSentBy(addr)
+	if got := string(via.Serialize()); got != "SIP/2.0/UDP [2001:db8::1]:40000" {
+		t.Errorf("Via = %q, want the address between brackets", got)
+	}
+
+	uri, _ := ParseSipUri([]byte("sip:alice@192.168.1.2;transport=udp"))
+	uri.SetHostPort(netip.MustParseAddrPort("198.51.100.1:40000"))
+	if got := string(uri.Serialize()); got != "sip:alice@198.51.100.1:40000;transport=udp" {
+		t.Errorf("URI = %q, want the reflexive address", got)
+	}
+}
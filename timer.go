@@ -19,38 +19,81 @@ const tif_dur = 64 * t1 // Timer F duration (64*T1)
 const tie_dur = t1
 const tik_dur = t4
 const tij_dur = 64 * t1
+const til_dur = 64 * t1   // Timer L duration (64*T1), RFC 6026
+const tim_dur = 64 * t1   // Timer M duration (64*T1), RFC 6026
+const tiack_dur = 64 * t1 // Time a UAS retransmits a 2xx without ACK (64*T1), RFC 3261 13.3.1.4
 
+// Scheduler runs a function once a delay has elapsed, it drives the timers of
+// transactions. Functions must be run from another goroutine than the caller
+// of AfterFunc. Now is the time the delays are counted from, timer deadlines
+// are recorded and restored against it.
+type Scheduler interface {
+	AfterFunc(d time.Duration, f func()) TimerHandle
+	Now() time.Time
+}
+
+// TimerHandle cancels a function scheduled by a Scheduler
+type TimerHandle interface {
+	// Stop prevents the function from running, it returns false if the
+	// function has already run or been stopped
+	Stop() bool
+}
+
+type runtimeScheduler struct{}
+
+func (runtimeScheduler) AfterFunc(d time.Duration, f func()) TimerHandle {
+	return time.AfterFunc(d, f)
+}
+
+func (runtimeScheduler) Now() time.Time {
+	return time.Now()
+}
+
+// RuntimeScheduler is the default Scheduler, every transaction timer is a timer
+// of the Go runtime
+var RuntimeScheduler Scheduler = runtimeScheduler{}
+
+// transTimer is a timer of a transaction state machine. Starting and stopping
+// it emits an action for the executor, which owns handle. Expirations of a
+// timer stopped or restarted after it fired are ignored.
 type transTimer struct {
 	ID       string
-	Timer    *time.Timer
 	Duration int
+
+	owner    *transaction
+	handle   TimerHandle
+	gen      uint64 // Incremented on every start and stop
+	running  bool
+	deadline time.Time
 }
 
 func newTransTimer(ID string) *transTimer {
-	timer := time.NewTimer(0)
-	if !timer.Stop() {
-		<-timer.C
-	}
-	return &transTimer{ID: ID, Timer: timer, Duration: 0}
+	return &transTimer{ID: ID}
 }
 
 func (t *transTimer) start(duration int) {
-	if !t.Timer.Stop() {
-		select {
-		case <-t.Timer.C:
-		default:
-		}
-	}
-
+	t.schedule(time.Duration(duration) * time.Millisecond)
 	t.Duration = duration
-	t.Timer.Reset(time.Duration(duration) * time.Millisecond)
+}
+
+// schedule starts the timer to fire after delay, leaving Duration alone
+func (t *transTimer) schedule(delay time.Duration) {
+	t.gen++
+	t.running = true
+	t.deadline = t.owner.sched.Now().Add(delay)
+	t.owner.emit(Action{
+		Kind:  StartTimerAction,
+		Delay: delay,
+		timer: t,
+		gen:   t.gen,
+	})
 }
 
 func (t *transTimer) stop() {
-	if !t.Timer.Stop() {
-		select {
-		case <-t.Timer.C:
-		default:
-		}
+	if !t.running {
+		return
 	}
+	t.gen++
+	t.running = false
+	t.owner.emit(Action{Kind: StopTimerAction, timer: t})
 }
@@ -0,0 +1,188 @@
+package sip
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+	Hashed timing wheel (Varghese and Lauck, scheme 6)
+
+		     pos
+		      |
+		      V
+		+---+---+---+---+---+---+---+---+
+		| 0 | 1 | 2 | 3 | 4 | 5 | 6 | 7 |  one slot per tick
+		+---+---+---+---+---+---+---+---+
+		      |           |
+		      V           V
+		   timer       timer (rounds=1)
+		      |
+		      V
+		   timer
+
+	A timer due in n ticks goes to slot (pos+n) mod len(slots) and carries the
+	number of full turns left before it is due. Every tick the wheel moves one
+	slot, fires the timers of the slot whose rounds are exhausted and decrements
+	the others. Scheduling and stopping are O(1), a tick is O(timers in slot).
+*/
+
+// Default parameters of NewTimingWheel: a 10ms resolution and a 5s turn, so
+// that T1 based timers fit in the first turn and Timer B takes a few rounds
+const (
+	DefaultWheelTick    = 10 * time.Millisecond
+	DefaultWheelSlots   = 512
+	DefaultWheelWorkers = 4
+)
+
+// Size of the queue between the wheel and its workers
+const wheel_jobs_len = 1024
+
+// TimingWheel is a Scheduler for large numbers of transactions. A single
+// goroutine advances the wheel and a pool of workers runs the expired
+// functions, instead of one runtime timer per transaction timer. Timers fire
+// on the first tick after they are due, so they are late by up to one tick.
+type TimingWheel struct {
+	tick time.Duration
+
+	mu    sync.Mutex
+	slots []*wheelTimer // Sentinels of circular lists of timers
+	pos   int
+
+	jobs chan func()
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// wheelTimer is a function scheduled on a TimingWheel
+type wheelTimer struct {
+	wheel      *TimingWheel
+	f          func()
+	rounds     int
+	prev, next *wheelTimer // Links in the list of the slot, nil once fired or stopped
+}
+
+// NewTimingWheel starts a wheel with the given resolution, number of slots and
+// number of workers. Close must be called to release its goroutines.
+func NewTimingWheel(tick time.Duration, slots int, workers int) *TimingWheel {
+	w := &TimingWheel{
+		tick:  tick,
+		slots: make([]*wheelTimer, slots),
+		jobs:  make(chan func(), wheel_jobs_len),
+		stop:  make(chan struct{}),
+	}
+	for i := range w.slots {
+		sentinel := &wheelTimer{}
+		sentinel.prev, sentinel.next = sentinel, sentinel
+		w.slots[i] = sentinel
+	}
+
+	w.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Now returns the wall clock time, which the ticks of the wheel follow
+func (w *TimingWheel) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc schedules f to be run by a worker after d
+func (w *TimingWheel) AfterFunc(d time.Duration, f func()) TimerHandle {
+	ticks := int((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	t := &wheelTimer{wheel: w, f: f, rounds: (ticks - 1) / len(w.slots)}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sentinel := w.slots[(w.pos+ticks)%len(w.slots)]
+	t.prev, t.next = sentinel.prev, sentinel
+	sentinel.prev.next = t
+	sentinel.prev = t
+	return t
+}
+
+// Stop removes the timer from its slot
+func (t *wheelTimer) Stop() bool {
+	t.wheel.mu.Lock()
+	defer t.wheel.mu.Unlock()
+	if t.next == nil {
+		return false
+	}
+	t.unlink()
+	return true
+}
+
+// unlink removes the timer from the list of its slot, the wheel lock must be held
+func (t *wheelTimer) unlink() {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+}
+
+// Close stops the wheel once the functions already expired have run. Pending
+// timers never fire.
+func (w *TimingWheel) Close() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// run advances the wheel every tick and queues the expired functions
+func (w *TimingWheel) run() {
+	defer w.wg.Done()
+	defer close(w.jobs)
+
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	var expired []func()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+
+		expired = w.advance(expired[:0])
+		for i, f := range expired {
+			w.jobs <- f
+			expired[i] = nil
+		}
+	}
+}
+
+// advance moves the wheel one slot and collects the functions due
+func (w *TimingWheel) advance(expired []func()) []func() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pos = (w.pos + 1) % len(w.slots)
+	sentinel := w.slots[w.pos]
+	for t := sentinel.next; t != sentinel; {
+		next := t.next
+		if t.rounds > 0 {
+			t.rounds--
+		} else {
+			t.unlink()
+			expired = append(expired, t.f)
+		}
+		t = next
+	}
+	return expired
+}
+
+// work runs expired functions until the wheel is closed
+func (w *TimingWheel) work() {
+	defer w.wg.Done()
+	for f := range w.jobs {
+		f()
+	}
+}
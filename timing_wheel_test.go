@@ -0,0 +1,159 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimingWheelFiresInOrder(t *testing.T) {
+	wheel := NewTimingWheel(time.Millisecond, 8, 1)
+	defer wheel.Close()
+
+	fired := make(chan int, 3)
+	start := time.Now()
+	// 20ms takes more than two turns of the 8 slots
+	for _, ms := range []int{20, 2, 5} {
+		ms := ms
+		wheel.AfterFunc(time.Duration(ms)*time.Millisecond, func() { fired <- ms })
+	}
+
+	for _, want := range []int{2, 5, 20} {
+		select {
+		case got := <-fired:
+			if got != want {
+				t.Fatalf("fired %dms timer, want %dms", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%dms timer did not fire", want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("20ms timer fired after %v", elapsed)
+	}
+}
+
+func TestTimingWheelStop(t *testing.T) {
+	wheel := NewTimingWheel(time.Millisecond, 8, 1)
+	defer wheel.Close()
+
+	fired := make(chan struct{}, 1)
+	timer := wheel.AfterFunc(5*time.Millisecond, func() { fired <- struct{}{} })
+	if !timer.Stop() {
+		t.Fatalf("Stop() = false for a pending timer")
+	}
+	if timer.Stop() {
+		t.Errorf("Stop() = true for a stopped timer")
+	}
+
+	select {
+	case <-fired:
+		t.Errorf("stopped timer fired")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestStackTimingWheel(t *testing.T) {
+	wheel := NewTimingWheel(DefaultWheelTick, DefaultWheelSlots, DefaultWheelWorkers)
+	defer wheel.Close()
+
+	stack := NewStack()
+	stack.SetScheduler(wheel)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer stack.Shutdown(ctx)
+
+	sent := make(chan *SIPMessage, 10)
+	invite := parseTestMessage(t, testInvite)
+	trans, err := stack.StartServerTrans(invite, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+
+	busy := makeGenericResponse(486, []byte("Busy Here"), invite)
+	busy.setToTag(GenerateTag())
+	trans.Event(busy)
+
+	// The response is sent once, then again when Timer G fires after T1
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-sent:
+			if msg != busy {
+				t.Fatalf("sent %v, want the 486", msg.Startline)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("486 sent %d times, want 2", i)
+		}
+	}
+}
+
+// benchSchedulers runs a benchmark with the runtime timers and a timing wheel
+func benchSchedulers(b *testing.B, bench func(b *testing.B, sched Scheduler)) {
+	b.Run("runtime", func(b *testing.B) { bench(b, RuntimeScheduler) })
+	b.Run("wheel", func(b *testing.B) {
+		wheel := NewTimingWheel(DefaultWheelTick, DefaultWheelSlots, DefaultWheelWorkers)
+		defer wheel.Close()
+		bench(b, wheel)
+	})
+}
+
+func BenchmarkSchedulerAfterFuncStop(b *testing.B) {
+	benchSchedulers(b, func(b *testing.B, sched Scheduler) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				sched.AfterFunc(time.Minute, func() {}).Stop()
+			}
+		})
+	})
+}
+
+// BenchmarkConcurrentTransactions keeps b.N INVITE client transactions alive
+// in Completed state with Timer D pending, each in its own goroutine or on an
+// event loop
+func BenchmarkConcurrentTransactions(b *testing.B) {
+	invite, err := ParseSipMessage([]byte(testInvite), ParseOptions{
+		ParseTopMostVia: true, ParseFrom: true, ParseTo: true, ParseCallID: true, ParseCseq: true,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	busy := makeGenericResponse(486, []byte("Busy Here"), invite)
+
+	bench := func(b *testing.B, sched Scheduler, start func(context.Context, SIPTransaction)) {
+		b.ReportAllocs()
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(b.N)
+		for i := 0; i < b.N; i++ {
+			trans := MakeICT(TransID(fmt.Sprint(i)), invite, NewLoopback("udp", "", ""),
+				func(Transport, *SIPMessage) {},
+				func(Transport, *SIPMessage) error { return nil },
+				func(TransID, error) { wg.Done() },
+			)
+			trans.SetScheduler(sched)
+			start(ctx, trans)
+			trans.Event(busy)
+		}
+		b.StopTimer()
+		cancel()
+		wg.Wait()
+	}
+	goroutine := func(ctx context.Context, trans SIPTransaction) { go trans.Start(ctx) }
+
+	benchSchedulers(b, func(b *testing.B, sched Scheduler) { bench(b, sched, goroutine) })
+	b.Run("loop", func(b *testing.B) {
+		wheel := NewTimingWheel(DefaultWheelTick, DefaultWheelSlots, DefaultWheelWorkers)
+		defer wheel.Close()
+		loop := NewEventLoop(runtime.GOMAXPROCS(0))
+		defer loop.Close()
+		bench(b, wheel, func(ctx context.Context, trans SIPTransaction) { loop.Start(ctx, trans) })
+	})
+}
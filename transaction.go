@@ -1,59 +1,371 @@
 package sip
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"sync"
+	"time"
 )
 
 type TransType int
 
 const (
-	INVITE_CLIENT = iota
+	INVITE_CLIENT TransType = iota
 	NON_INVITE_CLIENT
 	INVITE_SERVER
 	NON_INVITE_SERVER
 )
 
-type state int
-
-const (
-	trying state = iota
-	calling
-	proceeding
-	completed
-	confirmed
-	terminated
-)
+func (t TransType) String() string {
+	switch t {
+	case INVITE_CLIENT:
+		return "INVITE_CLIENT"
+	case NON_INVITE_CLIENT:
+		return "NON_INVITE_CLIENT"
+	case INVITE_SERVER:
+		return "INVITE_SERVER"
+	case NON_INVITE_SERVER:
+		return "NON_INVITE_SERVER"
+	default:
+		return "UNKNOWN"
+	}
+}
 
-type TERM_REASON int
+// State is the state of a transaction state machine
+type State int
 
 const (
-	NORMAL TERM_REASON = iota
-	TIMEOUT
-	ERROR
+	Trying State = iota
+	Calling
+	Proceeding
+	Completed
+	Confirmed
+	Accepted // RFC 6026 state absorbing 2xx retransmissions of INVITE transactions
+	Terminated
 )
 
-func (t TERM_REASON) String() string {
-	switch t {
-	case NORMAL:
-		return "NORMAL"
-	case TIMEOUT:
-		return "TIMEOUT"
-	case ERROR:
-		return "ERROR"
+func (s State) String() string {
+	switch s {
+	case Trying:
+		return "Trying"
+	case Calling:
+		return "Calling"
+	case Proceeding:
+		return "Proceeding"
+	case Completed:
+		return "Completed"
+	case Confirmed:
+		return "Confirmed"
+	case Accepted:
+		return "Accepted"
+	case Terminated:
+		return "Terminated"
 	default:
-		return "UNKNOWN"
+		return "Unknown"
 	}
 }
 
 type TransID string
 
+// MagicCookie starts the branch parameter of every RFC 3261 compliant request
+const MagicCookie = "z9hG4bK"
+
+// hasMagicCookie reports whether a branch was generated by an RFC 3261 compliant element
+func hasMagicCookie(branch []byte) bool {
+	return bytes.HasPrefix(branch, []byte(MagicCookie))
+}
+
 func (tid TransID) String() string {
 	return string(tid)
 }
 
+// SIPTransaction is the common interface of the four transaction state machines.
+// Start runs the transaction until it terminates or ctx is done, in which case
+// the termination callback is invoked with ErrShutdown. Event and Snapshot are safe
+// to call from any goroutine and never block.
 type SIPTransaction interface {
-	Event(*SIPMessage)
-	Start()
+	Event(*SIPMessage) bool
+	Start(ctx context.Context)
+	Snapshot() TransSnapshot
+}
+
+// TransSnapshot is a read-only copy of the state of a transaction
+type TransSnapshot struct {
+	ID           TransID
+	Kind         TransType
+	State        State
+	Started      time.Time // Creation of the transaction
+	StateChanged time.Time // Last transition, equal to Started until the first one
+	Retransmits  int       // Messages sent again by the transaction
+	RemoteAddr   string    // Remote address of the transport
+	LastResponse int       // Status code of the last response sent or received, 0 if none
+}
+
+// Size of the event queue of a transaction
+const transc_len = 16
+
+// Size of the timer expiration queue of a transaction
+const timerc_len = 8
+
+// transaction holds the fields and helpers shared by the four state machines.
+// Every field except transc, timerc, ctrl, post, done and the ones below mu is owned
+// by the executor of the transaction, which runs at most one Handle or action
+// at a time. state is also written under mu for Snapshot.
+type transaction struct {
+	id        TransID                             // Transaction ID
+	kind      TransType                           // Which of the four state machines
+	state     State                               // Current state of the transaction
+	message   *SIPMessage                         // The request that created the transaction
+	transport Transport                           // Transport layer for sending and receiving messages
+	transc    chan *SIPMessage                    // Queue of messages for Start, never closed
+	timerc    chan TransEvent                     // Queue of timer expirations for Start, never closed
+	ctrl      chan func()                         // Functions run by Start between two events, see do
+	post      func(TransEvent, bool) bool         // Queue of an EventLoop, nil when run by Start
+	done      chan struct{}                       // Closed once the transaction has terminated
+	trpt_cb   func(Transport, *SIPMessage) error  // Transport callback
+	core_cb   func(Transport, *SIPMessage)        // Core callback
+	term_cb   func(TransID, error)                // Termination callback, nil error on normal termination
+	spawn     func(TransID, SIPTransaction) error // Runs the transactions of SpawnAction
+	exit      func()                              // Called by the executor after the termination callback
+	observer  Observer                            // Notified of everything the state machine does
+	sched     Scheduler                           // Drives the timers
+	timers    []*transTimer                       // Timers of the state machine, see init_timers
+	resume    []TimerRecord                       // Timers of a restored transaction, see resume_timers
+	actions   []Action                            // Output of the event being handled
+
+	mu          sync.Mutex // Guards the writes of the fields read by Snapshot and to_tag
+	started     time.Time
+	changed     time.Time
+	retransmits int
+	last_code   int
+	last_tag    []byte // To tag of the last response with one
+}
+
+func makeTransaction(
+	id TransID,
+	kind TransType,
+	initial State,
+	msg *SIPMessage,
+	transport Transport,
+	core_callback func(Transport, *SIPMessage),
+	transport_callback func(Transport, *SIPMessage) error,
+	term_callback func(TransID, error),
+) transaction {
+	if transport_callback == nil {
+		transport_callback = Transport.Send
+	}
+	now := time.Now()
+	return transaction{
+		id:        id,
+		kind:      kind,
+		state:     initial,
+		message:   msg,
+		transport: transport,
+		transc:    make(chan *SIPMessage, transc_len),
+		timerc:    make(chan TransEvent, timerc_len),
+		ctrl:      make(chan func()),
+		done:      make(chan struct{}),
+		trpt_cb:   transport_callback,
+		core_cb:   core_callback,
+		term_cb:   term_callback,
+		observer:  NopObserver{},
+		sched:     RuntimeScheduler,
+		started:   now,
+		changed:   now,
+	}
+}
+
+// SetObserver attaches an observer to the transaction, it must be called before Start
+func (trans *transaction) SetObserver(observer Observer) {
+	trans.observer = observer
+}
+
+// SetScheduler changes the scheduler driving the timers, it must be called before Start
+func (trans *transaction) SetScheduler(sched Scheduler) {
+	trans.sched = sched
+}
+
+// Event queues a message for the transaction without blocking. It reports whether
+// the message was accepted: false means the transaction has terminated or its
+// queue is full, and the message is dropped as if it was lost by the network.
+func (trans *transaction) Event(msg *SIPMessage) bool {
+	select {
+	case <-trans.done:
+		return false
+	default:
+	}
+
+	if trans.post != nil {
+		return trans.post(TransEvent{Kind: MessageEvent, Msg: msg}, false)
+	}
+
+	select {
+	case trans.transc <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// init_timers attaches the timers of the state machine to the transaction, it
+// is called first thing on StartEvent
+func (trans *transaction) init_timers(timers ...*transTimer) {
+	for _, timer := range timers {
+		timer.owner = trans
+	}
+	trans.timers = timers
+}
+
+// expired returns the timer of a TimerEvent, or nil if the timer has been
+// stopped or restarted since. The timer is no longer running.
+func (trans *transaction) expired(ev TransEvent) *transTimer {
+	if !ev.timer.running || ev.timer.gen != ev.gen {
+		return nil
+	}
+	ev.timer.running = false
+	trans.timer_fired(ev.timer)
+	return ev.timer
+}
+
+/*
+	RFC 3261 17.1.2.2
+		Once the client transaction enters the "Completed" state, it MUST set
+		Timer K to fire in T4 seconds for unreliable transports, and zero
+		seconds for reliable transports.  The "Completed" state exists to
+		buffer any additional response retransmissions that may be received
+		(which is why the client transaction remains there only for
+		unreliable transports).
+*/
+// reliable reports whether the transport of the transaction is reliable: its
+// messages are not retransmitted, timers A, E and G are not started
+func (trans *transaction) reliable() bool {
+	return trans.transport != nil && trans.transport.Reliable()
+}
+
+// absorb_dur returns the duration of a timer absorbing retransmissions, D, I,
+// J or K: zero over a reliable transport
+func (trans *transaction) absorb_dur(duration int) int {
+	if trans.reliable() {
+		return 0
+	}
+	return duration
+}
+
+// handle_error terminates the transaction on a transport error, a transaction
+// it could not spawn or a shutdown
+func (trans *transaction) handle_error(ev TransEvent) {
+	switch ev.Kind {
+	case TransportErrorEvent:
+		trans.terminate(&TransportError{Err: ev.Err})
+	case SpawnErrorEvent:
+		trans.terminate(ev.Err)
+	case ShutdownEvent:
+		trans.terminate(ErrShutdown)
+	}
+}
+
+// emit appends an action to the output of the event being handled
+func (trans *transaction) emit(a Action) {
+	trans.actions = append(trans.actions, a)
+}
+
+// flush returns the output of the event that has been handled
+func (trans *transaction) flush() []Action {
+	actions := trans.actions
+	trans.actions = nil
+	return actions
+}
+
+// set_state moves the transaction to a new state because of msg, which is nil
+// when the transition is caused by a timer. Staying in the same state is not
+// reported to the observer.
+func (trans *transaction) set_state(state State, msg *SIPMessage) {
+	old := trans.state
+	if old == state {
+		return
+	}
+	trans.mu.Lock()
+	trans.state = state
+	trans.changed = time.Now()
+	trans.mu.Unlock()
+	trans.observer.StateChanged(trans.id, old, state, msg)
+}
+
+// timer_fired reports a timer expiration, before it is handled
+func (trans *transaction) timer_fired(timer *transTimer) {
+	trans.observer.TimerFired(trans.id, timer.ID, trans.state)
+}
+
+// send asks for a message to be sent
+func (trans *transaction) send(msg *SIPMessage) {
+	trans.emit(Action{Kind: SendAction, Msg: msg})
+}
+
+// pass asks for a message to be passed to the TU
+func (trans *transaction) pass(msg *SIPMessage) {
+	trans.emit(Action{Kind: PassAction, Msg: msg})
+}
+
+// retransmit asks for a message to be sent again
+func (trans *transaction) retransmit(msg *SIPMessage) {
+	trans.mu.Lock()
+	trans.retransmits++
+	trans.mu.Unlock()
+	trans.observer.Retransmitted(trans.id, msg)
+	trans.send(msg)
+}
+
+// terminate moves the transaction to the terminated state and asks for the TU
+// to be informed once, err is nil for a normal termination
+func (trans *transaction) terminate(err error) {
+	if trans.state == Terminated {
+		return
+	}
+	trans.set_state(Terminated, nil)
+	trans.emit(Action{Kind: TerminateAction, Err: err})
+}
+
+// Snapshot returns a copy of the state of the transaction
+func (trans *transaction) Snapshot() TransSnapshot {
+	trans.mu.Lock()
+	defer trans.mu.Unlock()
+	snap := TransSnapshot{
+		ID:           trans.id,
+		Kind:         trans.kind,
+		State:        trans.state,
+		Started:      trans.started,
+		StateChanged: trans.changed,
+		Retransmits:  trans.retransmits,
+		LastResponse: trans.last_code,
+	}
+	if trans.transport != nil {
+		snap.RemoteAddr = trans.transport.RemoteAddr()
+	}
+	return snap
+}
+
+// note_response records the status code and the To tag of a response going
+// through the transaction
+func (trans *transaction) note_response(msg *SIPMessage) {
+	if msg == nil || msg.Response == nil {
+		return
+	}
+	tag := msg.toTag()
+	trans.mu.Lock()
+	trans.last_code = msg.Response.StatusCode
+	if len(tag) > 0 {
+		trans.last_tag = tag
+	}
+	trans.mu.Unlock()
+}
+
+// to_tag returns the To tag of the last response with one that went through
+// the transaction, nil if none
+func (trans *transaction) to_tag() []byte {
+	trans.mu.Lock()
+	defer trans.mu.Unlock()
+	return trans.last_tag
 }
 
 /*
@@ -95,9 +407,68 @@ func MakeServerTransactionID(msg *SIPMessage) (TransID, error) {
 		method = Invite
 	}
 
+	if !hasMagicCookie(branch) {
+		return makeLegacyServerTransactionID(msg, method), nil
+	}
+
 	return TransID(fmt.Sprintf("%s;%s;%s", branch, SerializeMethod(method), topmostVia.Domain)), nil
 }
 
+/*
+	 RFC 3261 17.2.3
+		If the branch parameter in the top Via header field is not present,
+		or does not contain the magic cookie, the following procedures are
+		used.
+
+		The INVITE request matches a transaction if the Request-URI, To tag,
+		From tag, Call-ID, CSeq, and top Via header field match those of the
+		INVITE request which created the transaction.
+
+		The ACK request matches a transaction if the Request-URI, From tag,
+		Call-ID, CSeq number (not the method), and top Via header field match
+		those of the INVITE request which created the transaction, and the To
+		tag of the ACK matches the To tag of the response sent by the server
+		transaction.
+
+		For all other request methods, a request is matched to a transaction
+		if the Request-URI, To tag, From tag, Call-ID, CSeq (including the
+		method), and top Via header field match those of the request that
+		created the transaction.
+
+The To tag is left out of the ID of INVITE transactions so that the ACK maps
+to the same ID, the INVITE server transaction then checks the To tag of the
+ACK against the one of its response.
+*/
+func makeLegacyServerTransactionID(msg *SIPMessage, method SIPMethod) TransID {
+	var to_tag []byte
+	if method != Invite {
+		to_tag = msg.toTag()
+	}
+
+	return TransID(fmt.Sprintf("%s;%s;%s;%s;%d;%s;%s",
+		msg.Request.RequestURI.Serialize(),
+		to_tag,
+		msg.fromTag(),
+		msg.callID(),
+		msg.cseq().Seq,
+		SerializeMethod(method),
+		msg.TopmostVia.Serialize(),
+	))
+}
+
+// MakeCancelTargetID returns the ID of the INVITE server transaction a CANCEL
+// refers to. RFC 3261 9.2: the CANCEL matches the transaction as if its method
+// was INVITE, which is why it creates a transaction of its own.
+func MakeCancelTargetID(cancel *SIPMessage) (TransID, error) {
+	if cancel.Request == nil || cancel.Request.Method != Cancel {
+		return "", fmt.Errorf("request is not a CANCEL")
+	}
+
+	inv := *cancel
+	inv.Request = &Request{Method: Invite, RequestURI: cancel.Request.RequestURI}
+	return MakeServerTransactionID(&inv)
+}
+
 func MakeClientTransactionID(msg *SIPMessage) (TransID, error) {
 	topmostVia := msg.TopmostVia
 	branch := topmostVia.Branch
@@ -0,0 +1,720 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testInvite = "INVITE sip:bob@example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.168.1.1:5060;branch=z9hG4bK776asdhds\r\n" +
+	"From: Alice <sip:alice@example.com>;tag=1928301774\r\n" +
+	"To: Bob <sip:bob@example.com>\r\n" +
+	"Call-ID: a84b4c76e66710@pc33.example.com\r\n" +
+	"CSeq: 314159 INVITE\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+func parseTestMessage(t *testing.T, raw string) *SIPMessage {
+	t.Helper()
+	msg, err := ParseSipMessage([]byte(raw), ParseOptions{
+		ParseTopMostVia: true,
+		ParseFrom:       true,
+		ParseTo:         true,
+		ParseCallID:     true,
+		ParseCseq:       true,
+	})
+	if err != nil {
+		t.Fatalf("ParseSipMessage() error = %v", err)
+	}
+	return msg
+}
+
+func TestStackShutdownAnswersPendingInvite(t *testing.T) {
+	stack := NewStack()
+	sent := make(chan *SIPMessage, 10)
+	terms := make(chan error, 1)
+
+	_, err := stack.StartServerTrans(
+		parseTestMessage(t, testInvite),
+		NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil },
+		func(_ TransID, err error) { terms <- err },
+	)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := stack.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case msg := <-sent:
+		if msg.Response == nil || msg.Response.StatusCode != 503 {
+			t.Errorf("sent %v, want 503 response", msg.Startline)
+		}
+	default:
+		t.Errorf("no response sent for pending INVITE")
+	}
+
+	if err := <-terms; !errors.Is(err, ErrShutdown) {
+		t.Errorf("termination error = %v, want %v", err, ErrShutdown)
+	}
+	if n := stack.Len(); n != 0 {
+		t.Errorf("Len() = %d after shutdown, want 0", n)
+	}
+
+	_, err = stack.StartServerTrans(parseTestMessage(t, testInvite), NewLoopback("udp", "", ""), nil, nil, nil)
+	if err != ErrStackClosed {
+		t.Errorf("StartServerTrans() after shutdown error = %v, want %v", err, ErrStackClosed)
+	}
+}
+
+func TestEventConcurrentWithTermination(t *testing.T) {
+	invite := parseTestMessage(t, testInvite)
+	Trying := makeGenericResponse(100, []byte("Trying"), invite)
+
+	terminated := make(chan struct{})
+	trans := MakeICT("ict", invite, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) { close(terminated) },
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go trans.Start(ctx)
+
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					trans.Event(Trying)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-terminated
+	close(stop)
+	senders.Wait()
+
+	if trans.Event(Trying) {
+		t.Errorf("Event() = true after termination, want false")
+	}
+}
+
+func TestAcceptedStateDeliversEvery2xx(t *testing.T) {
+	invite := parseTestMessage(t, testInvite)
+	ok := makeGenericResponse(200, []byte("OK"), invite)
+
+	delivered := make(chan *SIPMessage, 10)
+	trans := MakeICT("ict", invite, NewLoopback("udp", "", ""),
+		func(_ Transport, msg *SIPMessage) { delivered <- msg },
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trans.Start(ctx)
+
+	for i := 0; i < 2; i++ {
+		if !trans.Event(ok) {
+			t.Fatalf("Event() rejected 2xx #%d", i+1)
+		}
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("2xx #%d not delivered to TU", i+1)
+		}
+	}
+}
+
+func TestAcceptedStatePassesAckToTU(t *testing.T) {
+	invite := parseTestMessage(t, testInvite)
+	ack := initAck(invite)
+
+	delivered := make(chan *SIPMessage, 10)
+	sent := make(chan *SIPMessage, 10)
+	trans := MakeIST("ist", invite, NewLoopback("udp", "", ""),
+		func(_ Transport, msg *SIPMessage) { delivered <- msg },
+		func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil },
+		func(TransID, error) {},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trans.Start(ctx)
+	<-delivered // INVITE
+
+	trans.Event(makeGenericResponse(200, []byte("OK"), invite))
+	<-sent
+	trans.Event(invite) // retransmission is absorbed
+	trans.Event(ack)
+
+	select {
+	case msg := <-delivered:
+		if msg.Request == nil || msg.Request.Method != Ack {
+			t.Errorf("delivered %v, want ACK", msg.Startline)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ACK for 2xx not delivered to TU")
+	}
+	if len(sent) != 0 {
+		t.Errorf("INVITE retransmission in accepted state was answered")
+	}
+}
+
+func TestStackCancelTerminatesInvite(t *testing.T) {
+	stack := NewStack()
+	sent := make(chan *SIPMessage, 10)
+	send := func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil }
+	notified := make(chan *SIPMessage, 10)
+
+	invite := parseTestMessage(t, testInvite)
+	ist, err := stack.StartServerTrans(invite, NewLoopback("udp", "", ""),
+		func(_ Transport, msg *SIPMessage) { notified <- msg }, send, func(TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartServerTrans(INVITE) error = %v", err)
+	}
+	<-notified // INVITE
+	ringing := makeGenericResponse(180, []byte("Ringing"), invite)
+	ringing.setToTag([]byte("ring"))
+	ist.Event(ringing)
+	<-sent
+
+	cancels := make(chan *SIPMessage, 10)
+	_, err = stack.StartServerTrans(MakeCancel(invite), NewLoopback("udp", "", ""),
+		func(_ Transport, msg *SIPMessage) { cancels <- msg }, send, func(TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartServerTrans(CANCEL) error = %v", err)
+	}
+
+	got := map[SIPMethod]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case res := <-sent:
+			got[res.CSeq.Method] = res.Response.StatusCode
+			// Both in the dialog of the 180 (RFC 3261 9.2)
+			if tag := string(res.toTag()); tag != "ring" {
+				t.Errorf("%d response has To tag %q, want the one of the 180", res.Response.StatusCode, tag)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("responses sent = %v, want 487 to INVITE and 200 to CANCEL", got)
+		}
+	}
+	if got[Invite] != 487 || got[Cancel] != 200 {
+		t.Errorf("responses sent = %v, want 487 to INVITE and 200 to CANCEL", got)
+	}
+	// The TU is notified of the CANCEL once, by its own transaction, which
+	// also passes the response it sends
+	if msg := <-cancels; msg.Request == nil || msg.Request.Method != Cancel {
+		t.Errorf("TU notified with %v, want CANCEL", msg.Startline)
+	}
+	for {
+		select {
+		case msg := <-cancels:
+			if msg.Request != nil {
+				t.Errorf("TU notified of the CANCEL again")
+			}
+		case msg := <-notified:
+			if msg.Request != nil {
+				t.Errorf("INVITE transaction passed a request to the TU")
+			}
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestInviteClientCancelWaitsForProvisional(t *testing.T) {
+	stack := NewStack()
+	sent := make(chan *SIPMessage, 10)
+
+	invite := parseTestMessage(t, testInvite)
+	trans, err := stack.StartClientTrans(invite, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil },
+		func(TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	<-sent // INVITE
+
+	ict := trans.(*Ictrans)
+	if !ict.Cancel() {
+		t.Fatalf("Cancel() = false")
+	}
+	select {
+	case msg := <-sent:
+		t.Fatalf("sent %v before a provisional response", msg.Startline)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ict.Event(makeGenericResponse(180, []byte("Ringing"), invite))
+	cancel := <-sent
+	if cancel.Request == nil || cancel.Request.Method != Cancel {
+		t.Fatalf("sent %v, want CANCEL", cancel.Startline)
+	}
+	if string(cancel.TopmostVia.Branch) != string(invite.TopmostVia.Branch) || cancel.CSeq.Seq != invite.CSeq.Seq {
+		t.Errorf("CANCEL Via/CSeq = %s/%d, want %s/%d", cancel.TopmostVia.Branch, cancel.CSeq.Seq, invite.TopmostVia.Branch, invite.CSeq.Seq)
+	}
+
+	// The response to the CANCEL is matched by its own transaction
+	if stack.FindTrans(makeGenericResponse(200, []byte("OK"), cancel)) == nil {
+		t.Errorf("no client transaction for the CANCEL")
+	}
+}
+
+func TestInviteClientCancelNotStarted(t *testing.T) {
+	stack := NewStack()
+	terminated := make(chan error, 1)
+	send := func(Transport, *SIPMessage) error { return nil }
+
+	invite := parseTestMessage(t, testInvite)
+	trans, err := stack.StartClientTrans(invite, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {}, send,
+		func(_ TransID, err error) { terminated <- err })
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	// A transaction already uses the ID of the CANCEL
+	_, err = stack.StartClientTrans(MakeCancel(invite), NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {}, send, func(TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartClientTrans(CANCEL) error = %v", err)
+	}
+
+	ict := trans.(*Ictrans)
+	ict.Event(makeGenericResponse(180, []byte("Ringing"), invite))
+	ict.Cancel()
+	select {
+	case err := <-terminated:
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("terminated with %v, want the error of the CANCEL transaction", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("INVITE transaction not terminated")
+	}
+}
+
+func TestLegacyServerTransactionID(t *testing.T) {
+	const legacyRequest = "%[2]s sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.1:5060\r\n" +
+		"From: Alice <sip:alice@example.com>;tag=1928301774\r\n" +
+		"To: Bob <sip:bob@example.com>\r\n" +
+		"Call-ID: %[1]s\r\n" +
+		"CSeq: 1 %[2]s\r\n" +
+		"\r\n"
+	id := func(callID, method, to string) TransID {
+		raw := fmt.Sprintf(legacyRequest, callID, method)
+		if to != "" {
+			raw = strings.Replace(raw, "<sip:bob@example.com>\r\n", "<sip:bob@example.com>;tag="+to+"\r\n", 1)
+		}
+		tid, err := MakeServerTransactionID(parseTestMessage(t, raw))
+		if err != nil {
+			t.Fatalf("MakeServerTransactionID() error = %v", err)
+		}
+		return tid
+	}
+
+	if id("call-1", "INVITE", "") == id("call-2", "INVITE", "") {
+		t.Errorf("INVITEs with different Call-IDs share a transaction ID")
+	}
+	if id("call-1", "INVITE", "") != id("call-1", "ACK", "8321234356") {
+		t.Errorf("ACK does not match its INVITE")
+	}
+	if id("call-1", "BYE", "a") == id("call-1", "BYE", "b") {
+		t.Errorf("BYEs with different To tags share a transaction ID")
+	}
+}
+
+func TestLegacyAckMatchesToTagOfResponse(t *testing.T) {
+	invite := parseTestMessage(t, strings.Replace(testInvite, ";branch=z9hG4bK776asdhds", "", 1))
+	sent := make(chan *SIPMessage, 10)
+	trans := MakeIST("ist", invite, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil },
+		func(TransID, error) {},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trans.Start(ctx)
+
+	busy := makeGenericResponse(486, []byte("Busy Here"), invite)
+	busy.setToTag([]byte("server"))
+	trans.Event(busy)
+	<-sent
+
+	// An ACK with another To tag leaves the transaction completed: the INVITE
+	// retransmission is answered again
+	stray := initAck(invite)
+	updateAck(stray, busy)
+	stray.setToTag([]byte("other"))
+	trans.Event(stray)
+	trans.Event(invite)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("ACK with a foreign To tag confirmed the transaction")
+	}
+
+	// The ACK of the response confirms it: the retransmission is absorbed
+	ack := initAck(invite)
+	updateAck(ack, busy)
+	trans.Event(ack)
+	trans.Event(invite)
+	select {
+	case msg := <-sent:
+		t.Errorf("sent %v after the ACK of the response", msg.Startline)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// recordingObserver keeps a line for every notification
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+	done   chan struct{}
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) StateChanged(_ TransID, from, to State, _ *SIPMessage) {
+	o.record("state %v -> %v", from, to)
+}
+
+func (o *recordingObserver) TimerFired(_ TransID, timer string, _ State) {
+	o.record("timer %s", timer)
+}
+
+func (o *recordingObserver) Retransmitted(_ TransID, msg *SIPMessage) {
+	o.record("retransmit %d", msg.Response.StatusCode)
+}
+
+func (o *recordingObserver) Terminated(_ TransID, err error) {
+	o.record("terminated: %v", err)
+	close(o.done)
+}
+
+func TestStackObserver(t *testing.T) {
+	observer := &recordingObserver{done: make(chan struct{})}
+	stack := NewStack()
+	stack.SetObserver(observer)
+
+	invite := parseTestMessage(t, testInvite)
+	trans, err := stack.StartServerTrans(invite, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+
+	busy := makeGenericResponse(486, []byte("Busy Here"), invite)
+	busy.setToTag(GenerateTag())
+	trans.Event(busy)
+	trans.Event(invite) // Retransmission of the INVITE
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stack.Shutdown(ctx)
+	<-observer.done
+
+	want := []string{
+		"state Proceeding -> Completed",
+		"retransmit 486",
+		"state Completed -> Terminated",
+		"terminated: transaction layer shut down",
+	}
+	if got := strings.Join(observer.events, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("observer events:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestStackSnapshot(t *testing.T) {
+	stack := NewStack()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer stack.Shutdown(ctx)
+
+	invite := parseTestMessage(t, testInvite)
+	trans, err := stack.StartServerTrans(invite, NewLoopback("udp", "", "192.168.1.1:5060"),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+
+	ringing := makeGenericResponse(180, []byte("Ringing"), invite)
+	trans.Event(ringing)
+	trans.Event(invite) // Retransmission of the INVITE, answered with the 180
+
+	deadline := time.Now().Add(time.Second)
+	for trans.Snapshot().Retransmits == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	snaps := stack.Snapshot()
+	if len(snaps) != 1 {
+		t.Fatalf("Snapshot() returned %d transactions, want 1", len(snaps))
+	}
+	snap := snaps[0]
+	if snap.Kind != INVITE_SERVER || snap.State != Proceeding {
+		t.Errorf("kind, state = %v, %v, want %v, %v", snap.Kind, snap.State, INVITE_SERVER, Proceeding)
+	}
+	if snap.Retransmits != 1 || snap.LastResponse != 180 {
+		t.Errorf("retransmits, last response = %d, %d, want 1, 180", snap.Retransmits, snap.LastResponse)
+	}
+	if snap.RemoteAddr != "192.168.1.1:5060" {
+		t.Errorf("remote address = %q", snap.RemoteAddr)
+	}
+	if snap.Started.IsZero() || snap.Started.After(time.Now()) {
+		t.Errorf("start time = %v", snap.Started)
+	}
+}
+
+func TestTransportErrorTerminatesTransaction(t *testing.T) {
+	options := strings.Replace(testInvite, "INVITE", "OPTIONS", -1)
+	terms := make(chan error, 1)
+	trans := MakeNICT("nict", parseTestMessage(t, options), NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return &net.OpError{Op: "write", Err: syscall.ECONNREFUSED} },
+		func(_ TransID, err error) { terms <- err },
+	)
+	go trans.Start(context.Background())
+
+	err := <-terms
+	var terr *TransportError
+	if !errors.As(err, &terr) || !errors.Is(err, ErrTransport) {
+		t.Fatalf("termination error = %v, want a TransportError", err)
+	}
+	if !IsUnreachable(err) {
+		t.Errorf("IsUnreachable(%v) = false, want true", err)
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Errorf("errors.Is(%v, ErrTimeout) = true", err)
+	}
+}
+
+func TestHandleReturnsActions(t *testing.T) {
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	trans := MakeNICT("nict", options, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+
+	kinds := func(actions []Action) []ActionKind {
+		var k []ActionKind
+		for _, a := range actions {
+			k = append(k, a.Kind)
+		}
+		return k
+	}
+
+	actions := trans.Handle(TransEvent{Kind: StartEvent})
+	if got, want := kinds(actions), []ActionKind{StartTimerAction, SendAction, StartTimerAction}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("start actions = %v, want %v", got, want)
+	}
+	if actions[1].Msg != options {
+		t.Errorf("start sends %v, want the request", actions[1].Msg.Startline)
+	}
+
+	// Timer E fires: the request is retransmitted and Timer E restarted
+	timerE := actions[2]
+	actions = trans.Handle(TransEvent{Kind: TimerEvent, timer: timerE.timer, gen: timerE.gen})
+	if got, want := kinds(actions), []ActionKind{StartTimerAction, SendAction}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Timer E actions = %v, want %v", got, want)
+	}
+	if actions[0].Delay != 2*timerE.Delay {
+		t.Errorf("Timer E restarted with %v, want %v", actions[0].Delay, 2*timerE.Delay)
+	}
+
+	// The first expiration of Timer E is stale now that it has been restarted
+	if actions := trans.Handle(TransEvent{Kind: TimerEvent, timer: timerE.timer, gen: timerE.gen}); len(actions) != 0 {
+		t.Errorf("stale Timer E actions = %v, want none", kinds(actions))
+	}
+
+	actions = trans.Handle(TransEvent{Kind: TransportErrorEvent, Err: syscall.ECONNREFUSED})
+	if len(actions) != 1 || actions[0].Kind != TerminateAction || !errors.Is(actions[0].Err, ErrTransport) {
+		t.Fatalf("transport error actions = %v, want a TerminateAction with a TransportError", actions)
+	}
+	if trans.Snapshot().State != Terminated {
+		t.Errorf("state = %v, want %v", trans.Snapshot().State, Terminated)
+	}
+}
+
+func TestExpireDoesNotBlockScheduler(t *testing.T) {
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	trans := MakeNICT("nict", options, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+
+	// Nothing drains the queue of a transaction that has not been started
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*timerc_len; i++ {
+			trans.expire(TransEvent{Kind: TimerEvent})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expire blocked on a full timer queue")
+	}
+}
+
+func TestNonInviteClientCompletedAbsorbsResponses(t *testing.T) {
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	trans := MakeNICT("nict", options, NewLoopback("udp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+	trans.Handle(TransEvent{Kind: StartEvent})
+
+	ok := makeGenericResponse(200, []byte("OK"), options)
+	actions := trans.Handle(TransEvent{Kind: MessageEvent, Msg: ok})
+	if len(actions) == 0 || actions[len(actions)-1].Kind != PassAction || trans.Snapshot().State != Completed {
+		t.Fatalf("200 actions = %v in %v, want it passed in Completed", actions, trans.Snapshot().State)
+	}
+
+	// Retransmissions of the final response, or late provisional responses,
+	// are neither passed to the TU nor change the state
+	for _, code := range []int{200, 180} {
+		res := makeGenericResponse(code, []byte("Reason"), options)
+		if actions := trans.Handle(TransEvent{Kind: MessageEvent, Msg: res}); len(actions) != 0 {
+			t.Errorf("%d in Completed state actions = %v, want none", code, actions)
+		}
+	}
+	if state := trans.Snapshot().State; state != Completed {
+		t.Errorf("state = %v, want %v", state, Completed)
+	}
+}
+
+func TestReliableTransportTimers(t *testing.T) {
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	trans := MakeNICT("nict", options, NewLoopback("tcp", "", ""),
+		func(Transport, *SIPMessage) {},
+		func(Transport, *SIPMessage) error { return nil },
+		func(TransID, error) {},
+	)
+
+	// No Timer E, requests are not retransmitted over a reliable transport
+	actions := trans.Handle(TransEvent{Kind: StartEvent})
+	if len(actions) != 2 || actions[0].Kind != StartTimerAction || actions[1].Kind != SendAction {
+		t.Fatalf("start actions = %v, want Timer F and the request", actions)
+	}
+
+	// Timer K is zero, there are no retransmissions to absorb
+	actions = trans.Handle(TransEvent{Kind: MessageEvent, Msg: makeGenericResponse(200, []byte("OK"), options)})
+	if len(actions) == 0 || actions[0].Kind != StartTimerAction || actions[0].Delay != 0 {
+		t.Fatalf("final response actions = %v, want Timer K started with no delay", actions)
+	}
+}
+
+func TestLoopbackTransport(t *testing.T) {
+	stack := NewStack()
+	defer shutdownNow(stack)
+	loopback := NewLoopback("udp", "127.0.0.1:5060", "192.0.2.1:5060")
+
+	// Messages are sent with the transport without transport callback
+	options := parseTestMessage(t, strings.Replace(testInvite, "INVITE", "OPTIONS", -1))
+	if _, err := stack.StartClientTrans(options, loopback, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {}); err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	sent := receive(t, loopback.sent)
+	if sent == options || sent.Request == nil || sent.Request.Method != Options {
+		t.Fatalf("sent %v, want a copy of the request", sent.Startline)
+	}
+
+	loopback.Close()
+	if err := loopback.Send(options); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Send() once closed error = %v, want ErrTransportClosed", err)
+	}
+}
+
+func TestStackEventLoop(t *testing.T) {
+	loop := NewEventLoop(2)
+	defer loop.Close()
+	stack := NewStack()
+	stack.SetEventLoop(loop)
+
+	sent := make(chan *SIPMessage, 10)
+	send := func(_ Transport, msg *SIPMessage) error { sent <- msg; return nil }
+	terms := make(chan error, 2)
+	term := func(_ TransID, err error) { terms <- err }
+
+	invite := parseTestMessage(t, testInvite)
+	ist, err := stack.StartServerTrans(invite, NewLoopback("udp", "", ""), func(Transport, *SIPMessage) {}, send, term)
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+	ict, err := stack.StartClientTrans(invite, NewLoopback("udp", "", ""), func(Transport, *SIPMessage) {}, send, term)
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+	if msg := <-sent; msg != invite {
+		t.Fatalf("client transaction sent %v, want the INVITE", msg.Startline)
+	}
+
+	ringing := makeGenericResponse(180, []byte("Ringing"), invite)
+	ist.Event(ringing)
+	if msg := <-sent; msg != ringing {
+		t.Fatalf("server transaction sent %v, want the 180", msg.Startline)
+	}
+	ict.Event(ringing)
+
+	deadline := time.Now().Add(time.Second)
+	for ict.Snapshot().State != Proceeding && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if state := ict.Snapshot().State; state != Proceeding {
+		t.Fatalf("client transaction state = %v, want %v", state, Proceeding)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := stack.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-terms; !errors.Is(err, ErrShutdown) {
+			t.Errorf("termination error = %v, want %v", err, ErrShutdown)
+		}
+	}
+	if n := stack.Len(); n != 0 {
+		t.Errorf("Len() = %d after shutdown, want 0", n)
+	}
+}
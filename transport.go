@@ -1,12 +1,411 @@
 package sip
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-type SIPTransport struct {
-	Conn       net.Conn
-	Protocol   string
-	LocalAddr  string
-	RemoteAddr string
+// Transport sends messages to a remote address: from a UDP socket, over a
+// connection, or over anything else such as a Loopback in tests. The
+// transports of a TransportLayer are given to its handler with the messages
+// they received, and created by TransportLayer.Transport to send requests.
+type Transport interface {
+	Send(msg *SIPMessage) error
+	LocalAddr() string  // Local address, empty until known
+	RemoteAddr() string // Remote address, host:port
+	Protocol() string   // Transport protocol in lower case, such as udp or tls
+	Reliable() bool     // Connection oriented, the messages need no retransmission
+	Secure() bool       // TLS, for SIPS
+	Close() error
+}
+
+// Destination is where to send a request: the transport protocol, the
+// address of the server and the SIP domain a TLS server is validated against,
+// the host of Addr if empty
+type Destination struct {
+	Protocol string
+	Addr     string
+	Domain   string
+}
+
+// URIDestination returns the destination of a URI, TLS for a SIPS URI, to the
+// host and port of the URI or the default port of the transport
+func URIDestination(uri SIPUri) Destination {
+	protocol := uri.Transport()
+	host := strings.Trim(string(uri.Domain), "[]") // IPv6 references
+	port := uri.Port
+	if port == -1 {
+		port = defaultPort(protocol)
+	}
+	return Destination{
+		Protocol: protocol,
+		Addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		Domain:   host,
+	}
+}
+
+/*
+	RFC 3261 18.2.2
+		o  If the "sent-protocol" is a reliable transport protocol such as
+		   TCP or SCTP, or TLS over those, the response MUST be sent using
+		   the existing connection to the source of the original request
+		   that created the transaction, if that connection is still open.
+		   [...] If that connection is no longer open, the server SHOULD open
+		   a connection to the IP address in the "received" parameter, if
+		   present, using the port in the "sent-by" value, or the default
+		   port for that transport, if no port is specified.
+
+		o  Otherwise, if the Via header field value contains a "maddr"
+		   parameter, the response MUST be forwarded to the address listed
+		   there, using the port indicated in "sent-by", or port 5060 if
+		   none is present.
+
+		o  Otherwise (for unreliable unicast transports), if the top Via
+		   has a "received" parameter, the response MUST be sent to the
+		   address in the "received" parameter, using the port indicated in
+		   the "sent-by" value, or using port 5060 if none is specified
+		   explicitly.
+
+		o  Otherwise, if it is not receiver-tagged, the response MUST be
+		   sent to the address indicated by the "sent-by" value, using the
+		   procedures in Section 5 of [4].
+
+	RFC 3581 4
+		If the "sent-protocol" component indicates an unreliable unicast
+		transport protocol, such as UDP, and there is no "maddr" parameter,
+		but there is both a "received" parameter and an "rport" parameter,
+		the response MUST be sent to the IP address listed in the "received"
+		parameter, and the port in the "rport" parameter.  The response MUST
+		be sent from the same address and port that the corresponding
+		request was received on.
+*/
+// ResponseTransport returns the transport to send the responses of a request
+// with, from the top Via of the request and the transport of a TransportLayer
+// it was received on. Responses go over the connection or from the socket the
+// request was received on, the remote address is the one to connect to once
+// the connection is closed. Other transports are returned as they are.
+func ResponseTransport(via SIPVia, received Transport) Transport {
+	t, ok := received.(interface{ withRemoteAddr(string) Transport })
+	if !ok {
+		return received
+	}
+	protocol := received.Protocol()
+
+	host := strings.Trim(string(via.Domain), "[]")
+	recv, hasReceived := via.Param("received")
+	if hasReceived && len(recv) > 0 {
+		host = string(recv)
+	}
+	port := via.Port
+	if port == -1 {
+		port = defaultPort(protocol)
+	}
+
+	if !received.Reliable() {
+		maddr, hasMaddr := via.Param("maddr")
+		rport, _ := via.Param("rport")
+		if n, err := strconv.Atoi(string(rport)); hasMaddr && len(maddr) > 0 {
+			host = strings.Trim(string(maddr), "[]")
+		} else if hasReceived && err == nil {
+			port = n
+		}
+	}
+	return t.withRemoteAddr(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// reliable reports whether a transport is connection oriented
+func reliable(protocol string) bool {
+	switch strings.ToLower(protocol) {
+	case "tcp", "tls", "ws", "wss", "sctp":
+		return true
+	}
+	return false
+}
+
+// How long resolved addresses are cached
+const addr_cache_ttl = 5 * time.Minute
+
+// DefaultIdleTimeout is the time after which a connection that neither sent nor
+// received anything is closed
+const DefaultIdleTimeout = 2 * time.Minute
+
+// DefaultMTU is the path MTU assumed when it is unknown
+const DefaultMTU = 1500
+
+// Margin kept under the path MTU for requests sent over UDP (RFC 3261 18.1.1)
+const mtu_margin = 200
+
+var (
+	// ErrTransportClosed is returned when sending through a closed transport layer
+	ErrTransportClosed = errors.New("transport layer is closed")
+	// ErrConnectionClosed is reported to the transactions of a connection closed by the remote end
+	ErrConnectionClosed = errors.New("connection closed by the remote end")
+	// ErrUnsupportedTransport is returned for a destination of an unknown transport protocol
+	ErrUnsupportedTransport = errors.New("unsupported transport protocol")
+)
+
+// TransportLayer owns the listening sockets. It parses the messages it
+// receives, passes the ones matching a transaction to the transaction layer
+// and the others to the handler. Messages are sent with its transports: the
+// ones of the received messages, or the ones of Transport.
+type TransportLayer struct {
+	Options     ParseOptions  // Options of ParseSipMessage for received messages
+	IdleTimeout time.Duration // Idle time after which connections are closed, never if zero
+	TLSConfig   *tls.Config   // Certificates and trusted CAs of the TLS transport, mutual TLS with ClientAuth
+	WSPath      string        // Path requested by WebSocket clients, "/" if empty
+	MTU         int           // Path MTU, larger requests than MTU-200 bytes are sent over TCP instead of UDP, never if zero
+
+	KeepAliveTimeout time.Duration // Time to wait for the answer to a keep-alive, DefaultKeepAliveTimeout if zero
+
+	stack   *Stack
+	handler func(*SIPMessage, Transport)
+	addrs   *addrCache
+
+	flow_key []byte // Key of the flow tokens
+
+	mu        sync.Mutex
+	udp       []*net.UDPConn
+	listeners []streamListener
+	conns     map[connKey]*streamConn        // Connections by remote address, accepted or dialed
+	stun      map[[12]byte]chan *stunMessage // Responses to the STUN Binding requests sent, by transaction ID
+	closed    bool
+	wg        sync.WaitGroup // Read and accept loops
+}
+
+// NewTransportLayer creates a transport layer without listeners. The handler
+// is called in a goroutine of its own for every received message that does not
+// match a transaction of the stack.
+func NewTransportLayer(stack *Stack, handler func(*SIPMessage, Transport)) *TransportLayer {
+	flow_key := make([]byte, 32)
+	rand.Read(flow_key)
+	return &TransportLayer{
+		Options: ParseOptions{
+			ParseFrom:       true,
+			ParseTo:         true,
+			ParseCallID:     true,
+			ParseCseq:       true,
+			ParseTopMostVia: true,
+		},
+		IdleTimeout:      DefaultIdleTimeout,
+		MTU:              DefaultMTU,
+		KeepAliveTimeout: DefaultKeepAliveTimeout,
+		stack:            stack,
+		handler:          handler,
+		addrs:            newAddrCache(addr_cache_ttl),
+		flow_key:         flow_key,
+		conns:            make(map[connKey]*streamConn),
+		stun:             make(map[[12]byte]chan *stunMessage),
+	}
+}
+
+// receive parses a message and dispatches it, data must not be reused
+func (tl *TransportLayer) receive(data []byte, transport Transport) {
+	msg, err := ParseSipMessage(data, tl.Options)
+	if err != nil { // RFC 3261 18.3: malformed datagrams are discarded
+		return
+	}
+	if msg.Request != nil {
+		stampVia(msg, transport)
+	}
+
+	if trans := tl.stack.FindTrans(msg); trans != nil {
+		trans.Event(msg)
+		return
+	}
+	go tl.handler(msg, transport)
+}
+
+/*
+	RFC 3261 18.2.1
+		When the server transport receives a request over any transport, it
+		MUST examine the value of the "sent-by" parameter in the top Via
+		header field value.  If the host portion of the "sent-by" field
+		contains a domain name, or if it contains an IP address that differs
+		from the packet source address, the server MUST add a "received"
+		parameter to that Via header field value.
+
+	RFC 3581 4
+		If this Via header field value contains an "rport" parameter
+		with no value, it MUST set the value of the parameter to the source
+		port of the request.  [...] In fact, the server MUST insert a
+		"received" parameter containing the source IP address that the
+		request came from, even if it is identical to the value of the
+		"sent-by" component.
+*/
+// stampVia adds the received and rport parameters to the top Via of a request
+func stampVia(msg *SIPMessage, transport Transport) {
+	src, err := netip.ParseAddrPort(transport.RemoteAddr())
+	if err != nil {
+		return
+	}
+	via, err := msg.topVia()
+	if err != nil {
+		return
+	}
+
+	rport, hasRport := via.Param("rport")
+	host, err := netip.ParseAddr(strings.Trim(string(via.Domain), "[]"))
+	if !hasRport && err == nil && host.Unmap() == src.Addr().Unmap() {
+		return
+	}
+	via.SetParam("received", []byte(src.Addr().Unmap().String()))
+	if hasRport && len(rport) == 0 {
+		via.SetParam("rport", strconv.AppendUint(nil, uint64(src.Port()), 10))
+	}
+	msg.setTopVia(via)
+}
+
+// Transport returns the transport to send requests to a destination with.
+// Stream transports reuse the connection to the address, and open one when a
+// message is sent if there is none.
+func (tl *TransportLayer) Transport(dest Destination) (Transport, error) {
+	protocol := strings.ToLower(dest.Protocol)
+	switch protocol {
+	case "udp", "":
+		return &UDPTransport{layer: tl, raddr: dest.Addr}, nil
+	case "tcp", "tls", "ws", "wss":
+		return tl.streamTransport(protocol, dest.Addr, dest.Domain, nil), nil
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedTransport, dest.Protocol)
+	}
+}
+
+// Transports returns the transports of destinations, such as the ones of
+// Resolve for StartClientTransFailover, but for the unsupported ones
+func (tl *TransportLayer) Transports(dests []Destination) []Transport {
+	var transports []Transport
+	for _, dest := range dests {
+		if t, err := tl.Transport(dest); err == nil {
+			transports = append(transports, t)
+		}
+	}
+	return transports
+}
+
+// Close closes every listener and connection and waits for the read loops to exit
+func (tl *TransportLayer) Close() error {
+	tl.mu.Lock()
+	tl.closed = true
+	var errs []error
+	for _, conn := range tl.udp {
+		errs = append(errs, conn.Close())
+	}
+	for _, ln := range tl.listeners {
+		errs = append(errs, ln.Close())
+	}
+	for _, sc := range tl.conns {
+		sc.Close()
+	}
+	tl.mu.Unlock()
+
+	tl.wg.Wait()
+	return errors.Join(errs...)
+}
+
+/*
+	RFC 3261 18.1.1
+		If a request is within 200 bytes of the path MTU, or if it is larger
+		than 1300 bytes and the path MTU is unknown, the request MUST be sent
+		using an RFC 2914 [43] congestion controlled transport protocol, such
+		as TCP.  If this causes a change in the transport protocol from the
+		one indicated in the top Via, the value in the top Via MUST be
+		changed.
+	[...]
+		If an element sends a request over TCP because of these message size
+		constraints, and that request would have otherwise been sent over
+		UDP, if the attempt to establish the connection generates either an
+		ICMP Protocol Not Supported, or results in a TCP reset, the element
+		SHOULD retry the request, using UDP.
+*/
+// requestTransport returns the transport a client transaction sends its request
+// with, and the request with its top Via matching it. Transports may switch to
+// another protocol for the whole transaction, as UDPTransport does for large
+// requests.
+func requestTransport(msg *SIPMessage, transport Transport) (Transport, *SIPMessage) {
+	if t, ok := transport.(interface {
+		forRequest(*SIPMessage) (Transport, *SIPMessage)
+	}); ok {
+		return t.forRequest(msg)
+	}
+	return transport, msg
+}
+
+// SendRequest sends a request outside of any transaction, as a stateless proxy
+// does, switching to another protocol as client transactions do.
+func SendRequest(transport Transport, msg *SIPMessage) error {
+	transport, msg = requestTransport(msg, transport)
+	return transport.Send(msg)
+}
+
+// withViaTransport returns a copy of a message whose top Via has another
+// transport, the message itself is unchanged
+func withViaTransport(msg *SIPMessage, protocol string) *SIPMessage {
+	cp := *msg
+	via, err := msg.topVia()
+	if err != nil {
+		return &cp
+	}
+	via.Tranport = protocol
+	cp.Headers = maps.Clone(msg.Headers)
+	cp.setTopVia(via)
+	return &cp
+}
+
+// addrCache keeps resolved addresses so that sending does not resolve the
+// destination of every message
+type addrCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]addrEntry
+}
+
+type addrEntry struct {
+	addr    netip.AddrPort
+	expires time.Time
+}
+
+func newAddrCache(ttl time.Duration) *addrCache {
+	return &addrCache{ttl: ttl, entries: make(map[string]addrEntry)}
+}
+
+// resolve returns the address of host:port, from the cache unless host is an
+// IP address, which needs no resolution and is not cached
+func (c *addrCache) resolve(addr string) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return unmap(ap), nil
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[addr]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addr, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ap := unmap(raddr.AddrPort())
+
+	c.mu.Lock()
+	c.entries[addr] = addrEntry{addr: ap, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return ap, nil
+}
+
+// unmap turns IPv4-mapped IPv6 addresses, as seen on dual-stack sockets, into IPv4 ones
+func unmap(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
 }
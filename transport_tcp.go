@@ -0,0 +1,404 @@
+package sip
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time limits of connecting and of writing a message on a connection
+const (
+	dial_timeout  = 5 * time.Second
+	write_timeout = 10 * time.Second
+)
+
+// connKey identifies a connection in the connection table
+type connKey struct {
+	protocol string
+	raddr    netip.AddrPort
+}
+
+// streamListener is a listener of a stream transport
+type streamListener struct {
+	net.Listener
+	protocol string
+}
+
+// streamConn is a connection of a stream transport, accepted or dialed
+type streamConn struct {
+	net.Conn
+	key connKey
+
+	domains []string // SIP domains of the TLS peer, validated for dialed connections
+
+	pong   chan struct{} // Pongs received, for the keep-alives sent
+	pinged atomic.Bool   // Keep-alives were sent, the CRLFs received are pongs
+
+	wmu    sync.Mutex   // Serializes the messages written
+	last   atomic.Int64 // Unix time in nanoseconds of the last message sent or received
+	closed atomic.Bool  // Closed by this end, for idleness or by Close
+}
+
+func newStreamConn(conn net.Conn, protocol string) *streamConn {
+	sc := &streamConn{Conn: conn, key: connKey{protocol: protocol}, pong: make(chan struct{}, 1)}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		sc.key.raddr = unmap(addr.AddrPort())
+	}
+	sc.touch()
+	return sc
+}
+
+func (sc *streamConn) touch() {
+	sc.last.Store(time.Now().UnixNano())
+}
+
+// idle_deadline returns when the connection becomes idle, zero if never
+func (sc *streamConn) idle_deadline(idle time.Duration) time.Time {
+	if idle <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, sc.last.Load()).Add(idle)
+}
+
+// write sends a whole message, messages of concurrent writers are not interleaved
+func (sc *streamConn) write(data []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.SetWriteDeadline(time.Now().Add(write_timeout))
+	if _, err := sc.Conn.Write(data); err != nil {
+		return err
+	}
+	sc.touch()
+	return nil
+}
+
+func (sc *streamConn) Close() error {
+	sc.closed.Store(true)
+	return sc.Conn.Close()
+}
+
+// streamTransport sends messages over a connection of a transport layer to a
+// remote address, the part shared by TCPTransport, TLSTransport and WSTransport
+type streamTransport struct {
+	layer    *TransportLayer
+	protocol string
+	raddr    string
+	domain   string      // SIP domain the TLS peer is validated against, the host of raddr if empty
+	conn     *streamConn // Connection a request was received on, nil to look up the table
+}
+
+// TCPTransport sends messages over a TCP connection of a transport layer
+type TCPTransport struct{ streamTransport }
+
+// streamTransport returns the transport of a stream protocol to an address,
+// over a connection if not nil
+func (tl *TransportLayer) streamTransport(protocol, raddr, domain string, sc *streamConn) Transport {
+	t := streamTransport{layer: tl, protocol: protocol, raddr: raddr, domain: domain, conn: sc}
+	switch protocol {
+	case "tls":
+		return &TLSTransport{t}
+	case "ws", "wss":
+		return &WSTransport{t}
+	default:
+		return &TCPTransport{t}
+	}
+}
+
+func (t *streamTransport) base() *streamTransport { return t }
+
+// Send sends a message over the connection of the transport, which is the one
+// the request came from for a response. A connection is opened to the remote
+// address if there is none.
+func (t *streamTransport) Send(msg *SIPMessage) error {
+	return t.send(msg.Serialize())
+}
+
+// LocalAddr returns the address of the connection, empty until it is opened
+func (t *streamTransport) LocalAddr() string {
+	sc := t.connection()
+	if sc == nil {
+		return ""
+	}
+	return sc.LocalAddr().String()
+}
+
+func (t *streamTransport) RemoteAddr() string { return t.raddr }
+func (t *streamTransport) Protocol() string   { return t.protocol }
+func (t *streamTransport) Reliable() bool     { return true }
+func (t *streamTransport) Secure() bool       { return t.protocol == "tls" || t.protocol == "wss" }
+
+// Domain returns the SIP domain a TLS peer is validated against
+func (t *streamTransport) Domain() string {
+	return tlsDomain(t)
+}
+
+// Close closes the connection of the transport, if any
+func (t *streamTransport) Close() error {
+	sc := t.connection()
+	if sc == nil {
+		return nil
+	}
+	t.layer.drop(sc, nil)
+	return nil
+}
+
+func (t *streamTransport) withRemoteAddr(raddr string) Transport {
+	return t.layer.streamTransport(t.protocol, raddr, t.domain, t.conn)
+}
+
+// connection returns the connection of the transport while it is open, else
+// the one to its remote address from the table, nil if there is none
+func (t *streamTransport) connection() *streamConn {
+	if t.conn != nil && !t.conn.closed.Load() {
+		return t.conn
+	}
+	key, err := t.key()
+	if err != nil {
+		return nil
+	}
+	t.layer.mu.Lock()
+	defer t.layer.mu.Unlock()
+	return t.layer.conns[key]
+}
+
+// key returns the key of the connection to the remote address
+func (t *streamTransport) key() (connKey, error) {
+	raddr, err := t.layer.addrs.resolve(t.raddr)
+	return connKey{protocol: t.protocol, raddr: raddr}, err
+}
+
+// ListenTCP starts accepting TCP connections on an address, such as
+// "0.0.0.0:5060". It can be called several times to listen on several addresses.
+func (tl *TransportLayer) ListenTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return tl.listen(ln, "tcp", func() { tl.accept(ln, "tcp") })
+}
+
+// TCPAddrs returns the local addresses of the TCP listeners
+func (tl *TransportLayer) TCPAddrs() []net.Addr {
+	return tl.listenerAddrs("tcp")
+}
+
+// listen adds a listener of a stream transport and runs its accept loop
+func (tl *TransportLayer) listen(ln net.Listener, protocol string, run func()) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.closed {
+		ln.Close()
+		return ErrTransportClosed
+	}
+	tl.listeners = append(tl.listeners, streamListener{Listener: ln, protocol: protocol})
+
+	tl.wg.Add(1)
+	go func() {
+		defer tl.wg.Done()
+		run()
+	}()
+	return nil
+}
+
+// listenerAddrs returns the local addresses of the listeners of a stream transport
+func (tl *TransportLayer) listenerAddrs(protocol string) []net.Addr {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var addrs []net.Addr
+	for _, ln := range tl.listeners {
+		if ln.protocol == protocol {
+			addrs = append(addrs, ln.Addr())
+		}
+	}
+	return addrs
+}
+
+// accept serves the connections of a listener until it is closed
+func (tl *TransportLayer) accept(ln net.Listener, protocol string) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		tl.serve(newStreamConn(conn, protocol))
+	}
+}
+
+// serve adds a connection to the connection table and reads its messages in a
+// goroutine of its own
+func (tl *TransportLayer) serve(sc *streamConn) bool {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.closed {
+		sc.Close()
+		return false
+	}
+	// A newer connection to the same address replaces the former one for sending
+	tl.conns[sc.key] = sc
+
+	tl.wg.Add(1)
+	go func() {
+		defer tl.wg.Done()
+		tl.drop(sc, tl.readStream(sc))
+	}()
+	return true
+}
+
+// readStream receives the messages of a connection until it fails or is idle,
+// it returns nil if the connection was closed by this end
+func (tl *TransportLayer) readStream(sc *streamConn) error {
+	f := newFramer()
+	f.pongs = sc.pinged.Load
+	next := func() ([]byte, error) { return f.next(sc) }
+	if ws, ok := sc.Conn.(*wsConn); ok {
+		next = ws.readMessage // One message per WebSocket message
+	}
+	transport := tl.streamTransport(sc.key.protocol, sc.key.raddr.String(), "", sc)
+
+	for {
+		sc.SetReadDeadline(sc.idle_deadline(tl.IdleTimeout))
+		data, err := next()
+		if sc.closed.Load() {
+			return nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if time.Now().Before(sc.idle_deadline(tl.IdleTimeout)) {
+				continue // A message was sent in the meantime
+			}
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return ErrConnectionClosed
+		}
+		if err != nil {
+			return err
+		}
+
+		sc.touch()
+		if isKeepAlive(data) {
+			tl.keepAlive(sc, data)
+			continue
+		}
+		tl.receive(data, transport)
+	}
+}
+
+// drop removes a connection from the table and closes it, the client
+// transactions waiting for a response on it fail if it was not closed by this end
+func (tl *TransportLayer) drop(sc *streamConn, err error) {
+	tl.mu.Lock()
+	if tl.conns[sc.key] == sc {
+		delete(tl.conns, sc.key)
+	}
+	tl.mu.Unlock()
+	sc.Close()
+
+	if err != nil {
+		tl.stack.conn_failed(func(transport Transport) bool {
+			t, ok := transport.(interface{ base() *streamTransport })
+			if !ok || t.base().layer != tl {
+				return false
+			}
+			key, kerr := t.base().key()
+			return kerr == nil && key == sc.key
+		}, err)
+	}
+}
+
+/*
+	RFC 3261 18.2.2
+		If the "sent-protocol" is a reliable transport protocol such as
+		TCP or SCTP, or TLS over those, the response MUST be sent using
+		the existing connection to the source of the original request
+		that created the transaction, if that connection is still open.
+		This requires the server transport to maintain an association
+		between server transactions and transport connections.  If that
+		connection is no longer open, the server SHOULD open a
+		connection to the IP address in the "received" parameter, if
+		present, using the port in the "sent-by" value, or the default
+		port for that transport, if no port is specified.
+*/
+// send writes a message over the connection of the transport, or over a new
+// connection to its remote address
+func (t *streamTransport) send(data []byte) error {
+	sc, err := t.open()
+	if err != nil {
+		return err
+	}
+	if err := sc.write(data); err != nil {
+		sc.Close()
+		return err
+	}
+	return nil
+}
+
+// open returns the connection to send over, which is dialed if there is none
+func (t *streamTransport) open() (*streamConn, error) {
+	tl := t.layer
+	// Responses go over the connection of their request while it is open
+	if sc := t.conn; sc != nil && !sc.closed.Load() {
+		return sc, nil
+	}
+	key, err := t.key()
+	if err != nil {
+		return nil, err
+	}
+
+	tl.mu.Lock()
+	if tl.closed {
+		tl.mu.Unlock()
+		return nil, ErrTransportClosed
+	}
+	sc := tl.conns[key]
+	tl.mu.Unlock()
+
+	// Requests to a SIP domain only reuse connections validated for it
+	if sc != nil && t.domain != "" && t.Secure() && !slices.Contains(sc.domains, strings.ToLower(t.domain)) {
+		sc = nil
+	}
+	if sc == nil {
+		return tl.dial(key, tlsDomain(t))
+	}
+	return sc, nil
+}
+
+// dial opens a connection and reads the messages it receives, such as the
+// responses to the requests sent over it. A TLS peer must be authenticated for
+// the domain.
+func (tl *TransportLayer) dial(key connKey, domain string) (*streamConn, error) {
+	conn, err := net.DialTimeout("tcp", key.raddr.String(), dial_timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []string
+	if key.protocol == "tls" || key.protocol == "wss" {
+		if conn, err = tl.handshake(conn, domain); err != nil {
+			return nil, err
+		}
+		domains = []string{domain}
+	}
+	if key.protocol == "ws" || key.protocol == "wss" {
+		if conn, err = tl.upgrade(conn, domain); err != nil {
+			return nil, err
+		}
+	}
+
+	sc := newStreamConn(conn, key.protocol)
+	sc.key = key
+	sc.domains = domains
+	if !tl.serve(sc) {
+		return nil, ErrTransportClosed
+	}
+	return sc, nil
+}
@@ -0,0 +1,737 @@
+package sip
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testOptions = "OPTIONS sip:bob@example.com SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bKopt1;rport\r\n" +
+	"From: Alice <sip:alice@example.com>;tag=1928301774\r\n" +
+	"To: Bob <sip:bob@example.com>\r\n" +
+	"Call-ID: opt@pc33.example.com\r\n" +
+	"CSeq: 1 OPTIONS\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+// testTransport returns the transport of a transport layer to a destination
+func testTransport(t *testing.T, tl *TransportLayer, dest Destination) Transport {
+	t.Helper()
+	transport, err := tl.Transport(dest)
+	if err != nil {
+		t.Fatalf("Transport(%+v) error = %v", dest, err)
+	}
+	return transport
+}
+
+// newTestLayer listens on addr and queues the messages passed to the handler
+func newTestLayer(t *testing.T, network, addr string, handler func(*TransportLayer, *SIPMessage, Transport)) (*TransportLayer, *Stack) {
+	return newTestTLSLayer(t, network, addr, nil, handler)
+}
+
+// newTestTLSLayer is newTestLayer with a TLS configuration
+func newTestTLSLayer(t *testing.T, network, addr string, config *tls.Config, handler func(*TransportLayer, *SIPMessage, Transport)) (*TransportLayer, *Stack) {
+	t.Helper()
+	stack := NewStack()
+	var tl *TransportLayer
+	tl = NewTransportLayer(stack, func(msg *SIPMessage, transport Transport) { handler(tl, msg, transport) })
+	tl.TLSConfig = config
+
+	var err error
+	switch network {
+	case "udp":
+		err = tl.ListenUDP(addr)
+	case "tcp":
+		err = tl.ListenTCP(addr)
+	case "tls":
+		err = tl.ListenTLS(addr)
+	}
+	if err != nil {
+		t.Skipf("cannot listen on %s %s: %v", network, addr, err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		stack.Shutdown(ctx)
+		tl.Close()
+	})
+	return tl, stack
+}
+
+func queueHandler(c chan *SIPMessage) func(*TransportLayer, *SIPMessage, Transport) {
+	return func(_ *TransportLayer, msg *SIPMessage, _ Transport) { c <- msg }
+}
+
+func receive(t *testing.T, c chan *SIPMessage) *SIPMessage {
+	t.Helper()
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no message received")
+		return nil
+	}
+}
+
+func TestUDPTransportLargeMessage(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(addr, func(t *testing.T) {
+			received := make(chan *SIPMessage, 1)
+			server, _ := newTestLayer(t, "udp", addr, queueHandler(received))
+			client, _ := newTestLayer(t, "udp", addr, queueHandler(make(chan *SIPMessage, 1)))
+
+			// Larger than the 1 KB buffer of the old read loop
+			body := bytes.Repeat([]byte("v=0\r\n"), 1000)
+			msg := parseTestMessage(t, strings.Replace(testOptions, "Content-Length: 0", "Content-Length: 5000", 1)+string(body))
+
+			dest := testTransport(t, client, Destination{Protocol: "udp", Addr: server.UDPAddrs()[0].String()})
+			if err := dest.Send(msg); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+
+			got := receive(t, received)
+			if !bytes.Equal(got.Body, body) {
+				t.Errorf("received a body of %d bytes, want %d", len(got.Body), len(body))
+			}
+		})
+	}
+}
+
+func TestSendRequestSwitchesToTCP(t *testing.T) {
+	for _, tcp := range []bool{true, false} {
+		t.Run(fmt.Sprintf("tcp=%v", tcp), func(t *testing.T) {
+			received := make(chan Transport, 1)
+			vias := make(chan SIPVia, 1)
+			server, _ := newTestLayer(t, "udp", "127.0.0.1:0", func(_ *TransportLayer, msg *SIPMessage, transport Transport) {
+				vias <- msg.TopmostVia
+				received <- transport
+			})
+			addr := server.UDPAddrs()[0].String()
+			if tcp {
+				if err := server.ListenTCP(addr); err != nil {
+					t.Skipf("cannot listen on tcp %s: %v", addr, err)
+				}
+			}
+			client, _ := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+
+			body := bytes.Repeat([]byte("a=x\r\n"), 360) // 1800 bytes, over 1300
+			msg := parseTestMessage(t, strings.Replace(testOptions, "Content-Length: 0", "Content-Length: 1800", 1)+string(body))
+			if err := SendRequest(testTransport(t, client, Destination{Protocol: "udp", Addr: addr}), msg); err != nil {
+				t.Fatalf("SendRequest() error = %v", err)
+			}
+
+			want := "udp"
+			if tcp {
+				want = "tcp"
+			}
+			select {
+			case transport := <-received:
+				if transport.Protocol() != want {
+					t.Errorf("received over %s, want %s", transport.Protocol(), want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("no message received")
+			}
+			if via := <-vias; via.Tranport != want {
+				t.Errorf("top Via transport = %q, want %q", via.Tranport, want)
+			}
+			if msg.TopmostVia.Tranport != "udp" {
+				t.Errorf("SendRequest() changed the top Via of the request to %q", msg.TopmostVia.Tranport)
+			}
+		})
+	}
+}
+
+func TestClientTransactionSwitchesToTCP(t *testing.T) {
+	type request struct {
+		msg       *SIPMessage
+		transport Transport
+	}
+	requests := make(chan request, 10)
+	server, _ := newTestLayer(t, "udp", "127.0.0.1:0", func(_ *TransportLayer, msg *SIPMessage, transport Transport) {
+		requests <- request{msg, transport}
+	})
+	addr := server.UDPAddrs()[0].String()
+	if err := server.ListenTCP(addr); err != nil {
+		t.Skipf("cannot listen on tcp %s: %v", addr, err)
+	}
+	responses := make(chan *SIPMessage, 10)
+	client, stack := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+	clock := NewFakeClock()
+	stack.SetScheduler(clock)
+
+	body := bytes.Repeat([]byte("a=x\r\n"), 360) // 1800 bytes, over 1300
+	invite := parseTestMessage(t, strings.Replace(testInvite, "Content-Length: 0", "Content-Length: 1800", 1)+string(body))
+	trans, err := stack.StartClientTrans(invite, testTransport(t, client, Destination{Protocol: "udp", Addr: addr}),
+		func(_ Transport, msg *SIPMessage) { responses <- msg }, nil, func(TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+
+	first := <-requests
+	if first.transport.Protocol() != "tcp" || first.msg.TopmostVia.Tranport != "tcp" {
+		t.Fatalf("INVITE received over %s with a %s Via, want tcp", first.transport.Protocol(), first.msg.TopmostVia.Tranport)
+	}
+	// Timer A is not started over TCP
+	clock.Advance(2 * time.Second)
+	select {
+	case r := <-requests:
+		t.Fatalf("request retransmitted over %s", r.transport.Protocol())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The CANCEL uses the transport and the Via of the INVITE
+	ist, err := server.stack.StartServerTrans(first.msg, first.transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+	if err != nil {
+		t.Fatalf("StartServerTrans() error = %v", err)
+	}
+	ringing := makeGenericResponse(180, []byte("Ringing"), first.msg)
+	ringing.setToTag(GenerateTag())
+	ist.Event(ringing)
+	receive(t, responses)
+	trans.(*Ictrans).Cancel()
+	if cancel := <-requests; cancel.transport.Protocol() != "tcp" || cancel.msg.TopmostVia.Tranport != "tcp" {
+		t.Errorf("CANCEL received over %s with a %s Via, want tcp", cancel.transport.Protocol(), cancel.msg.TopmostVia.Tranport)
+	}
+}
+
+func TestWithViaTransportRewritesRawVia(t *testing.T) {
+	msg := parseTestMessage(t, testOptions)
+	msg.Headers[Via] = [][]byte{msg.TopmostVia.Serialize()}
+	msg.Options.ParseTopMostVia = false
+
+	got := withViaTransport(msg, "tcp")
+	if want := "SIP/2.0/TCP 127.0.0.1:5060;branch=z9hG4bKopt1;rport"; string(got.Headers[Via][0]) != want {
+		t.Errorf("top Via = %q, want %q", got.Headers[Via][0], want)
+	}
+	if !bytes.HasPrefix(msg.Headers[Via][0], []byte("SIP/2.0/UDP")) {
+		t.Errorf("the Via of the original message was changed to %q", msg.Headers[Via][0])
+	}
+}
+
+func TestUDPTransportPassesRetransmissionsToTransaction(t *testing.T) {
+	requests := make(chan *SIPMessage, 2)
+	server, _ := newTestLayer(t, "udp", "127.0.0.1:0", func(tl *TransportLayer, msg *SIPMessage, transport Transport) {
+		requests <- msg
+		trans, err := tl.stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+		if err == nil {
+			trans.Event(makeGenericResponse(200, []byte("OK"), msg))
+		}
+	})
+	responses := make(chan *SIPMessage, 2)
+	client, _ := newTestLayer(t, "udp", "127.0.0.1:0", queueHandler(responses))
+
+	dest := testTransport(t, client, Destination{Protocol: "udp", Addr: server.UDPAddrs()[0].String()})
+	options := parseTestMessage(t, testOptions)
+	for i := 0; i < 2; i++ {
+		if err := dest.Send(options); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+		if res := receive(t, responses); res.Response == nil || res.Response.StatusCode != 200 {
+			t.Fatalf("received %v, want 200", res.Startline)
+		}
+	}
+
+	receive(t, requests)
+	select {
+	case <-requests:
+		t.Errorf("retransmission passed to the handler instead of the transaction")
+	default:
+	}
+}
+
+func TestResponseTransport(t *testing.T) {
+	tl := NewTransportLayer(NewStack(), func(*SIPMessage, Transport) {})
+	udp := testTransport(t, tl, Destination{Protocol: "udp", Addr: "198.51.100.1:40000"})
+	tcp := testTransport(t, tl, Destination{Protocol: "tcp", Addr: "198.51.100.1:40000"})
+	tls := testTransport(t, tl, Destination{Protocol: "tls", Addr: "[2001:db8::2]:40000"})
+	loopback := NewLoopback("udp", "", "198.51.100.1:40000")
+	tests := []struct {
+		via      string
+		received Transport
+		want     string
+	}{
+		{"SIP/2.0/UDP 192.0.2.1:5070;branch=z9hG4bK1", udp, "192.0.2.1:5070"},
+		{"SIP/2.0/UDP pc.example.com;branch=z9hG4bK1", udp, "pc.example.com:5060"},
+		{"SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1;received=198.51.100.1", udp, "198.51.100.1:5060"},
+		{"SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1;received=198.51.100.1;rport=40000", udp, "198.51.100.1:40000"},
+		{"SIP/2.0/UDP 192.0.2.1:5070;branch=z9hG4bK1;maddr=239.255.255.1;received=198.51.100.1", udp, "239.255.255.1:5070"},
+		{"SIP/2.0/TCP 192.0.2.1;branch=z9hG4bK1;received=198.51.100.1;rport=40000", tcp, "198.51.100.1:5060"},
+		{"SIP/2.0/TLS [2001:db8::1];branch=z9hG4bK1", tls, "[2001:db8::1]:5061"},
+		{"SIP/2.0/UDP 192.0.2.1:5070;branch=z9hG4bK1", loopback, "198.51.100.1:40000"}, // Not a transport of a transport layer
+	}
+
+	for _, tt := range tests {
+		via, err := ParseSipVia([]byte(tt.via))
+		if err != nil {
+			t.Fatalf("ParseSipVia(%q) error = %v", tt.via, err)
+		}
+		if got := ResponseTransport(via, tt.received); got.RemoteAddr() != tt.want {
+			t.Errorf("ResponseTransport(%q) = %s, want %s", tt.via, got.RemoteAddr(), tt.want)
+		}
+	}
+}
+
+func TestReceivedRequestsAreStamped(t *testing.T) {
+	tests := []struct {
+		via  string
+		want string
+	}{
+		{"SIP/2.0/UDP 198.51.100.1:40000;branch=z9hG4bK1", "SIP/2.0/UDP 198.51.100.1:40000;branch=z9hG4bK1"},
+		{"SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK1;received=198.51.100.1"},
+		{"SIP/2.0/UDP pc.example.com;branch=z9hG4bK1", "SIP/2.0/UDP pc.example.com;branch=z9hG4bK1;received=198.51.100.1"},
+		{"SIP/2.0/UDP 198.51.100.1:40000;rport;branch=z9hG4bK1", "SIP/2.0/UDP 198.51.100.1:40000;branch=z9hG4bK1;received=198.51.100.1;rport=40000"},
+	}
+
+	for _, tt := range tests {
+		msg := parseTestMessage(t, strings.Replace(testOptions, "SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bKopt1;rport", tt.via, 1))
+		stampVia(msg, NewLoopback("udp", "", "198.51.100.1:40000"))
+		if got := string(msg.TopmostVia.Serialize()); got != tt.want {
+			t.Errorf("stampVia(%q) = %q, want %q", tt.via, got, tt.want)
+		}
+	}
+}
+
+func TestTCPResponseUsesRequestConnection(t *testing.T) {
+	server, _ := newTestLayer(t, "tcp", "127.0.0.1:0", func(tl *TransportLayer, msg *SIPMessage, transport Transport) {
+		trans, err := tl.stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+		if err == nil {
+			trans.Event(makeGenericResponse(200, []byte("OK"), msg))
+		}
+	})
+	responses := make(chan *SIPMessage, 1)
+	client, _ := newTestLayer(t, "", "", queueHandler(responses))
+
+	// The sent-by of the Via does not accept connections
+	dest := testTransport(t, client, Destination{Protocol: "tcp", Addr: server.TCPAddrs()[0].String()})
+	if err := dest.Send(parseTestMessage(t, testOptions)); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if res := receive(t, responses); res.Response == nil || res.Response.StatusCode != 200 {
+		t.Fatalf("received %v, want 200", res.Startline)
+	}
+}
+
+// chunkReader returns one chunk per Read
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestFramerSplitsStream(t *testing.T) {
+	withBody := strings.Replace(testOptions, "Content-Length: 0", "l: 4", 1) + "v=0\n"
+	stream := "\r\n\r\n" + testOptions + withBody + "\r\n" + testOptions
+	r := &chunkReader{}
+	for i := 0; i < len(stream); i += 7 {
+		r.chunks = append(r.chunks, stream[i:min(i+7, len(stream))])
+	}
+
+	f := newFramer()
+	for _, want := range []string{"\r\n\r\n", testOptions, withBody, "\r\n", testOptions} {
+		got, err := f.next(r)
+		if err != nil {
+			t.Fatalf("next() error = %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("next() = %q, want %q", got, want)
+		}
+	}
+	if _, err := f.next(r); err != io.EOF {
+		t.Errorf("next() at the end of the stream error = %v, want EOF", err)
+	}
+
+	// Pings split across reads are not taken for pongs, unless pongs are
+	// expected
+	for _, pongs := range []bool{false, true} {
+		r = &chunkReader{chunks: []string{"\r\n", "\r\n" + testOptions[:10], testOptions[10:], "\r\n\r", "\n"}}
+		f = newFramer()
+		f.pongs = func() bool { return pongs }
+		want := []string{"\r\n\r\n", testOptions, "\r\n\r\n"}
+		if pongs {
+			want = []string{"\r\n", "\r\n", testOptions, "\r\n\r\n"}
+		}
+		for _, want := range want {
+			got, err := f.next(r)
+			if err != nil {
+				t.Fatalf("next() error = %v", err)
+			}
+			if string(got) != want {
+				t.Errorf("next() with pongs %v = %q, want %q", pongs, got, want)
+			}
+		}
+	}
+
+	f = newFramer()
+	noLength := strings.Replace(testOptions, "Content-Length: 0\r\n", "", 1)
+	if _, err := f.next(strings.NewReader(noLength)); err != ErrMissingContentLength {
+		t.Errorf("next() error = %v, want ErrMissingContentLength", err)
+	}
+}
+
+// answerOK answers every request with a 200 through a server transaction
+func answerOK(requests chan Transport) func(*TransportLayer, *SIPMessage, Transport) {
+	return func(tl *TransportLayer, msg *SIPMessage, transport Transport) {
+		requests <- transport
+		trans, err := tl.stack.StartServerTrans(msg, transport, func(Transport, *SIPMessage) {}, nil, func(TransID, error) {})
+		if err == nil {
+			trans.Event(makeGenericResponse(200, []byte("OK"), msg))
+		}
+	}
+}
+
+func TestTCPTransportReusesConnection(t *testing.T) {
+	requests := make(chan Transport, 2)
+	server, _ := newTestLayer(t, "tcp", "127.0.0.1:0", answerOK(requests))
+	responses := make(chan *SIPMessage, 2)
+	client, _ := newTestLayer(t, "tcp", "127.0.0.1:0", queueHandler(responses))
+
+	dest := testTransport(t, client, Destination{Protocol: "tcp", Addr: server.TCPAddrs()[0].String()})
+	var from []string
+	for _, branch := range []string{"z9hG4bKtcp1", "z9hG4bKtcp2"} {
+		options := parseTestMessage(t, strings.Replace(testOptions, "z9hG4bKopt1", branch, 1))
+		if err := dest.Send(options); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+		// The response comes back over the connection of the request, not
+		// to a listener of the client
+		if res := receive(t, responses); res.Response == nil || res.Response.StatusCode != 200 {
+			t.Fatalf("received %v, want 200", res.Startline)
+		}
+		from = append(from, (<-requests).RemoteAddr())
+	}
+
+	if from[0] != from[1] {
+		t.Errorf("requests came from %v, want a single connection", from)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if n := len(client.conns); n != 1 {
+		t.Errorf("client has %d connections, want 1", n)
+	}
+}
+
+func TestTCPTransportClosesIdleConnection(t *testing.T) {
+	server, _ := newTestLayer(t, "tcp", "127.0.0.1:0", answerOK(make(chan Transport, 1)))
+	responses := make(chan *SIPMessage, 1)
+	client, _ := newTestLayer(t, "tcp", "127.0.0.1:0", queueHandler(responses))
+	client.IdleTimeout = 100 * time.Millisecond
+
+	dest := testTransport(t, client, Destination{Protocol: "tcp", Addr: server.TCPAddrs()[0].String()})
+	if err := dest.Send(parseTestMessage(t, testOptions)); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	receive(t, responses)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.mu.Lock()
+		n := len(client.conns)
+		client.mu.Unlock()
+		server.mu.Lock()
+		m := len(server.conns)
+		server.mu.Unlock()
+		if n == 0 && m == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d client and %d server connections left open", n, m)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPConnectionFailureTerminatesClientTransaction(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// Reads the request and closes the connection without answering
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Read(make([]byte, 1024))
+			conn.Close()
+		}
+	}()
+
+	client, stack := newTestLayer(t, "tcp", "127.0.0.1:0", queueHandler(make(chan *SIPMessage, 1)))
+	terminated := make(chan error, 1)
+	_, err = stack.StartClientTrans(parseTestMessage(t, testOptions), testTransport(t, client, Destination{Protocol: "tcp", Addr: ln.Addr().String()}),
+		func(Transport, *SIPMessage) {}, nil, func(_ TransID, err error) { terminated <- err })
+	if err != nil {
+		t.Fatalf("StartClientTrans() error = %v", err)
+	}
+
+	select {
+	case err := <-terminated:
+		if !errors.Is(err, ErrTransport) || !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("terminated with %v, want a transport error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("transaction not terminated by the closed connection")
+	}
+}
+
+// testCA issues the certificates of the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for a SIP domain, with DNS names as well
+func (ca *testCA) issue(t *testing.T, domain string, dns ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{{Scheme: "sip", Opaque: domain}},
+		DNSNames:     dns,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSTransportValidatesSIPDomain(t *testing.T) {
+	ca := newTestCA(t)
+	server, _ := newTestTLSLayer(t, "tls", "127.0.0.1:0",
+		&tls.Config{Certificates: []tls.Certificate{ca.issue(t, "example.com", "sip.example.net")}},
+		answerOK(make(chan Transport, 1)))
+	responses := make(chan *SIPMessage, 1)
+	client, _ := newTestTLSLayer(t, "", "", &tls.Config{RootCAs: ca.pool}, queueHandler(responses))
+
+	dest := testTransport(t, client, Destination{Protocol: "tls", Addr: server.TLSAddrs()[0].String(), Domain: "example.com"})
+	if err := dest.Send(parseTestMessage(t, testOptions)); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if res := receive(t, responses); res.Response == nil || res.Response.StatusCode != 200 {
+		t.Fatalf("received %v, want 200", res.Startline)
+	}
+
+	// The DNS name is not an identity of a certificate with a sip URI
+	dest = testTransport(t, client, Destination{Protocol: "tls", Addr: dest.RemoteAddr(), Domain: "sip.example.net"})
+	if err := dest.Send(parseTestMessage(t, testOptions)); !errors.Is(err, ErrCertificateDomain) {
+		t.Errorf("Send() to another domain error = %v, want ErrCertificateDomain", err)
+	}
+}
+
+func TestTLSTransportMutualAuth(t *testing.T) {
+	ca := newTestCA(t)
+	peers := make(chan []string, 1)
+	server, _ := newTestTLSLayer(t, "tls", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "example.com")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}, func(_ *TransportLayer, _ *SIPMessage, transport Transport) {
+		state := transport.(*TLSTransport).ConnectionState()
+		peers <- CertificateDomains(state.PeerCertificates[0])
+	})
+	client, _ := newTestTLSLayer(t, "", "", &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "carrier.example.org")},
+		RootCAs:      ca.pool,
+	}, queueHandler(make(chan *SIPMessage, 1)))
+
+	dest := testTransport(t, client, Destination{Protocol: "tls", Addr: server.TLSAddrs()[0].String(), Domain: "example.com"})
+	if err := dest.Send(parseTestMessage(t, testOptions)); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	select {
+	case domains := <-peers:
+		if !slices.Equal(domains, []string{"carrier.example.org"}) {
+			t.Errorf("client domains = %v, want carrier.example.org", domains)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("request not received")
+	}
+}
+
+func TestURIDestination(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want Destination
+	}{
+		{"sip:alice@example.com", Destination{Protocol: "udp", Addr: "example.com:5060", Domain: "example.com"}},
+		{"sips:alice@example.com", Destination{Protocol: "tls", Addr: "example.com:5061", Domain: "example.com"}},
+		{"sips:alice@example.com:5071;transport=tcp", Destination{Protocol: "tls", Addr: "example.com:5071", Domain: "example.com"}},
+		{"sip:alice@[::1];transport=TCP", Destination{Protocol: "tcp", Addr: "[::1]:5060", Domain: "::1"}},
+	}
+	for _, tt := range tests {
+		uri, err := ParseSipUri([]byte(tt.uri))
+		if err != nil {
+			t.Fatalf("ParseSipUri(%q) error = %v", tt.uri, err)
+		}
+		if got := URIDestination(uri); got != tt.want {
+			t.Errorf("URIDestination(%q) = %+v, want %+v", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	requests := make(chan Transport, 1)
+	server, _ := newTestLayer(t, "", "", answerOK(requests))
+	srv := httptest.NewServer(server.WebSocketHandler())
+	defer srv.Close()
+	responses := make(chan *SIPMessage, 1)
+	client, _ := newTestLayer(t, "", "", queueHandler(responses))
+
+	// Larger than a frame with a 16 bits length
+	body := bytes.Repeat([]byte("a=x\r\n"), 20000)
+	msg := parseTestMessage(t, strings.Replace(testOptions, "Content-Length: 0", "Content-Length: 100000", 1)+string(body))
+	dest := testTransport(t, client, Destination{Protocol: "ws", Addr: srv.Listener.Addr().String()})
+	if err := dest.Send(msg); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if res := receive(t, responses); res.Response == nil || res.Response.StatusCode != 200 {
+		t.Fatalf("received %v, want 200", res.Startline)
+	}
+	if transport := <-requests; transport.Protocol() != "ws" {
+		t.Errorf("request received over %q, want ws", transport.Protocol())
+	}
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	server := &wsConn{Conn: b}
+
+	// frame returns a masked client frame
+	frame := func(fin bool, op byte, payload string) []byte {
+		mask := []byte{1, 2, 3, 4}
+		f := []byte{op, 0x80 | byte(len(payload))}
+		if fin {
+			f[0] |= 0x80
+		}
+		f = append(f, mask...)
+		for i := range payload {
+			f = append(f, payload[i]^mask[i%4])
+		}
+		return f
+	}
+	go func() {
+		a.Write(frame(false, ws_text, "OPT"))
+		a.Write(frame(true, ws_ping, "hi"))
+		pong := make([]byte, 4)
+		io.ReadFull(a, pong)
+		if string(pong) != "\x8a\x02hi" {
+			t.Errorf("pong = %q", pong)
+		}
+		a.Write(frame(true, ws_continuation, "IONS"))
+		a.Write(frame(true, ws_close, "\x03\xe8"))
+		io.ReadFull(a, make([]byte, 4))
+	}()
+
+	msg, err := server.readMessage()
+	if err != nil || string(msg) != "OPTIONS" {
+		t.Errorf("readMessage() = %q, %v, want the reassembled fragments", msg, err)
+	}
+	if _, err := server.readMessage(); err != io.EOF {
+		t.Errorf("readMessage() after a close frame error = %v, want EOF", err)
+	}
+}
+
+func TestWebSocketRequiresSIPSubprotocol(t *testing.T) {
+	server, _ := newTestLayer(t, "", "", queueHandler(make(chan *SIPMessage, 1)))
+	srv := httptest.NewServer(server.WebSocketHandler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upgrade request error = %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("upgrade without the sip subprotocol answered %s, want 400", res.Status)
+	}
+}
+
+func TestViaWebSocketTransport(t *testing.T) {
+	raw := "SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bKasudf"
+	via, err := ParseSipVia([]byte(raw))
+	if err != nil {
+		t.Fatalf("ParseSipVia() error = %v", err)
+	}
+	if via.Tranport != "wss" {
+		t.Errorf("Tranport = %q, want wss", via.Tranport)
+	}
+	if got := string(via.Serialize()); got != raw {
+		t.Errorf("Serialize() = %q, want %q", got, raw)
+	}
+
+	uri, _ := ParseSipUri([]byte("sip:bob@example.com;transport=ws"))
+	if got := uri.Transport(); got != "ws" {
+		t.Errorf("Transport() = %q, want ws", got)
+	}
+	uri, _ = ParseSipUri([]byte("sips:bob@example.com;transport=ws"))
+	if got := uri.Transport(); got != "wss" {
+		t.Errorf("Transport() of a SIPS URI = %q, want wss", got)
+	}
+}
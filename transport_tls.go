@@ -0,0 +1,166 @@
+package sip
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrNoCertificate is returned by ListenTLS when TLSConfig has no certificate
+	ErrNoCertificate = errors.New("no TLS certificate configured")
+	// ErrCertificateDomain is the cause of a failed handshake with a peer whose
+	// certificate is not valid for the SIP domain
+	ErrCertificateDomain = errors.New("certificate does not match the SIP domain")
+)
+
+// TLSTransport sends messages over a TLS connection of a transport layer, to a
+// server authenticated for the SIP domain of the transport
+type TLSTransport struct{ streamTransport }
+
+// ConnectionState returns the state of the TLS connection of the transport,
+// such as the certificates of the peer, zero until the connection is opened
+func (t *TLSTransport) ConnectionState() tls.ConnectionState {
+	if sc := t.connection(); sc != nil {
+		if conn, ok := sc.Conn.(*tls.Conn); ok {
+			return conn.ConnectionState()
+		}
+	}
+	return tls.ConnectionState{}
+}
+
+// ListenTLS starts accepting TLS connections on an address, such as
+// "0.0.0.0:5061", with the certificates of TLSConfig. Clients are authenticated
+// as set by the ClientAuth and ClientCAs of TLSConfig.
+func (tl *TransportLayer) ListenTLS(addr string) error {
+	if tl.TLSConfig == nil || len(tl.TLSConfig.Certificates) == 0 && tl.TLSConfig.GetCertificate == nil {
+		return ErrNoCertificate
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ln = tls.NewListener(ln, tl.TLSConfig)
+	return tl.listen(ln, "tls", func() { tl.accept(ln, "tls") })
+}
+
+// TLSAddrs returns the local addresses of the TLS listeners
+func (tl *TransportLayer) TLSAddrs() []net.Addr {
+	return tl.listenerAddrs("tls")
+}
+
+// tlsDomain returns the domain a TLS peer is validated against
+func tlsDomain(t *streamTransport) string {
+	if t.domain != "" {
+		return strings.ToLower(t.domain)
+	}
+	host, _, err := net.SplitHostPort(t.raddr)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(host)
+}
+
+// handshake secures a dialed connection, the server must present a
+// certificate valid for the domain, which is also sent for SNI
+func (tl *TransportLayer) handshake(conn net.Conn, domain string) (net.Conn, error) {
+	config := &tls.Config{}
+	if tl.TLSConfig != nil {
+		config = tl.TLSConfig.Clone()
+	}
+	if net.ParseIP(domain) == nil {
+		config.ServerName = domain
+	}
+	if !config.InsecureSkipVerify {
+		// The chain is verified by verifySIPDomain, which matches the SIP
+		// domain instead of the host name
+		roots, verify := config.RootCAs, config.VerifyConnection
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := verifySIPDomain(cs, roots, domain); err != nil {
+				return err
+			}
+			if verify != nil {
+				return verify(cs)
+			}
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dial_timeout)
+	defer cancel()
+	tconn := tls.Client(conn, config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// verifySIPDomain verifies the certificate chain of a server and that the
+// certificate is valid for the SIP domain, or for the IP address if the domain
+// is one
+func verifySIPDomain(cs tls.ConnectionState, roots *x509.CertPool, domain string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return err
+	}
+
+	if net.ParseIP(domain) != nil {
+		return leaf.VerifyHostname(domain)
+	}
+	if !slices.Contains(CertificateDomains(leaf), domain) {
+		return fmt.Errorf("%w %q", ErrCertificateDomain, domain)
+	}
+	return nil
+}
+
+// CertificateDomains returns the SIP domain identities of a certificate as of
+// RFC 5922 7.1: the domains of the sip URIs without user part in the
+// subjectAltName, else its DNS names, else the common name if there is no
+// subjectAltName. Wildcard identities are not returned, they never match a
+// SIP domain (RFC 5922 7.2). Domains are lower case.
+func CertificateDomains(cert *x509.Certificate) []string {
+	var domains []string
+	for _, uri := range cert.URIs {
+		if !strings.EqualFold(uri.Scheme, "sip") || strings.Contains(uri.Opaque, "@") {
+			continue
+		}
+		host, _, _ := strings.Cut(uri.Opaque, ";")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		domains = append(domains, host)
+	}
+	if len(domains) == 0 {
+		domains = append(domains, cert.DNSNames...)
+	}
+	if len(domains) == 0 && len(cert.URIs) == 0 && len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0 && len(cert.EmailAddresses) == 0 {
+		domains = append(domains, cert.Subject.CommonName)
+	}
+
+	valid := domains[:0]
+	for _, domain := range domains {
+		if domain != "" && !strings.Contains(domain, "*") {
+			valid = append(valid, strings.ToLower(domain))
+		}
+	}
+	return valid
+}
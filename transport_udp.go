@@ -0,0 +1,170 @@
+package sip
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// Size of the read buffer of UDP listeners, the largest UDP datagram
+const udp_buf_len = 65535
+
+// UDPTransport sends datagrams to a remote address from a UDP socket of a
+// transport layer: the socket a request was received on, or the first one of
+// the address family of the destination
+type UDPTransport struct {
+	layer *TransportLayer
+	conn  *net.UDPConn // Socket the datagrams are sent from, picked for every datagram if nil
+	raddr string
+}
+
+// Send sends a message in a datagram. Requests larger than the MTU of the
+// transport layer go over TCP only when the transport is picked for them, see
+// forRequest.
+func (t *UDPTransport) Send(msg *SIPMessage) error {
+	tl := t.layer
+	data := msg.Serialize()
+	ap, err := tl.addrs.resolve(t.raddr)
+	if err != nil {
+		return err
+	}
+	conn := t.socket(ap)
+	if conn == nil {
+		return ErrTransportClosed
+	}
+	_, err = conn.WriteToUDPAddrPort(data, ap)
+	return err
+}
+
+// oversize reports whether a serialized message is a request too large for UDP
+func (t *UDPTransport) oversize(msg *SIPMessage, data []byte) bool {
+	return msg.Request != nil && t.layer.MTU > 0 && len(data) > t.layer.MTU-mtu_margin
+}
+
+// forRequest returns the transport of a client transaction for its request,
+// with the top Via matching it. A request too large for UDP is sent over a TCP
+// connection to the remote address, which is opened right away so that the
+// transaction falls back to UDP if it is refused. The request, its
+// retransmissions, its CANCEL and the ACK of a non-2xx response then all use
+// the same transport, and the timers of the transaction are those of a
+// reliable one over TCP.
+func (t *UDPTransport) forRequest(msg *SIPMessage) (Transport, *SIPMessage) {
+	if !t.oversize(msg, msg.Serialize()) {
+		return t, msg
+	}
+	tcp := &TCPTransport{streamTransport{layer: t.layer, protocol: "tcp", raddr: t.raddr}}
+	if _, err := tcp.open(); err != nil {
+		return t, msg
+	}
+	return tcp, withViaTransport(msg, "tcp")
+}
+
+// socket returns the socket the datagrams to an address are sent from
+func (t *UDPTransport) socket(raddr netip.AddrPort) *net.UDPConn {
+	if t.conn != nil {
+		return t.conn
+	}
+	return t.layer.udpConnFor(net.UDPAddrFromAddrPort(raddr))
+}
+
+// LocalAddr returns the address of the socket, empty if it is picked for every datagram
+func (t *UDPTransport) LocalAddr() string {
+	if t.conn == nil {
+		return ""
+	}
+	return t.conn.LocalAddr().String()
+}
+
+func (t *UDPTransport) RemoteAddr() string { return t.raddr }
+func (t *UDPTransport) Protocol() string   { return "udp" }
+func (t *UDPTransport) Reliable() bool     { return false }
+func (t *UDPTransport) Secure() bool       { return false }
+
+// Close does nothing, the socket belongs to the transport layer
+func (t *UDPTransport) Close() error { return nil }
+
+func (t *UDPTransport) withRemoteAddr(raddr string) Transport {
+	return &UDPTransport{layer: t.layer, conn: t.conn, raddr: raddr}
+}
+
+// ListenUDP starts receiving on a UDP address, such as "0.0.0.0:5060" or
+// "[::]:5060". It can be called several times to listen on several addresses.
+func (tl *TransportLayer) ListenUDP(addr string) error {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.closed {
+		conn.Close()
+		return ErrTransportClosed
+	}
+	tl.udp = append(tl.udp, conn)
+
+	tl.wg.Add(1)
+	go func() {
+		defer tl.wg.Done()
+		tl.readUDP(conn)
+	}()
+	return nil
+}
+
+// UDPAddrs returns the local addresses of the UDP listeners
+func (tl *TransportLayer) UDPAddrs() []net.Addr {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	addrs := make([]net.Addr, len(tl.udp))
+	for i, conn := range tl.udp {
+		addrs[i] = conn.LocalAddr()
+	}
+	return addrs
+}
+
+// readUDP receives datagrams until the listener is closed
+func (tl *TransportLayer) readUDP(conn *net.UDPConn) {
+	buf := make([]byte, udp_buf_len)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			continue
+		}
+
+		if isSTUN(buf[:n]) { // RFC 5626 keep-alives and STUN clients
+			tl.receiveSTUN(conn, raddr.AddrPort(), buf[:n])
+			continue
+		}
+
+		// The message keeps references to its bytes, the buffer is reused
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		tl.receive(data, &UDPTransport{layer: tl, conn: conn, raddr: raddr.String()})
+	}
+}
+
+// udpConnFor picks a listener able to reach the address
+func (tl *TransportLayer) udpConnFor(raddr *net.UDPAddr) *net.UDPConn {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.closed || len(tl.udp) == 0 {
+		return nil
+	}
+
+	v4 := raddr.IP.To4() != nil
+	for _, conn := range tl.udp {
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		if ip.IsUnspecified() && ip.To4() == nil || (ip.To4() != nil) == v4 {
+			return conn
+		}
+	}
+	return tl.udp[0]
+}
@@ -0,0 +1,370 @@
+package sip
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GUID of the Sec-WebSocket-Accept computation (RFC 6455 1.3)
+const ws_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket subprotocol of SIP (RFC 7118 4.1)
+const ws_subprotocol = "sip"
+
+// WebSocket opcodes (RFC 6455 5.2)
+const (
+	ws_continuation = 0x0
+	ws_text         = 0x1
+	ws_binary       = 0x2
+	ws_close        = 0x8
+	ws_ping         = 0x9
+	ws_pong         = 0xa
+)
+
+// ErrWebSocketProtocol closes a WebSocket connection that breaks RFC 6455
+var ErrWebSocketProtocol = errors.New("websocket protocol error")
+
+// WSTransport sends messages over a WebSocket connection of a transport layer,
+// secure for the wss protocol
+type WSTransport struct{ streamTransport }
+
+// ListenWS starts accepting SIP over WebSocket connections on an address, such
+// as "0.0.0.0:80", on any path
+func (tl *TransportLayer) ListenWS(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return tl.listenHTTP(ln, "ws")
+}
+
+// ListenWSS starts accepting SIP over secure WebSocket connections on an
+// address, such as "0.0.0.0:443", with the certificates of TLSConfig
+func (tl *TransportLayer) ListenWSS(addr string) error {
+	if tl.TLSConfig == nil || len(tl.TLSConfig.Certificates) == 0 && tl.TLSConfig.GetCertificate == nil {
+		return ErrNoCertificate
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return tl.listenHTTP(tls.NewListener(ln, tl.TLSConfig), "wss")
+}
+
+// WSAddrs returns the local addresses of the WebSocket listeners, ws and wss
+func (tl *TransportLayer) WSAddrs() []net.Addr {
+	return append(tl.listenerAddrs("ws"), tl.listenerAddrs("wss")...)
+}
+
+// listenHTTP serves WebSocket upgrades on a listener
+func (tl *TransportLayer) listenHTTP(ln net.Listener, protocol string) error {
+	server := &http.Server{Handler: tl.WebSocketHandler(), ReadHeaderTimeout: dial_timeout}
+	return tl.listen(ln, protocol, func() { server.Serve(ln) })
+}
+
+/*
+	RFC 7118 4.1
+		The WebSocket Client MUST include the value "sip" in the
+		Sec-WebSocket-Protocol header.  The WebSocket Server MUST include
+		the value "sip" in the Sec-WebSocket-Protocol header in its
+		response.
+*/
+// WebSocketHandler returns the HTTP handler upgrading requests to SIP over
+// WebSocket connections, which are ws connections or wss ones for requests
+// received over TLS. It can be mounted on any HTTP server.
+func (tl *TransportLayer) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Method != http.MethodGet || !hasToken(r.Header, "Connection", "upgrade") ||
+			!hasToken(r.Header, "Upgrade", "websocket") || key == "" {
+			http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+			return
+		}
+		if !hasToken(r.Header, "Sec-WebSocket-Protocol", ws_subprotocol) {
+			http.Error(w, "sip subprotocol expected", http.StatusBadRequest)
+			return
+		}
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+
+		res := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n" +
+			"Sec-WebSocket-Protocol: " + ws_subprotocol + "\r\n\r\n"
+		conn.SetDeadline(time.Time{})
+		if _, err := conn.Write([]byte(res)); err != nil {
+			conn.Close()
+			return
+		}
+
+		// Frames the client sent right after its request
+		buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+		ws := &wsConn{Conn: conn, buf: append([]byte(nil), buffered...)}
+
+		protocol := "ws"
+		if r.TLS != nil {
+			protocol = "wss"
+		}
+		tl.serve(newStreamConn(ws, protocol))
+	})
+}
+
+// upgrade opens a WebSocket over a dialed connection
+func (tl *TransportLayer) upgrade(conn net.Conn, host string) (*wsConn, error) {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	path := tl.WSPath
+	if path == "" {
+		path = "/"
+	}
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "http", Host: host, Path: path},
+		Host:   host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-Websocket-Key":      {key},
+			"Sec-Websocket-Version":  {"13"},
+			"Sec-Websocket-Protocol": {ws_subprotocol},
+		},
+	}
+
+	conn.SetDeadline(time.Now().Add(dial_timeout))
+	br := bufio.NewReader(conn)
+	err := req.Write(conn)
+	var res *http.Response
+	if err == nil {
+		res, err = http.ReadResponse(br, req)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	conn.SetDeadline(time.Time{})
+
+	switch {
+	case res.StatusCode != http.StatusSwitchingProtocols:
+		err = fmt.Errorf("WebSocket upgrade refused: %s", res.Status)
+	case res.Header.Get("Sec-WebSocket-Accept") != wsAccept(key):
+		err = fmt.Errorf("%w: invalid Sec-WebSocket-Accept", ErrWebSocketProtocol)
+	case !strings.EqualFold(res.Header.Get("Sec-WebSocket-Protocol"), ws_subprotocol):
+		err = fmt.Errorf("%w: sip subprotocol not accepted", ErrWebSocketProtocol)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buffered, _ := br.Peek(br.Buffered())
+	return &wsConn{Conn: conn, client: true, buf: append([]byte(nil), buffered...)}, nil
+}
+
+// wsAccept returns the Sec-WebSocket-Accept of a Sec-WebSocket-Key
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + ws_guid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken reports whether a comma-separated header contains a token
+func hasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a WebSocket connection, each Write sends one message. Received
+// messages are read with readMessage.
+type wsConn struct {
+	net.Conn
+	client bool // Masks the frames it sends, expects unmasked ones
+
+	buf        []byte // Received data not yet parsed, kept when a read times out
+	msg        []byte // Fragments of the message being received
+	fragmented bool
+
+	wmu sync.Mutex // Serializes frames, control frames are sent by the reader
+}
+
+// Write sends p as one text message, SIP messages being UTF-8 (RFC 7118 5.1)
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(ws_text, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a final frame
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// readMessage returns the next data message, reassembled from its fragments.
+// It answers pings and close frames, the latter ending the connection with
+// io.EOF as a closed stream would.
+func (c *wsConn) readMessage() ([]byte, error) {
+	for {
+		fin, op, payload, err := c.nextFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case ws_text, ws_binary, ws_continuation:
+			if (op == ws_continuation) != c.fragmented {
+				return nil, fmt.Errorf("%w: unexpected continuation", ErrWebSocketProtocol)
+			}
+			if len(c.msg)+len(payload) > stream_max_msg_len {
+				return nil, ErrMessageTooLarge
+			}
+			c.msg = append(c.msg, payload...)
+			c.fragmented = !fin
+			if fin {
+				msg := c.msg
+				c.msg = nil
+				return msg, nil
+			}
+		case ws_ping:
+			if err := c.writeFrame(ws_pong, payload); err != nil {
+				return nil, err
+			}
+		case ws_pong:
+		case ws_close:
+			c.writeFrame(ws_close, payload[:min(len(payload), 2)]) // Echoes the status code
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("%w: unknown opcode %d", ErrWebSocketProtocol, op)
+		}
+	}
+}
+
+// nextFrame reads a frame, reading from the connection as needed
+func (c *wsConn) nextFrame() (fin bool, op byte, payload []byte, err error) {
+	for {
+		if fin, op, payload, ok, err := c.parseFrame(); ok || err != nil {
+			return fin, op, payload, err
+		}
+		if c.buf, err = readMore(c.buf, c.Conn); err != nil {
+			return false, 0, nil, err
+		}
+	}
+}
+
+// parseFrame removes the first frame from the buffer and unmasks it, ok is
+// false if more data is needed
+func (c *wsConn) parseFrame() (fin bool, op byte, payload []byte, ok bool, err error) {
+	if len(c.buf) < 2 {
+		return false, 0, nil, false, nil
+	}
+	fin, op = c.buf[0]&0x80 != 0, c.buf[0]&0x0f
+	masked := c.buf[1]&0x80 != 0
+	if masked == c.client {
+		// Clients mask their frames, servers do not (RFC 6455 5.1)
+		return false, 0, nil, false, fmt.Errorf("%w: invalid masking", ErrWebSocketProtocol)
+	}
+
+	header := 2
+	length := uint64(c.buf[1] & 0x7f)
+	switch length {
+	case 126:
+		header += 2
+		if len(c.buf) < header {
+			return false, 0, nil, false, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(c.buf[2:]))
+	case 127:
+		header += 8
+		if len(c.buf) < header {
+			return false, 0, nil, false, nil
+		}
+		length = binary.BigEndian.Uint64(c.buf[2:])
+	}
+	if length > stream_max_msg_len {
+		return false, 0, nil, false, ErrMessageTooLarge
+	}
+	var mask [4]byte
+	if masked {
+		if len(c.buf) < header+4 {
+			return false, 0, nil, false, nil
+		}
+		copy(mask[:], c.buf[header:])
+		header += 4
+	}
+	if uint64(len(c.buf)) < uint64(header)+length {
+		return false, 0, nil, false, nil
+	}
+
+	payload = make([]byte, length)
+	copy(payload, c.buf[header:])
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	rest := copy(c.buf, c.buf[header+int(length):])
+	c.buf = c.buf[:rest]
+	return fin, op, payload, true, nil
+}
@@ -3,7 +3,9 @@ package sip
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
 	"strconv"
+	"strings"
 )
 
 type SIPUri struct {
@@ -60,8 +62,16 @@ func ParseSipUri(uri []byte) (SIPUri, error) {
 		}
 	}
 
-	// Parse domain and port
+	// Parse domain and port, the colons of an IPv6 reference are not a port separator
 	colonIndex = bytes.IndexByte(rest, ':')
+	if len(rest) > 0 && rest[0] == '[' {
+		if end := bytes.IndexByte(rest, ']'); end != -1 {
+			colonIndex = bytes.IndexByte(rest[end:], ':')
+			if colonIndex != -1 {
+				colonIndex += end
+			}
+		}
+	}
 	if colonIndex == -1 {
 		sipURI.Domain = rest
 	} else {
@@ -135,3 +145,92 @@ func (uri SIPUri) Serialize() []byte {
 
 	return buffer
 }
+
+// Default ports of SIP and SIPS URIs (RFC 3261 19.1.2)
+const (
+	DefaultPort    = 5060
+	DefaultTLSPort = 5061
+)
+
+/*
+	RFC 3261 26.2.2
+		A SIPS URI specifies that the resource be contacted securely.  This
+		means, in particular, that TLS is to be used between the UAC and the
+		domain that owns the URI.
+*/
+// IsSecure reports whether the URI is a SIPS URI
+func (uri SIPUri) IsSecure() bool {
+	return bytes.EqualFold(uri.Scheme, []byte("sips"))
+}
+
+// Param returns the value of a parameter of the URI, such as transport or
+// maddr, ok is false if the URI does not have the parameter
+func (uri SIPUri) Param(name string) (value []byte, ok bool) {
+	return lookupParam(uri.Opts, name)
+}
+
+// Transport returns the transport to reach the URI with: TLS for a SIPS URI,
+// or WSS with transport=ws, the transport parameter otherwise, UDP by default.
+// It is lower case.
+func (uri SIPUri) Transport() string {
+	transport, ok := uri.Param("transport")
+	switch {
+	case uri.IsSecure() && strings.EqualFold(string(transport), "ws"):
+		return "wss"
+	case uri.IsSecure():
+		return "tls"
+	case ok:
+		return strings.ToLower(string(transport))
+	default:
+		return "udp"
+	}
+}
+
+// SetHostPort sets the host and the port of the URI to an address, such as the
+// reflexive address returned by TransportLayer.Reflexive for a Contact
+func (uri *SIPUri) SetHostPort(addr netip.AddrPort) {
+	uri.Domain = []byte(hostOf(addr.Addr()))
+	uri.Port = int(addr.Port())
+}
+
+// hostOf formats an address as the host of a URI or of a sent-by, IPv6
+// addresses between brackets
+func hostOf(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is6() {
+		return "[" + addr.String() + "]"
+	}
+	return addr.String()
+}
+
+// lookupParam finds a parameter in a ;-separated list of parameters
+func lookupParam(params []byte, name string) ([]byte, bool) {
+	for _, param := range bytes.Split(params, []byte(";")) {
+		key, value, _ := bytes.Cut(param, []byte("="))
+		if bytes.EqualFold(bytes.TrimSpace(key), []byte(name)) {
+			return bytes.TrimSpace(value), true
+		}
+	}
+	return nil, false
+}
+
+// setParam sets a parameter in a ;-separated list of parameters, without
+// value if value is nil
+func setParam(params []byte, name string, value []byte) []byte {
+	var set []byte
+	for _, param := range bytes.Split(params, []byte(";")) {
+		key, _, _ := bytes.Cut(param, []byte("="))
+		if len(param) == 0 || bytes.EqualFold(bytes.TrimSpace(key), []byte(name)) {
+			continue
+		}
+		set = append(set, param...)
+		set = append(set, ';')
+	}
+
+	set = append(set, name...)
+	if value != nil {
+		set = append(set, '=')
+		set = append(set, value...)
+	}
+	return set
+}
@@ -3,6 +3,7 @@ package sip
 import (
 	"bytes"
 	"fmt"
+	"net/netip"
 	"strconv"
 	"strings"
 )
@@ -19,7 +20,7 @@ func ParseSipVia(via []byte) (SIPVia, error) {
 	sipVia := SIPVia{Port: -1} // Default value for Port
 
 	// Find first space to separate protocol
-	spaceIndex := bytes.IndexByte(via, ' ')
+	spaceIndex := bytes.IndexAny(via, " \t")
 	if spaceIndex == -1 {
 		return sipVia, fmt.Errorf("missing protocol or domain in %q", via)
 	}
@@ -42,13 +43,15 @@ func ParseSipVia(via []byte) (SIPVia, error) {
 		// No options, everything after space is domain
 		domainPart = rest
 	} else {
-		// Split domain and options
 		domainPart = rest[:semiIndex]
-		sipVia.Opts = rest[semiIndex+1:] // Options start after semicolon
 	}
+	domainPart = bytes.TrimSpace(domainPart)
 
-	// Find port (split by colon)
-	colonIndex := bytes.IndexByte(domainPart, ':')
+	// Find port (split by colon), the colons of an IPv6 reference are not a port separator
+	colonIndex := bytes.LastIndexByte(domainPart, ':')
+	if colonIndex != -1 && bytes.IndexByte(domainPart[colonIndex:], ']') != -1 {
+		colonIndex = -1
+	}
 	if colonIndex == -1 {
 		sipVia.Domain = domainPart
 	} else {
@@ -60,23 +63,20 @@ func ParseSipVia(via []byte) (SIPVia, error) {
 		sipVia.Port = port
 	}
 
-	// Extract branch if exists
-	if sipVia.Opts != nil {
-		branchIndex := bytes.Index(sipVia.Opts, []byte("branch="))
-		if branchIndex != -1 {
-			// Find end of branch value (delimited by ';' or end of options)
-			endIndex := bytes.IndexByte(sipVia.Opts[branchIndex+7:], ';')
-			if endIndex == -1 {
-				sipVia.Branch = sipVia.Opts[branchIndex+7:]
-				sipVia.Opts = sipVia.Opts[:branchIndex] // Remove "branch=" and its value
-			} else {
-				sipVia.Branch = sipVia.Opts[branchIndex+7 : branchIndex+7+endIndex]
-				sipVia.Opts = append(sipVia.Opts[:branchIndex], sipVia.Opts[branchIndex+7+endIndex:]...)
+	// Extract branch, the other options are kept in order, each after a semicolon
+	if semiIndex != -1 {
+		for _, param := range bytes.Split(rest[semiIndex+1:], []byte(";")) {
+			param = bytes.TrimSpace(param)
+			if len(param) == 0 {
+				continue
 			}
-		}
-
-		if len(sipVia.Opts) == 0 {
-			sipVia.Opts = nil
+			name, value, _ := bytes.Cut(param, []byte("="))
+			if bytes.EqualFold(bytes.TrimSpace(name), []byte("branch")) {
+				sipVia.Branch = bytes.TrimSpace(value)
+				continue
+			}
+			sipVia.Opts = append(sipVia.Opts, ';')
+			sipVia.Opts = append(sipVia.Opts, param...)
 		}
 	}
 
@@ -120,3 +120,21 @@ func (via SIPVia) Serialize() []byte {
 
 	return buffer
 }
+
+// Param returns the value of an option of the Via, such as received or rport,
+// ok is false if the Via does not have the option
+func (via SIPVia) Param(name string) (value []byte, ok bool) {
+	return lookupParam(via.Opts, name)
+}
+
+// SetParam sets an option of the Via, without value if value is nil
+func (via *SIPVia) SetParam(name string, value []byte) {
+	via.Opts = append([]byte{';'}, setParam(bytes.TrimPrefix(via.Opts, []byte(";")), name, value)...)
+}
+
+// SetSentBy sets the sent-by of the Via to an address, such as the reflexive
+// address returned by TransportLayer.Reflexive
+func (via *SIPVia) SetSentBy(addr netip.AddrPort) {
+	via.Domain = []byte(hostOf(addr.Addr()))
+	via.Port = int(addr.Port())
+}